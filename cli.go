@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"scraper/internal/config"
+	"scraper/internal/scraper"
+	"scraper/internal/selectors"
+	"sort"
+	"strings"
+)
+
+// settings holds the knobs for a single command, defaulted from the config profile and overridden by flags
+type settings struct {
+	cfg                *config.Config
+	fullhist           bool   //false if only want 3 months of data, true if want full data on fsm website
+	priceRange         string //preset, from..to dates or auto, overrides fullhist
+	planningPath       string //Planning workbook containing the Planning and Link sheets
+	universePath       string //Exported xlsx listing every fund on FSM, empty lists the funds table
+	tableName          string
+	batchsize          int //290 seems to be the max limit to download in 1 session, decreases over time
+	downloadWithinDays int
+	downloadFolder     string
+	source             string //planning, universe or watchlist
+	watchlistPath      string //CSV watchlist, or - to read fund names from stdin
+	downloadLog        string //CSV file to append a line to for every download
+	dryRun             bool
+	resume             string  //id of a crashed run to continue
+	includeBroken      bool    //try funds that failed too many runs in a row instead of skipping them
+	db                 *sql.DB //shared connection for the daemon, other commands connect when they need to
+	selectorsPath      string  //selector overrides
+	snapshotsDir       string  //saved FSM pages to check selectors against
+	maxPages           int     //listing pages universe crawl reads per filter
+}
+
+func defaultSettings(cfg *config.Config) settings {
+	return settings{
+		cfg:                cfg,
+		fullhist:           cfg.Scrape.FullHist,
+		priceRange:         cfg.Scrape.Range,
+		planningPath:       cfg.Paths.Planning,
+		universePath:       cfg.Paths.Universe,
+		tableName:          cfg.Database.Table,
+		batchsize:          cfg.Scrape.Batchsize,
+		downloadWithinDays: cfg.Scrape.DownloadWithinDays,
+		source:             "planning",
+		watchlistPath:      cfg.Paths.Watchlist,
+		selectorsPath:      cfg.Paths.Selectors,
+		snapshotsDir:       cfg.Paths.Snapshots,
+		maxPages:           cfg.Crawl.MaxPages,
+	}
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, s settings) error
+	flags func(fs *flag.FlagSet, s *settings)
+}
+
+var commands = []command{
+	{
+		name:  "scrape planning",
+		usage: "Download prices for every fund listed in the Planning workbook",
+		run:   scrape,
+		flags: func(fs *flag.FlagSet, s *settings) {
+			s.source = "planning"
+			s.downloadFolder = s.cfg.Paths.PlanningDownloads
+			planningFlags(fs, s)
+			scrapeFlags(fs, s)
+		},
+	},
+	{
+		name:  "scrape universe",
+		usage: "Download prices for funds in the universe that have not been downloaded recently",
+		run:   scrape,
+		flags: func(fs *flag.FlagSet, s *settings) {
+			s.source = "universe"
+			s.downloadFolder = s.cfg.Paths.UniverseDownloads
+			universeFlags(fs, s)
+			scrapeFlags(fs, s)
+			fs.IntVar(&s.batchsize, "batchsize", s.batchsize, "maximum number of funds to download in one run")
+			fs.IntVar(&s.downloadWithinDays, "within-days", s.downloadWithinDays, "skip funds downloaded within this many days")
+		},
+	},
+	{
+		name:  "scrape watchlist",
+		usage: "Download prices for every fund in a CSV watchlist or read from stdin",
+		run:   scrape,
+		flags: func(fs *flag.FlagSet, s *settings) {
+			s.source = "watchlist"
+			s.downloadFolder = s.cfg.Paths.WatchlistDownloads
+			watchlistFlags(fs, s)
+			planningFlags(fs, s)
+			scrapeFlags(fs, s)
+		},
+	},
+	{
+		name:  "daemon",
+		usage: "Stay running, log in once and scrape on the schedules in the daemon section of the config",
+		run:   daemon,
+		flags: func(fs *flag.FlagSet, s *settings) {
+			planningFlags(fs, s)
+			universeFlags(fs, s)
+			watchlistFlags(fs, s)
+			fs.BoolVar(&s.fullhist, "fullhist", s.fullhist, "download 10 years of prices instead of the default 3 months")
+			rangeFlag(fs, s)
+			fs.StringVar(&s.downloadLog, "download-log", s.downloadLog, "CSV file to append a line to for every download")
+			fs.BoolVar(&s.includeBroken, "include-broken", s.includeBroken, "try funds that failed too many runs in a row instead of skipping them")
+			fs.BoolVar(&s.dryRun, "dry-run", s.dryRun, "print when each job will next run without launching a browser")
+		},
+	},
+	{
+		name:  "links resolve",
+		usage: "Find factsheet links for funds that do not have one yet",
+		run:   resolveLinks,
+		flags: sourceFlags,
+	},
+	{
+		name:  "universe crawl",
+		usage: "Walk the fund selector listing and add every fund to the funds table",
+		run:   crawlUniverse,
+		flags: func(fs *flag.FlagSet, s *settings) {
+			s.source = "universe"
+			fs.StringVar(&s.tableName, "table", s.tableName, "database table holding the funds")
+			fs.IntVar(&s.maxPages, "max-pages", s.maxPages, "listing pages to read per filter, 0 reads them all")
+		},
+	},
+	{
+		name:  "process downloads",
+		usage: "Move today's FSM exports for Planning funds out of Downloads and compile them",
+		run:   processDownloads,
+		flags: planningFlags,
+	},
+	{
+		name:  "selectors check",
+		usage: "Check every page selector against saved HTML snapshots of the FSM pages",
+		run:   checkSelectors,
+		flags: func(fs *flag.FlagSet, s *settings) {
+			fs.StringVar(&s.snapshotsDir, "snapshots", s.snapshotsDir, "folder of saved pages named after the page of each selector, e.g. factsheet.html")
+		},
+	},
+	{
+		name:  "status",
+		usage: "Show how many funds are known, linked and due for download",
+		run:   status,
+		flags: func(fs *flag.FlagSet, s *settings) {
+			sourceFlags(fs, s)
+			fs.IntVar(&s.downloadWithinDays, "within-days", s.downloadWithinDays, "count funds not downloaded within this many days as stale")
+		},
+	},
+}
+
+func planningFlags(fs *flag.FlagSet, s *settings) {
+	fs.StringVar(&s.planningPath, "planning", s.planningPath, "path to the Planning workbook")
+}
+
+func universeFlags(fs *flag.FlagSet, s *settings) {
+	fs.StringVar(&s.universePath, "universe", s.universePath, "path to an exported xlsx listing every fund, empty lists the funds table filled by universe crawl")
+	fs.StringVar(&s.tableName, "table", s.tableName, "database table holding the funds")
+}
+
+func watchlistFlags(fs *flag.FlagSet, s *settings) {
+	fs.StringVar(&s.watchlistPath, "watchlist", s.watchlistPath, "CSV file with a fund name in the first column, - reads one fund name per line from stdin")
+}
+
+func sourceFlags(fs *flag.FlagSet, s *settings) {
+	fs.StringVar(&s.source, "source", s.source, "which funds to work on: planning, universe or watchlist")
+	planningFlags(fs, s)
+	universeFlags(fs, s)
+	watchlistFlags(fs, s)
+}
+
+func scrapeFlags(fs *flag.FlagSet, s *settings) {
+	fs.BoolVar(&s.fullhist, "fullhist", s.fullhist, "download 10 years of prices instead of the default 3 months")
+	rangeFlag(fs, s)
+	fs.StringVar(&s.downloadFolder, "out", s.downloadFolder, "folder to save downloaded price files to")
+	fs.StringVar(&s.downloadLog, "download-log", s.downloadLog, "CSV file to append a line to for every download")
+	fs.StringVar(&s.resume, "resume", s.resume, "id of a run that stopped early to continue where it left off")
+	fs.BoolVar(&s.includeBroken, "include-broken", s.includeBroken, "try funds that failed too many runs in a row instead of skipping them")
+	fs.BoolVar(&s.dryRun, "dry-run", s.dryRun, "list the funds that would be looked up, scraped and skipped without launching a browser")
+}
+
+func rangeFlag(fs *flag.FlagSet, s *settings) {
+	fs.StringVar(&s.priceRange, "range", s.priceRange, "prices to download: 1M, 3M, 6M, YTD, 1Y, 3Y, 5Y, 10Y, from..to dates such as 2020-01-01..2024-06-30, or auto for the gap since the last download")
+}
+
+// run parses the global flags, loads the config and then parses the rest of args into a command and runs it
+func run(ctx context.Context, args []string, stderr io.Writer) error {
+	global := flag.NewFlagSet("fsm", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() { printUsage(stderr) }
+	configPath := global.String("config", "", "path to the config file, defaults to $FSM_CONFIG or config.yaml")
+	profile := global.String("profile", "", "config profile to use, defaults to $FSM_PROFILE or the profile named in the config file")
+	if err := global.Parse(args); err != nil {
+		return err
+	}
+
+	cmd, rest, err := findCommand(global.Args())
+	if err != nil {
+		printUsage(stderr)
+		return err
+	}
+
+	cfg, err := config.Load(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+
+	s := defaultSettings(cfg)
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cmd.flags(fs, &s)
+	if err := fs.Parse(rest); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments for %s: %s", cmd.name, strings.Join(fs.Args(), " "))
+	}
+	if s.batchsize <= 0 {
+		return fmt.Errorf("batchsize must be positive, got %d", s.batchsize)
+	}
+	if s.dryRun && s.resume != "" {
+		return fmt.Errorf("-dry-run cannot be used with -resume, run status to see the funds left in run %s", s.resume)
+	}
+	if s.source != "planning" && s.source != "universe" && s.source != "watchlist" {
+		return fmt.Errorf("source must be planning, universe or watchlist, got %s", s.source)
+	}
+
+	scraper.Selectors, err = selectors.Load(s.selectorsPath)
+	if err != nil {
+		return err
+	}
+
+	return cmd.run(ctx, s)
+}
+
+func findCommand(args []string) (command, []string, error) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], nil
+		}
+	}
+
+	if len(args) == 0 {
+		return command{}, nil, fmt.Errorf("no command given")
+	}
+	return command{}, nil, fmt.Errorf("unknown command: %s", strings.Join(args, " "))
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [-config file] [-profile name] <command> [flags]\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	usages := make(map[string]string, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+		usages[cmd.name] = cmd.usage
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-20s %s\n", name, usages[name])
+	}
+	fmt.Fprint(w, "\nRun '<command> -h' to see the flags for a command.\n")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCLI(t *testing.T) {
+	t.Run("Testing finding two word commands", func(t *testing.T) {
+		cmd, rest, err := findCommand([]string{"scrape", "universe", "-batchsize", "10"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd.name != "scrape universe" {
+			t.Fatalf("Expected scrape universe, got %s", cmd.name)
+		}
+		if len(rest) != 2 || rest[0] != "-batchsize" {
+			t.Fatalf("Expected flags to be left for the command, got %v", rest)
+		}
+	})
+
+	t.Run("Testing unknown commands", func(t *testing.T) {
+		for _, args := range [][]string{{}, {"scrape"}, {"scrape", "everything"}} {
+			if err := run(context.Background(), args, io.Discard); err == nil {
+				t.Fatalf("Expected error for %v, none given", args)
+			}
+		}
+	})
+
+	t.Run("Testing flags override defaults", func(t *testing.T) {
+		var got settings
+		cmd := command{name: "scrape universe", run: func(ctx context.Context, s settings) error { got = s; return nil }}
+		for _, c := range commands {
+			if c.name == cmd.name {
+				cmd.flags = c.flags
+			}
+		}
+
+		commands = append([]command{cmd}, commands...)
+		defer func() { commands = commands[1:] }()
+
+		err := run(context.Background(), []string{"-profile", "prod", "scrape", "universe", "-batchsize", "10", "-within-days", "7", "-fullhist", "-out", "data/tmp"}, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := defaultSettings(got.cfg)
+		want.batchsize = 10
+		want.downloadWithinDays = 7
+		want.fullhist = true
+		want.downloadFolder = "data/tmp"
+		want.source = "universe"
+		if got.cfg.Profile != "prod" {
+			t.Fatalf("Expected prod profile to be loaded, got %s", got.cfg.Profile)
+		}
+		if got != want {
+			t.Fatalf("Expected %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("Testing invalid batchsize", func(t *testing.T) {
+		if err := run(context.Background(), []string{"scrape", "universe", "-batchsize", "0"}, io.Discard); err == nil {
+			t.Fatal("Expected error for zero batchsize, none given")
+		}
+	})
+
+	t.Run("Testing dry run cannot resume a run", func(t *testing.T) {
+		err := run(context.Background(), []string{"scrape", "planning", "-dry-run", "-resume", "20240823-190000.123"}, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "-dry-run cannot be used with -resume") {
+			t.Fatalf("Expected usage error for -dry-run with -resume, got %v", err)
+		}
+	})
+}
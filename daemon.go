@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"scraper/internal/config"
+	"scraper/internal/database"
+	"scraper/internal/schedule"
+	"scraper/internal/scraper"
+	"time"
+	_ "time/tzdata" //schedules name a timezone, which may not be installed on the host
+)
+
+// job is a daemon job from the config with its schedule parsed
+type job struct {
+	config.Job
+	schedule *schedule.Schedule
+}
+
+// parseJobs reads the daemon jobs from the config, returning them with the location their schedules are in
+func parseJobs(cfg *config.Config) ([]job, *time.Location, error) {
+	loc, err := time.LoadLocation(cfg.Daemon.Timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid daemon timezone: %w", err)
+	}
+	if len(cfg.Daemon.Jobs) == 0 {
+		return nil, nil, fmt.Errorf("no jobs in the daemon section of the config")
+	}
+
+	var jobs []job
+	for _, j := range cfg.Daemon.Jobs {
+		if j.Name == "" {
+			j.Name = j.Source
+		}
+		if j.Source != "planning" && j.Source != "universe" && j.Source != "watchlist" {
+			return nil, nil, fmt.Errorf("job %s: source must be planning, universe or watchlist, got %s", j.Name, j.Source)
+		}
+
+		s, err := schedule.Parse(j.Schedule)
+		if err != nil {
+			return nil, nil, fmt.Errorf("job %s: %w", j.Name, err)
+		}
+		// nextJob would take the zero time as due right away, e.g. for 0 0 31 2 *
+		if s.Next(time.Now().In(loc)).IsZero() {
+			return nil, nil, fmt.Errorf("job %s: schedule %s never runs", j.Name, j.Schedule)
+		}
+		jobs = append(jobs, job{Job: j, schedule: s})
+	}
+
+	return jobs, loc, nil
+}
+
+// nextJob returns the job that is due first after now and when it is due. Jobs due at the same time run in the order
+// they are listed in the config.
+func nextJob(jobs []job, now time.Time) (job, time.Time) {
+	var next job
+	var at time.Time
+	for _, j := range jobs {
+		if t := j.schedule.Next(now); at.IsZero() || t.Before(at) {
+			next, at = j, t
+		}
+	}
+	return next, at
+}
+
+// jobSettings applies a job over the daemon's settings
+func jobSettings(s settings, j job) settings {
+	s.source = j.Source
+	s.downloadFolder = downloadFolder(s.cfg, j.Source)
+	if j.Batchsize > 0 {
+		s.batchsize = j.Batchsize
+	}
+	if j.DownloadWithinDays > 0 {
+		s.downloadWithinDays = j.DownloadWithinDays
+	}
+	return s
+}
+
+func downloadFolder(cfg *config.Config, source string) string {
+	switch source {
+	case "universe":
+		return cfg.Paths.UniverseDownloads
+	case "watchlist":
+		return cfg.Paths.WatchlistDownloads
+	default:
+		return cfg.Paths.PlanningDownloads
+	}
+}
+
+// daemon logs in once and then runs each job whenever its schedule is due, until it is stopped
+func daemon(ctx context.Context, s settings) error {
+	jobs, loc, err := parseJobs(s.cfg)
+	if err != nil {
+		return err
+	}
+
+	if s.dryRun {
+		printSchedule(os.Stdout, jobs, time.Now().In(loc), 3)
+		return nil
+	}
+
+	for _, j := range jobs {
+		if j.Source == "universe" {
+			s.db, err = database.ConnectDB(ctx, s.cfg.Database)
+			if err != nil {
+				return err
+			}
+			defer s.db.Close()
+			break
+		}
+	}
+
+	session, err := scraper.Login(ctx, s.cfg.Browser, s.cfg.Login)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for {
+		j, at := nextJob(jobs, time.Now().In(loc))
+		log.Printf("Next job %s at %s", j.Name, at.Format("2006-01-02 15:04 MST"))
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Print("Daemon stopped")
+			return nil
+		case <-timer.C:
+		}
+
+		if err := runJob(ctx, jobSettings(s, j), session); err != nil {
+			log.Printf("Job %s failed: %v", j.Name, err)
+		}
+	}
+}
+
+// runJob runs one scrape in the daemon's logged in session
+func runJob(ctx context.Context, s settings, session *scraper.Session) error {
+	p, err := newPipeline(ctx, s)
+	if err != nil {
+		return err
+	}
+	p.Session = session
+	if err := prepareStores(ctx, s, p); err != nil {
+		return err
+	}
+
+	summary, err := p.Run(ctx)
+	if len(summary.Results) != 0 {
+		summary.Print(os.Stdout)
+	}
+	return err
+}
+
+// printSchedule lists the next n times each job will run
+func printSchedule(w io.Writer, jobs []job, now time.Time, n int) {
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%s (%s, %s):\n", j.Name, j.Source, j.Schedule)
+		t := now
+		for i := 0; i < n; i++ {
+			t = j.schedule.Next(t)
+			fmt.Fprintf(w, "  %s\n", t.Format("Mon 2006-01-02 15:04 MST"))
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigPath = "config.yaml"
+
+// Config holds every setting the scraper needs, loaded from a config file profile and environment variables
+type Config struct {
+	Profile   string    `yaml:"-"`
+	Database  Database  `yaml:"database"`
+	Browser   Browser   `yaml:"browser"`
+	Login     Login     `yaml:"login"`
+	Export    Export    `yaml:"export"`
+	Factsheet Factsheet `yaml:"factsheet"`
+	Crawl     Crawl     `yaml:"crawl"`
+	Links     Links     `yaml:"links"`
+	Paths     Paths     `yaml:"paths"`
+	Scrape    Scrape    `yaml:"scrape"`
+	Retry     Retry     `yaml:"retry"`
+	Daemon    Daemon    `yaml:"daemon"`
+}
+
+type Database struct {
+	User     string `yaml:"user" env:"FSM_DB_USER,DBUSER"`
+	Password string `yaml:"password" env:"FSM_DB_PASSWORD,DBPASS"`
+	Addr     string `yaml:"addr" env:"FSM_DB_ADDR"`
+	Name     string `yaml:"name" env:"FSM_DB_NAME"`
+	Table    string `yaml:"table" env:"FSM_DB_TABLE"`
+}
+
+type Browser struct {
+	DownloadDir string `yaml:"download_dir" env:"FSM_DOWNLOAD_DIR"` //Where chrome saves files, also where process downloads looks for FSM exports
+	PoolLimit   int    `yaml:"pool_limit" env:"FSM_POOL_LIMIT"`     //Number of pages that can be loaded concurrently, at least 1
+	Headless    bool   `yaml:"headless" env:"FSM_HEADLESS"`         //Run chrome without a window, needs login mode auto
+	Block       Block  `yaml:"block"`
+}
+
+// Block sets which requests worker pages fail instead of sending. A request is blocked if its resource type, as Chrome
+// names it (Image, Font, Media, Stylesheet, Script...), is in ResourceTypes or its URL matches one of URLPatterns, where
+// * matches anything.
+type Block struct {
+	Enabled       bool     `yaml:"enabled" env:"FSM_BLOCK"`
+	ResourceTypes []string `yaml:"resource_types"`
+	URLPatterns   []string `yaml:"url_patterns"`
+	MeasureBytes  bool     `yaml:"measure_bytes" env:"FSM_BLOCK_MEASURE_BYTES"` //HEAD each url blocked by type once to count the bytes saved
+}
+
+// Login sets how the scraper logs in to FSM. Mode interactive waits for the user to log in in the browser window, auto
+// fills the login form with Username and Password, which are best left to FSM_USERNAME / FSM_PASSWORD or a SecretsFile.
+type Login struct {
+	Mode        string         `yaml:"mode" env:"FSM_LOGIN_MODE"`
+	URL         string         `yaml:"url" env:"FSM_LOGIN_URL"`
+	CheckURL    string         `yaml:"check_url" env:"FSM_LOGIN_CHECK_URL"` //page that redirects to URL once the session has lapsed
+	Username    string         `yaml:"username" env:"FSM_USERNAME"`
+	Password    string         `yaml:"password" env:"FSM_PASSWORD"`
+	SecretsFile string         `yaml:"secrets_file" env:"FSM_SECRETS_FILE"` //.env style file with FSM_USERNAME and FSM_PASSWORD
+	Timeout     time.Duration  `yaml:"timeout" env:"FSM_LOGIN_TIMEOUT"`
+	Selectors   LoginSelectors `yaml:"selectors"`
+
+	// The logged in session is saved to SessionFile, encrypted with Passphrase or the contents of KeyFile, so later
+	// runs reuse it until it is SessionMaxAge old or its cookies expire. Without a passphrase or key file nothing is saved.
+	SessionFile   string        `yaml:"session_file" env:"FSM_SESSION_FILE"`
+	Passphrase    string        `yaml:"passphrase" env:"FSM_SESSION_PASSPHRASE"`
+	KeyFile       string        `yaml:"key_file" env:"FSM_SESSION_KEY_FILE"`
+	SessionMaxAge time.Duration `yaml:"session_max_age" env:"FSM_SESSION_MAX_AGE"`
+}
+
+// LoginSelectors are the CSS selectors of the login form. Success is optional, without it leaving the login page
+// counts as logged in. Account is optional too, without it staying on CheckURL counts as still logged in.
+type LoginSelectors struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Submit   string `yaml:"submit"`
+	Success  string `yaml:"success"`
+	Error    string `yaml:"error"`
+	Account  string `yaml:"account"` //optional, only shown when logged in, checked on CheckURL
+}
+
+// Export sets how prices are downloaded. Mode browser clicks Export on every factsheet, direct learns the request behind
+// the Export button from the first fund and sends it over HTTP with the logged in cookies for the rest.
+type Export struct {
+	Mode     string        `yaml:"mode" env:"FSM_EXPORT_MODE"`
+	Endpoint string        `yaml:"endpoint" env:"FSM_EXPORT_ENDPOINT"` //where the learned request is saved, delete it to learn again
+	Timeout  time.Duration `yaml:"timeout" env:"FSM_EXPORT_TIMEOUT"`
+}
+
+// Factsheet sets what is read from each fund page besides its prices. It is only read when the page is opened, so not
+// for funds fetched in direct export mode.
+type Factsheet struct {
+	Info          bool `yaml:"info" env:"FSM_FACTSHEET_INFO"`                   //fund house, currency, risk rating and the other key facts
+	Distributions bool `yaml:"distributions" env:"FSM_FACTSHEET_DISTRIBUTIONS"` //dividend history, off by default as it opens another tab
+	Allocations   bool `yaml:"allocations" env:"FSM_FACTSHEET_ALLOCATIONS"`     //top holdings and sector, region and asset class weights, also another tab
+}
+
+// Crawl sets how universe crawl walks the fund selector listing. Without Filters the whole listing is walked once,
+// with them it is walked once per filter, e.g. per fund house when the listing only pages through so many funds.
+type Crawl struct {
+	Filters     []string      `yaml:"filters"`                                   //labels of the listing filters to click, one at a time
+	MaxPages    int           `yaml:"max_pages" env:"FSM_CRAWL_MAX_PAGES"`       //pages per filter, 0 walks them all
+	PageTimeout time.Duration `yaml:"page_timeout" env:"FSM_CRAWL_PAGE_TIMEOUT"` //how long a listing page gets to load
+}
+
+// Links sets when a fund selector search result is taken as the fund searched for. The best result is used if its name
+// scores at least MinScore, from 0 to 1, and beats the next best by Margin. Otherwise the ranked results are written to
+// ReviewFile for someone to pick, and the picked link is used the next time the fund is looked up.
+type Links struct {
+	MinScore   float64 `yaml:"min_score"`
+	Margin     float64 `yaml:"margin"`
+	ReviewFile string  `yaml:"review_file" env:"FSM_LINKS_REVIEW_FILE"`
+}
+
+type Paths struct {
+	Planning           string `yaml:"planning" env:"FSM_PLANNING"`
+	Universe           string `yaml:"universe" env:"FSM_UNIVERSE"` //Exported xlsx of every fund, empty lists the funds table filled by universe crawl
+	PlanningDownloads  string `yaml:"planning_downloads" env:"FSM_PLANNING_DOWNLOADS"`
+	UniverseDownloads  string `yaml:"universe_downloads" env:"FSM_UNIVERSE_DOWNLOADS"`
+	Watchlist          string `yaml:"watchlist" env:"FSM_WATCHLIST"`
+	WatchlistDownloads string `yaml:"watchlist_downloads" env:"FSM_WATCHLIST_DOWNLOADS"`
+	Data               string `yaml:"data" env:"FSM_DATA"`
+	Runs               string `yaml:"runs" env:"FSM_RUNS"` //Run journals used to resume crashed runs
+	CompileScript      string `yaml:"compile_script" env:"FSM_COMPILE_SCRIPT"`
+	Selectors          string `yaml:"selectors" env:"FSM_SELECTORS"` //Selector overrides, missing uses the built in selectors
+	Snapshots          string `yaml:"snapshots" env:"FSM_SNAPSHOTS"` //Saved FSM pages that selectors check runs against
+}
+
+type Scrape struct {
+	FullHist           bool              `yaml:"fullhist" env:"FSM_FULLHIST"`   //same as range 10Y, kept for older configs
+	Range              string            `yaml:"range" env:"FSM_RANGE"`         //1M, 3M, 6M, YTD, 1Y, 3Y, 5Y, 10Y, from..to dates or auto
+	FundRanges         map[string]string `yaml:"fund_ranges"`                   //range by fund name, overriding Range
+	Batchsize          int               `yaml:"batchsize" env:"FSM_BATCHSIZE"` //290 seems to be the max limit to download in 1 session, decreases over time
+	DownloadWithinDays int               `yaml:"download_within_days" env:"FSM_DOWNLOAD_WITHIN_DAYS"`
+	ShutdownGrace      time.Duration     `yaml:"shutdown_grace" env:"FSM_SHUTDOWN_GRACE"`           //how long funds already downloading get to finish after Ctrl+C
+	CheckSessionEvery  int               `yaml:"check_session_every" env:"FSM_CHECK_SESSION_EVERY"` //funds between session checks, 0 only checks before the batch
+}
+
+// Retry sets how a failing fund download is retried. Transient failures such as timeouts are retried with backoff,
+// permanent ones such as a renamed fund are not by default.
+type Retry struct {
+	TransientAttempts   int           `yaml:"transient_attempts" env:"FSM_RETRY_TRANSIENT_ATTEMPTS"`
+	PermanentAttempts   int           `yaml:"permanent_attempts" env:"FSM_RETRY_PERMANENT_ATTEMPTS"`
+	BaseDelay           time.Duration `yaml:"base_delay" env:"FSM_RETRY_BASE_DELAY"`
+	MaxDelay            time.Duration `yaml:"max_delay" env:"FSM_RETRY_MAX_DELAY"`
+	AttemptTimeout      time.Duration `yaml:"attempt_timeout" env:"FSM_RETRY_ATTEMPT_TIMEOUT"`
+	SkipAfterFailedRuns int           `yaml:"skip_after_failed_runs" env:"FSM_RETRY_SKIP_AFTER_FAILED_RUNS"` //permanently failed runs in a row before a fund is skipped, 0 never skips
+}
+
+// Daemon lists the jobs the daemon command runs on a schedule, with schedules read in Timezone
+type Daemon struct {
+	Timezone string `yaml:"timezone" env:"FSM_DAEMON_TIMEZONE"`
+	Jobs     []Job  `yaml:"jobs"`
+}
+
+// Job is a scrape the daemon runs whenever Schedule, a cron expression, matches
+type Job struct {
+	Name               string `yaml:"name"`
+	Schedule           string `yaml:"schedule"`
+	Source             string `yaml:"source"`               //planning, universe or watchlist
+	Batchsize          int    `yaml:"batchsize"`            //0 uses scrape.batchsize
+	DownloadWithinDays int    `yaml:"download_within_days"` //0 uses scrape.download_within_days
+}
+
+// file is the layout of the config file, top level settings are shared by every profile
+type file struct {
+	Profile  string `yaml:"profile"`
+	Config   `yaml:",inline"`
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+}
+
+// Default returns the settings used when no config file or environment variable overrides them
+func Default() *Config {
+	return &Config{
+		Profile: "dev",
+		Database: Database{
+			Addr:  "127.0.0.1:3306",
+			Name:  "recordings",
+			Table: "funds",
+		},
+		Browser: Browser{
+			DownloadDir: "~/Downloads",
+			PoolLimit:   5,
+			Block: Block{
+				Enabled:       true,
+				ResourceTypes: []string{"Image", "Font", "Media"},
+				URLPatterns: []string{
+					"*google-analytics.com*",
+					"*googletagmanager.com*",
+					"*doubleclick.net*",
+					"*connect.facebook.net*",
+					"*hotjar.com*",
+					"*livechatinc.com*",
+				},
+			},
+		},
+		Login: Login{
+			Mode:     "interactive",
+			URL:      "https://secure.fundsupermart.com/fsm/account/login",
+			CheckURL: "https://secure.fundsupermart.com/fsm/account/dashboard",
+			Timeout:  time.Minute,
+			Selectors: LoginSelectors{
+				Username: `#username, input[name="username"], input[type="email"]`,
+				Password: `input[type="password"]`,
+				Submit:   `button[type="submit"], input[type="submit"]`,
+				Error:    `.error, .alert-danger, [role="alert"]`,
+			},
+			SessionFile:   "data/session.enc",
+			SessionMaxAge: 24 * time.Hour,
+		},
+		Export: Export{
+			Mode:     "browser",
+			Endpoint: "data/export_endpoint.json",
+			Timeout:  time.Minute,
+		},
+		Factsheet: Factsheet{
+			Info: true,
+		},
+		Crawl: Crawl{
+			PageTimeout: 30 * time.Second,
+		},
+		Links: Links{
+			MinScore:   0.9,
+			Margin:     0.05,
+			ReviewFile: "data/links_review.csv",
+		},
+		Paths: Paths{
+			Planning:           "Planning.xlsx",
+			PlanningDownloads:  "data/planning",
+			UniverseDownloads:  "data/downloaded",
+			Watchlist:          "watchlist.csv",
+			WatchlistDownloads: "data/watchlist",
+			Data:               "data",
+			Runs:               "data/runs",
+			CompileScript:      "compile_data.py",
+			Selectors:          "selectors.yaml",
+			Snapshots:          "data/snapshots",
+		},
+		Scrape: Scrape{
+			FullHist:           false,
+			Batchsize:          1000,
+			DownloadWithinDays: 3,
+			ShutdownGrace:      30 * time.Second,
+			CheckSessionEvery:  50,
+		},
+		Retry: Retry{
+			TransientAttempts:   3,
+			PermanentAttempts:   1,
+			BaseDelay:           5 * time.Second,
+			MaxDelay:            2 * time.Minute,
+			AttemptTimeout:      3 * time.Minute,
+			SkipAfterFailedRuns: 3,
+		},
+		Daemon: Daemon{
+			Timezone: "Asia/Singapore",
+		},
+	}
+}
+
+// Load reads the config file at path, applies the named profile over the shared settings and then applies
+// environment variable overrides. An empty path falls back to $FSM_CONFIG and then config.yaml, which may be missing.
+// An empty profile falls back to $FSM_PROFILE and then the profile named in the file.
+func Load(path, profile string) (*Config, error) {
+	// Load environment variables from .env file if there is one
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error loading .env file: %w", err)
+	}
+
+	optional := false
+	if path == "" {
+		path = os.Getenv("FSM_CONFIG")
+	}
+	if path == "" {
+		path = defaultConfigPath
+		optional = true
+	}
+	if profile == "" {
+		profile = os.Getenv("FSM_PROFILE")
+	}
+
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := parse(data, profile, cfg); err != nil {
+			return nil, fmt.Errorf("error reading config %s: %w", path, err)
+		}
+	case optional && errors.Is(err, os.ErrNotExist):
+		if profile != "" {
+			cfg.Profile = profile
+		}
+	default:
+		return nil, fmt.Errorf("error opening config: %w", err)
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	cfg.Browser.DownloadDir, err = expandHome(cfg.Browser.DownloadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pages are taken from a pool this big, with no pages every Get would wait forever
+	if cfg.Browser.PoolLimit < 1 {
+		return nil, fmt.Errorf("browser pool_limit must be at least 1, got %d", cfg.Browser.PoolLimit)
+	}
+
+	return cfg, nil
+}
+
+func parse(data []byte, profile string, cfg *Config) error {
+	f := file{Config: *cfg}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*cfg = f.Config
+
+	if profile == "" {
+		profile = f.Profile
+	}
+	if profile == "" {
+		return nil
+	}
+
+	node, ok := f.Profiles[profile]
+	if !ok {
+		return fmt.Errorf("profile %s not found", profile)
+	}
+	if err := node.Decode(cfg); err != nil {
+		return fmt.Errorf("error reading profile %s: %w", profile, err)
+	}
+	cfg.Profile = profile
+
+	return nil
+}
+
+// applyEnv overrides fields tagged with env using the first of the listed environment variables that is set
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		structField := v.Type().Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag := structField.Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+
+		for _, name := range strings.Split(tag, ",") {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setField(field, value); err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Kind())
+	}
+
+	return nil
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~")), nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+profile: dev
+database:
+  addr: 127.0.0.1:3306
+  name: recordings
+browser:
+  pool_limit: 3
+profiles:
+  dev:
+    browser:
+      download_dir: /tmp/dev
+  prod:
+    database:
+      addr: db.internal:3306
+    browser:
+      download_dir: /srv/fsm/downloads
+      pool_limit: 8
+    scrape:
+      batchsize: 290
+    retry:
+      base_delay: 10s
+`
+
+func TestConfig(t *testing.T) {
+	path := writeTestConfig(t, testConfig)
+
+	t.Run("Testing profile from file", func(t *testing.T) {
+		cfg, err := Load(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, cfg.Profile, "dev")
+		assertEqual(t, cfg.Browser.DownloadDir, "/tmp/dev")
+		assertEqual(t, cfg.Browser.PoolLimit, 3)
+		assertEqual(t, cfg.Database.Table, "funds")
+	})
+
+	t.Run("Testing profile overrides shared settings", func(t *testing.T) {
+		cfg, err := Load(path, "prod")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, cfg.Database.Addr, "db.internal:3306")
+		assertEqual(t, cfg.Database.Name, "recordings")
+		assertEqual(t, cfg.Browser.PoolLimit, 8)
+		assertEqual(t, cfg.Scrape.Batchsize, 290)
+		assertEqual(t, cfg.Scrape.DownloadWithinDays, 3)
+		assertEqual(t, cfg.Retry.BaseDelay, 10*time.Second)
+		assertEqual(t, cfg.Retry.TransientAttempts, 3)
+	})
+
+	t.Run("Testing environment variables override profile", func(t *testing.T) {
+		t.Setenv("FSM_PROFILE", "prod")
+		t.Setenv("FSM_POOL_LIMIT", "2")
+		t.Setenv("DBUSER", "legacy")
+		t.Setenv("FSM_FULLHIST", "true")
+		t.Setenv("FSM_SHUTDOWN_GRACE", "1m")
+
+		cfg, err := Load(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, cfg.Profile, "prod")
+		assertEqual(t, cfg.Browser.PoolLimit, 2)
+		assertEqual(t, cfg.Database.User, "legacy")
+		assertEqual(t, cfg.Scrape.FullHist, true)
+		assertEqual(t, cfg.Scrape.ShutdownGrace, time.Minute)
+	})
+
+	t.Run("Testing invalid environment variable", func(t *testing.T) {
+		t.Setenv("FSM_POOL_LIMIT", "many")
+
+		if _, err := Load(path, ""); err == nil {
+			t.Fatal("Expected error, none given")
+		}
+	})
+
+	t.Run("Testing pool limit below 1", func(t *testing.T) {
+		t.Setenv("FSM_POOL_LIMIT", "0")
+
+		if _, err := Load(path, ""); err == nil || !strings.Contains(err.Error(), "pool_limit") {
+			t.Fatalf("Expected error for pool limit 0, got %v", err)
+		}
+	})
+
+	t.Run("Testing unknown profile", func(t *testing.T) {
+		if _, err := Load(path, "staging"); err == nil {
+			t.Fatal("Expected error, none given")
+		}
+	})
+
+	t.Run("Testing missing config files", func(t *testing.T) {
+		if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), ""); err == nil {
+			t.Fatal("Expected error for missing explicit config, none given")
+		}
+
+		cfg, err := Load("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, cfg.Paths.Planning, Default().Paths.Planning)
+	})
+
+	t.Run("Testing home directory is expanded", func(t *testing.T) {
+		t.Setenv("HOME", "/home/fsm")
+		t.Setenv("FSM_DOWNLOAD_DIR", "~/Downloads")
+
+		cfg, err := Load(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, cfg.Browser.DownloadDir, "/home/fsm/Downloads")
+	})
+}
+
+func writeTestConfig(t testing.TB, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func assertEqual[T comparable](t testing.TB, got, want T) {
+	t.Helper()
+
+	if got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
@@ -1,94 +1,163 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"net/url"
+	"path"
+	"scraper/internal/config"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
 )
 
 var db *sql.DB
 
+// ErrFundNotFound is returned when an update matches no fund in the table
+var ErrFundNotFound = errors.New("fund not found")
+
+// ErrNotMigrated is returned when the funds table was made before funds had codes and no command that writes has
+// migrated it yet
+var ErrNotMigrated = errors.New("funds table has no fund codes yet, run scrape universe or universe crawl to add them")
+
+// Fund is a fund on FSM. Its Code, read from the factsheet link, is what identifies it, as FSM renames funds over time.
+// Code is empty for funds whose link is not a factsheet link.
 type Fund struct {
 	ID             int64
+	Code           string
 	Fundname       string
 	Link           string
 	Lastdownloaded []uint8
 }
 
-func ConnectDB() *sql.DB {
-	// Load environment variables from .env file
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file: %s", err)
+// CodeFromLink returns the FSM fund code at the end of a factsheet link such as
+// https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019, or "" if link is not a factsheet link
+func CodeFromLink(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	dir, code := path.Split(strings.TrimSuffix(u.Path, "/"))
+	if !strings.HasSuffix(dir, "/factsheet/") {
+		return ""
+	}
+	return code
+}
+
+// WithCode returns fund with its Code read from its link if it does not have one yet
+func (f Fund) WithCode() Fund {
+	if f.Code == "" {
+		f.Code = CodeFromLink(f.Link)
 	}
+	return f
+}
 
+// Key is what files and lookups of fund are keyed on, its code or its name if it has none
+func (f Fund) Key() string {
+	if f.Code != "" {
+		return f.Code
+	}
+	return f.Fundname
+}
+
+func ConnectDB(ctx context.Context, settings config.Database) (*sql.DB, error) {
 	// Capture connection properties.
 	cfg := mysql.Config{
-		User:                 os.Getenv("DBUSER"),
-		Passwd:               os.Getenv("DBPASS"),
+		User:                 settings.User,
+		Passwd:               settings.Password,
 		Net:                  "tcp",
-		Addr:                 "127.0.0.1:3306",
-		DBName:               "recordings",
+		Addr:                 settings.Addr,
+		DBName:               settings.Name,
 		AllowNativePasswords: true,
+		ClientFoundRows:      true, //count matched rows on update, so downloading a fund twice in a day is not an error
 	}
 	// Get a database handle.
 	var err error
 	db, err = sql.Open("mysql", cfg.FormatDSN())
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("error opening database: %w", err)
 	}
 
-	pingErr := db.Ping()
+	pingErr := db.PingContext(ctx)
 	if pingErr != nil {
-		log.Fatal(pingErr)
+		return nil, fmt.Errorf("error connecting to database %s: %w", settings.Addr, pingErr)
 	}
 	fmt.Println("Connected!")
 
-	return db
+	return db, nil
 }
 
-func AddFund(db *sql.DB, tableName string, fund Fund) int64 {
-	result, err := db.Exec(fmt.Sprintf("INSERT INTO %s (fundname, link) VALUES (?, ?)", tableName), fund.Fundname, fund.Link)
+// AddFund adds fund to the table, its code read from its link if it has none. A fund whose code is already in the table
+// is the same fund under a new name or link, so its row is updated instead and keeps its download history.
+func AddFund(ctx context.Context, db *sql.DB, tableName string, fund Fund) (int64, error) {
+	fund = fund.WithCode()
+	result, err := db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (code, fundname, link) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), fundname = VALUES(fundname), link = VALUES(link)",
+		tableName), nullable(fund.Code), fund.Fundname, fund.Link)
 	if err != nil {
-		log.Fatalf("addFund: %v", err)
+		return 0, fmt.Errorf("addFund: %w", err)
 	}
 	id, err := result.LastInsertId()
 	if err != nil {
-		log.Fatalf("addFund: %v", err)
+		return 0, fmt.Errorf("addFund: %w", err)
 	}
-	log.Printf("Added %s to %s with index %v", fund.Fundname, tableName, id)
-	return id
+	log.Printf("Added %s (%s) to %s with index %v", fund.Fundname, fund.Code, tableName, id)
+	return id, nil
 }
 
-func FundsByNames(db *sql.DB, tableName string, names []string) ([]Fund, error) {
-	template := fmt.Sprintf("SELECT * FROM %s WHERE fundname IN (", tableName)
-	for _, name := range names {
-		template = template + fmt.Sprintf("'%s',", name)
+// nullable stores an empty code as NULL, so funds without one do not clash on the unique key
+func nullable(code string) any {
+	if code == "" {
+		return nil
 	}
-	template = template[:len(template)-1]
-	template += ");"
+	return code
+}
 
-	funds, err := queryFunds(db, template)
+func FundsByNames(ctx context.Context, db *sql.DB, tableName string, names []string) ([]Fund, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	template := fmt.Sprintf("SELECT %s FROM %s WHERE fundname IN (?%s);", fundColumns, tableName, strings.Repeat(", ?", len(names)-1))
+	args := make([]any, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+
+	funds, err := queryFunds(ctx, db, template, args...)
 	return funds, err
 }
 
-func queryFunds(db *sql.DB, template string) ([]Fund, error) {
+func AllFunds(ctx context.Context, db *sql.DB, tableName string) ([]Fund, error) {
+	return queryFunds(ctx, db, fmt.Sprintf("SELECT %s FROM %s;", fundColumns, tableName))
+}
+
+// fundColumns are the columns queryFunds scans, in order
+const fundColumns = "id, code, fundname, link, lastdownloaded"
+
+func queryFunds(ctx context.Context, db *sql.DB, template string, args ...any) ([]Fund, error) {
 	var funds []Fund
 
-	rows, err := db.Query(template)
+	rows, err := db.QueryContext(ctx, template, args...)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errUnknownColumn {
+		return nil, fmt.Errorf("get funds: %w", ErrNotMigrated)
+	}
 	if err != nil {
-		log.Fatalf("get funds by template %s: %v", template, err)
+		return nil, fmt.Errorf("get funds by template %s: %w", template, err)
 	}
 	defer rows.Close()
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var fund Fund
-		if err := rows.Scan(&fund.ID, &fund.Fundname, &fund.Link, &fund.Lastdownloaded); err != nil {
+		var code sql.NullString
+		if err := rows.Scan(&fund.ID, &code, &fund.Fundname, &fund.Link, &fund.Lastdownloaded); err != nil {
 			return nil, fmt.Errorf("error obtaining values from row: %v", err)
 		}
+		fund.Code = code.String
 		funds = append(funds, fund)
 	}
 	if err := rows.Err(); err != nil {
@@ -100,8 +169,8 @@ func queryFunds(db *sql.DB, template string) ([]Fund, error) {
 	return funds, nil
 }
 
-func FundsNotInNames(db *sql.DB, tableName string, names []string) ([]string, error) {
-	funds, err := FundsByNames(db, tableName, names)
+func FundsNotInNames(ctx context.Context, db *sql.DB, tableName string, names []string) ([]string, error) {
+	funds, err := FundsByNames(ctx, db, tableName, names)
 	if err != nil {
 		return nil, err
 	}
@@ -117,22 +186,102 @@ func FundsNotInNames(db *sql.DB, tableName string, names []string) ([]string, er
 	return fundsNotIn, nil
 }
 
-// Create fund table if it does not exist
-func CreateFundTable(db *sql.DB, tableName string) {
-	_, err := db.Exec(fmt.Sprintf(
+// Create fund table if it does not exist, or add the code column to a table made before funds had codes
+func CreateFundTable(ctx context.Context, db *sql.DB, tableName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
 		`
 		CREATE TABLE IF NOT EXISTS %s (
 			id INT AUTO_INCREMENT PRIMARY KEY,
+			code VARCHAR(32) UNIQUE,
 			fundname VARCHAR(128) NOT NULL,
 			link VARCHAR(255) NOT NULL,
 			lastdownloaded DATETIME
 		);
 		`, tableName))
 	if err != nil {
-		log.Fatalf("Error creating fund table: %s", err)
+		return fmt.Errorf("error creating fund table: %w", err)
 	}
+	return MigrateFundTable(ctx, db, tableName)
 }
 
+// MigrateFundTable adds the code column to a funds table made before funds had codes, and fills it in from the links
+// of funds that have none yet. Funds listed twice under one code keep their code on the first row only.
+func MigrateFundTable(ctx context.Context, db *sql.DB, tableName string) error {
+	hasCode, err := columnExists(ctx, db, tableName, "code")
+	if err != nil {
+		return err
+	}
+	if !hasCode {
+		log.Printf("Adding fund codes to %s", tableName)
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN code VARCHAR(32) UNIQUE AFTER id", tableName)); err != nil {
+			return fmt.Errorf("error adding code to fund table: %w", err)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT id, link FROM %s WHERE code IS NULL", tableName))
+	if err != nil {
+		return fmt.Errorf("error migrating fund table: %w", err)
+	}
+	codes := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var link string
+		if err := rows.Scan(&id, &link); err != nil {
+			rows.Close()
+			return fmt.Errorf("error obtaining values from row: %w", err)
+		}
+		if code := CodeFromLink(link); code != "" {
+			codes[id] = code
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error migrating fund table: %w", err)
+	}
+
+	for id, code := range codes {
+		_, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET code = ? WHERE id = ?", tableName), code, id)
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == errDuplicateEntry {
+			log.Printf("Fund %d has the same code %s as another fund, leaving it without one", id, code)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error migrating fund table: %w", err)
+		}
+	}
+	return nil
+}
+
+// tableExists tells whether tableName is in the connected database
+func tableExists(ctx context.Context, db *sql.DB, tableName string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", tableName).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("error checking %s: %w", tableName, err)
+	}
+	return n > 0, nil
+}
+
+// columnExists tells whether tableName has column
+func columnExists(ctx context.Context, db *sql.DB, tableName, column string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		tableName, column).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("error checking %s: %w", tableName, err)
+	}
+	return n > 0, nil
+}
+
+// MySQL errors for a value already taken in a unique column and a column the table does not have
+const (
+	errDuplicateEntry = 1062
+	errUnknownColumn  = 1054
+)
+
 // difference returns the elements in `a` that aren't in `b`.
 func Difference(a, b []string) []string {
 	mb := make(map[string]struct{}, len(b))
@@ -148,47 +297,53 @@ func Difference(a, b []string) []string {
 	return diff
 }
 
-func CreateTestFundTable(db *sql.DB, testTableName string) {
-	_, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s;", testTableName))
+func CreateTestFundTable(ctx context.Context, db *sql.DB, testTableName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", testTableName))
 	if err != nil {
-		log.Fatalf("Error deleting fund table: %s", err)
+		return fmt.Errorf("error deleting fund table: %w", err)
 	}
 
-	CreateFundTable(db, testTableName)
+	return CreateFundTable(ctx, db, testTableName)
 }
 
-func UpdateFundName(db *sql.DB, tableName, oldfundName, newfundName string) {
-	result, err := db.Exec(fmt.Sprintf("UPDATE %s SET fundname = '%s' WHERE fundname = '%s'", tableName, newfundName, oldfundName))
+func UpdateFundName(ctx context.Context, db *sql.DB, tableName, oldfundName, newfundName string) error {
+	result, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET fundname = ? WHERE fundname = ?", tableName), newfundName, oldfundName)
 	if err != nil {
-		log.Fatalf("Error deleting fund table: %s", err)
+		return fmt.Errorf("error updating name for %s: %w", oldfundName, err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if rowsAffected == 0 {
-		log.Fatalf("No rows affected when updating name for %s", oldfundName)
-	}
+	return checkUpdated(result, oldfundName)
 }
 
-func FundsNotDownloadedWithinDays(db *sql.DB, tableName string, days int) ([]Fund, error) {
-	template := fmt.Sprintf("SELECT * FROM %s WHERE lastdownloaded NOT BETWEEN CURDATE() - INTERVAL %v DAY AND CURDATE() OR lastdownloaded IS NULL;", tableName, days)
-	funds, err := queryFunds(db, template)
+func FundsNotDownloadedWithinDays(ctx context.Context, db *sql.DB, tableName string, days int) ([]Fund, error) {
+	template := fmt.Sprintf("SELECT %s FROM %s WHERE lastdownloaded NOT BETWEEN CURDATE() - INTERVAL %v DAY AND CURDATE() OR lastdownloaded IS NULL;", fundColumns, tableName, days)
+	funds, err := queryFunds(ctx, db, template)
 	return funds, err
 }
 
-func UpdateLastDownloaded(db *sql.DB, tableName, fundName string) {
-	result, err := db.Exec(fmt.Sprintf("UPDATE %s SET lastdownloaded = CURDATE() WHERE fundname = '%s'", tableName, fundName))
+// UpdateLastDownloaded records that fund was downloaded today, finding it by its code if it has one so a rename since
+// it was looked up does not matter
+func UpdateLastDownloaded(ctx context.Context, db *sql.DB, tableName string, fund Fund) error {
+	column, key := "fundname", fund.Fundname
+	if fund.Code != "" {
+		column, key = "code", fund.Code
+	}
+	result, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET lastdownloaded = CURDATE() WHERE %s = ?", tableName, column), key)
 	if err != nil {
-		log.Fatalf("Error deleting fund table: %s", err)
+		return fmt.Errorf("error updating last downloaded for %s: %w", fund.Fundname, err)
 	}
 
+	return checkUpdated(result, fund.Fundname)
+}
+
+// checkUpdated returns ErrFundNotFound if the update did not match any row
+func checkUpdated(result sql.Result, fundName string) error {
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if rowsAffected == 0 {
-		log.Fatalf("No rows affected when updating last downloaded for %s", fundName)
+		return fmt.Errorf("%s: %w", fundName, ErrFundNotFound)
 	}
+	return nil
 }
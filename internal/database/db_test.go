@@ -1,27 +1,44 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"scraper/internal/config"
 	"testing"
+	"time"
 )
 
 func TestDB(t *testing.T) {
 	t.Run("Testing DB", func(t *testing.T) {
 		tableName := "testfunds"
-		db := ConnectDB()
+		ctx := context.Background()
+		cfg, err := config.Load("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := ConnectDB(ctx, cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		CreateTestFundTable(db, tableName)
+		if err := CreateTestFundTable(ctx, db, tableName); err != nil {
+			t.Fatal(err)
+		}
 		funds := []Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}, {Fundname: "fund3", Link: "link3"}}
 
 		var addedFunds []Fund
 		for _, fund := range funds {
-			id := AddFund(db, tableName, fund)
+			id, err := AddFund(ctx, db, tableName, fund)
+			if err != nil {
+				t.Fatal(err)
+			}
 			fund.ID = id
 			addedFunds = append(addedFunds, fund)
 		}
 
-		results, err := FundsByNames(db, tableName, []string{"fund1", "fund2"})
+		results, err := FundsByNames(ctx, db, tableName, []string{"fund1", "fund2"})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -30,7 +47,7 @@ func TestDB(t *testing.T) {
 			t.Fatalf("Queried results from fundsByNames are wrong, expected %+v, got %+v", addedFunds[:2], results)
 		}
 
-		fundsNotIn, err := FundsNotInNames(db, tableName, []string{"fund1", "fund2", "fund3", "fund4"})
+		fundsNotIn, err := FundsNotInNames(ctx, db, tableName, []string{"fund1", "fund2", "fund3", "fund4"})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -40,7 +57,7 @@ func TestDB(t *testing.T) {
 			t.Fatalf("Queried results from fundsNotInNames are wrong, expected %+v, got %+v", []string{"fund4"}, fundsNotIn)
 		}
 
-		queriedFunds, err := FundsNotDownloadedWithinDays(db, tableName, 5)
+		queriedFunds, err := FundsNotDownloadedWithinDays(ctx, db, tableName, 5)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -49,9 +66,16 @@ func TestDB(t *testing.T) {
 		}
 
 		fund5 := Fund{Fundname: "fund5", Link: "link5"}
-		AddFund(db, tableName, fund5)
-		UpdateFundName(db, tableName, "fund5", "newfund5")
-		queriedFunds, err = FundsByNames(db, tableName, []string{"newfund5"})
+		if _, err := AddFund(ctx, db, tableName, fund5); err != nil {
+			t.Fatal(err)
+		}
+		if err := UpdateFundName(ctx, db, tableName, "fund5", "newfund5"); err != nil {
+			t.Fatal(err)
+		}
+		if err := UpdateFundName(ctx, db, tableName, "fund6", "newfund6"); !errors.Is(err, ErrFundNotFound) {
+			t.Fatalf("Expected ErrFundNotFound when updating missing fund, got %v", err)
+		}
+		queriedFunds, err = FundsByNames(ctx, db, tableName, []string{"newfund5"})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -63,8 +87,14 @@ func TestDB(t *testing.T) {
 		}
 
 		//Fund successfully downloaded
-		UpdateLastDownloaded(db, tableName, "newfund5")
-		queriedFunds, err = FundsNotDownloadedWithinDays(db, tableName, 5)
+		if err := UpdateLastDownloaded(ctx, db, tableName, Fund{Fundname: "newfund5"}); err != nil {
+			t.Fatal(err)
+		}
+		// Downloading again on the same day should not be an error
+		if err := UpdateLastDownloaded(ctx, db, tableName, Fund{Fundname: "newfund5"}); err != nil {
+			t.Fatal(err)
+		}
+		queriedFunds, err = FundsNotDownloadedWithinDays(ctx, db, tableName, 5)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -74,4 +104,248 @@ func TestDB(t *testing.T) {
 		}
 	})
 
+	t.Run("Testing fund info is saved and replaced", func(t *testing.T) {
+		tableName := InfoTable("testfunds")
+		ctx := context.Background()
+		cfg, err := config.Load("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := ConnectDB(ctx, cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", tableName)); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateFundInfoTable(ctx, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+
+		info := FundInfo{FundHouse: "AllianceBernstein", BaseCurrency: "USD", RiskRating: "4", ExpenseRatio: "1.85%"}
+		if err := SaveFundInfo(ctx, db, tableName, "fund1", info); err != nil {
+			t.Fatal(err)
+		}
+		info.FundHouse = "AB"
+		if err := SaveFundInfo(ctx, db, tableName, "fund1", info); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := FundInfoByKey(ctx, db, tableName, "fund1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != info {
+			t.Fatalf("Expected %+v, got %+v", info, got)
+		}
+		if _, err := FundInfoByKey(ctx, db, tableName, "fund2"); !errors.Is(err, ErrFundNotFound) {
+			t.Fatalf("Expected ErrFundNotFound for fund without info, got %v", err)
+		}
+	})
+
+	t.Run("Testing distributions are saved once per ex-date and type", func(t *testing.T) {
+		tableName := DistributionTable("testfunds")
+		ctx := context.Background()
+		cfg, err := config.Load("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := ConnectDB(ctx, cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", tableName)); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateDistributionTable(ctx, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+
+		july := time.Date(2024, 7, 15, 0, 0, 0, 0, time.UTC)
+		distributions := []Distribution{
+			{ExDate: july.AddDate(0, -1, 0), Amount: 0.05, Currency: "USD", Type: "Dividend"},
+			{ExDate: july, PayDate: july.AddDate(0, 0, 16), Amount: 0.0512, Currency: "USD", Type: "Dividend"},
+		}
+		if err := SaveDistributions(ctx, db, tableName, "fund1", distributions); err != nil {
+			t.Fatal(err)
+		}
+		if err := SaveDistributions(ctx, db, tableName, "fund1", distributions[1:]); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := DistributionsByKey(ctx, db, tableName, "fund1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, distributions) {
+			t.Fatalf("Expected %+v, got %+v", distributions, got)
+		}
+	})
+	t.Run("Testing allocation snapshots are kept by their as-of date", func(t *testing.T) {
+		tableName := AllocationTable("testfunds")
+		ctx := context.Background()
+		cfg, err := config.Load("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := ConnectDB(ctx, cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", tableName)); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateAllocationTable(ctx, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+
+		may := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+		june := time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)
+		snapshots := [][]Allocation{
+			{{AsOf: may, Kind: AllocationSector, Name: "Technology", Weight: 30}, {AsOf: may, Kind: AllocationSector, Name: "Energy", Weight: 5}},
+			{{AsOf: june, Kind: AllocationSector, Name: "Technology", Weight: 31}},
+			{{AsOf: june, Kind: AllocationSector, Name: "Technology", Weight: 32.5}},
+		}
+		for _, allocations := range snapshots {
+			if err := SaveAllocations(ctx, db, tableName, "fund1", allocations); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := AllocationsByKey(ctx, db, tableName, "fund1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(snapshots[0], snapshots[2]...)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Expected %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("Testing fund codes are read from factsheet links", func(t *testing.T) {
+		tests := map[string]string{
+			"https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019":  "ACM019",
+			"https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019/": "ACM019",
+			"/fsmone/funds/factsheet/ACM019?tab=overview":                     "ACM019",
+			"https://secure.fundsupermart.com/fsmone/funds/fund-selector":     "",
+			"link1": "",
+		}
+		for link, want := range tests {
+			if got := CodeFromLink(link); got != want {
+				t.Errorf("Expected code %q from %s, got %q", want, link, got)
+			}
+		}
+
+		fund := Fund{Fundname: "AB American Income A2 USD", Link: "/fsmone/funds/factsheet/ACM019"}.WithCode()
+		if fund.Code != "ACM019" || fund.Key() != "ACM019" {
+			t.Fatalf("Expected fund keyed on ACM019, got code %q and key %q", fund.Code, fund.Key())
+		}
+		if key := (Fund{Fundname: "fund1", Link: "link1"}).Key(); key != "fund1" {
+			t.Fatalf("Expected a fund without a code keyed on its name, got %q", key)
+		}
+	})
+
+	t.Run("Testing a renamed fund keeps its row", func(t *testing.T) {
+		tableName := "testfunds_codes"
+		ctx := context.Background()
+		cfg, err := config.Load("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := ConnectDB(ctx, cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := CreateTestFundTable(ctx, db, tableName); err != nil {
+			t.Fatal(err)
+		}
+		link := "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"
+		id, err := AddFund(ctx, db, tableName, Fund{Fundname: "AB American Income A2 USD", Link: link})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := UpdateLastDownloaded(ctx, db, tableName, Fund{Code: "ACM019", Fundname: "AB American Income A2 USD"}); err != nil {
+			t.Fatal(err)
+		}
+		renamedID, err := AddFund(ctx, db, tableName, Fund{Fundname: "AB American Income Portfolio A2 USD", Link: link})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if renamedID != id {
+			t.Fatalf("Expected the renamed fund to keep index %d, got %d", id, renamedID)
+		}
+
+		funds, err := AllFunds(ctx, db, tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(funds) != 1 || funds[0].Code != "ACM019" || funds[0].Fundname != "AB American Income Portfolio A2 USD" || funds[0].Lastdownloaded == nil {
+			t.Fatalf("Expected one fund ACM019 under its new name with its download date, got %+v", funds)
+		}
+
+		//Downloads are recorded by code, even under the name the fund had when it was picked
+		if err := UpdateLastDownloaded(ctx, db, tableName, Fund{Code: "ACM019", Fundname: "AB American Income A2 USD"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Testing factsheet tables keyed on names are moved to fund codes", func(t *testing.T) {
+		fundTable := "testfunds_keys"
+		ctx := context.Background()
+		cfg, err := config.Load("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := ConnectDB(ctx, cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := CreateTestFundTable(ctx, db, fundTable); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AddFund(ctx, db, fundTable, Fund{Fundname: "fund1", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AddFund(ctx, db, fundTable, Fund{Fundname: "fund2", Link: "link2"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The allocation table as it was made before funds had codes
+		tableName := AllocationTable(fundTable)
+		for _, query := range []string{
+			fmt.Sprintf("DROP TABLE IF EXISTS %s, %s, %s", InfoTable(fundTable), DistributionTable(fundTable), tableName),
+			fmt.Sprintf("CREATE TABLE %s (fundname VARCHAR(128) NOT NULL, as_of DATE NOT NULL, kind VARCHAR(16) NOT NULL, name VARCHAR(255) NOT NULL, weight DECIMAL(9, 4) NOT NULL, PRIMARY KEY (fundname, as_of, kind, name))", tableName),
+			fmt.Sprintf("INSERT INTO %s VALUES ('fund1', '2024-05-31', 'sector', 'Technology', 30), ('fund2', '2024-05-31', 'sector', 'Energy', 5)", tableName),
+		} {
+			if _, err := db.ExecContext(ctx, query); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Twice, as every universe run migrates
+		for range 2 {
+			if err := MigrateFactsheetTables(ctx, db, fundTable); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		may := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+		for key, want := range map[string][]Allocation{
+			"ACM019": {{AsOf: may, Kind: AllocationSector, Name: "Technology", Weight: 30}},
+			"fund2":  {{AsOf: may, Kind: AllocationSector, Name: "Energy", Weight: 5}},
+		} {
+			got, err := AllocationsByKey(ctx, db, tableName, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %+v under %s, got %+v", want, key, got)
+			}
+		}
+	})
 }
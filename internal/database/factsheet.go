@@ -0,0 +1,310 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// FundInfo is the key facts shown on a fund's factsheet, kept as FSM displays them
+type FundInfo struct {
+	FundHouse        string
+	BaseCurrency     string
+	ShareClass       string
+	RiskRating       string
+	InceptionDate    string
+	FundSize         string
+	ExpenseRatio     string
+	DealingFrequency string
+	MinInvestment    string
+}
+
+// InfoTable is the table holding the FundInfo of the funds in tableName
+func InfoTable(tableName string) string {
+	return tableName + "_info"
+}
+
+// CreateFundInfoTable creates the table for fund info if it does not exist
+func CreateFundInfoTable(ctx context.Context, db *sql.DB, tableName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		`
+		CREATE TABLE IF NOT EXISTS %s (
+			fund_key VARCHAR(128) PRIMARY KEY,
+			fund_house VARCHAR(128) NOT NULL,
+			base_currency VARCHAR(16) NOT NULL,
+			share_class VARCHAR(64) NOT NULL,
+			risk_rating VARCHAR(64) NOT NULL,
+			inception_date VARCHAR(32) NOT NULL,
+			fund_size VARCHAR(64) NOT NULL,
+			expense_ratio VARCHAR(32) NOT NULL,
+			dealing_frequency VARCHAR(64) NOT NULL,
+			min_investment VARCHAR(64) NOT NULL,
+			updated DATETIME NOT NULL
+		);
+		`, tableName))
+	if err != nil {
+		return fmt.Errorf("error creating fund info table: %w", err)
+	}
+	return nil
+}
+
+// SaveFundInfo stores info as the latest for the fund with fundKey, its Fund.Key, replacing what was read before
+func SaveFundInfo(ctx context.Context, db *sql.DB, tableName, fundKey string, info FundInfo) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		`
+		INSERT INTO %s (fund_key, fund_house, base_currency, share_class, risk_rating, inception_date, fund_size, expense_ratio, dealing_frequency, min_investment, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE
+			fund_house = VALUES(fund_house), base_currency = VALUES(base_currency), share_class = VALUES(share_class),
+			risk_rating = VALUES(risk_rating), inception_date = VALUES(inception_date), fund_size = VALUES(fund_size),
+			expense_ratio = VALUES(expense_ratio), dealing_frequency = VALUES(dealing_frequency),
+			min_investment = VALUES(min_investment), updated = VALUES(updated)
+		`, tableName),
+		fundKey, info.FundHouse, info.BaseCurrency, info.ShareClass, info.RiskRating, info.InceptionDate, info.FundSize,
+		info.ExpenseRatio, info.DealingFrequency, info.MinInvestment)
+	if err != nil {
+		return fmt.Errorf("error saving info for %s: %w", fundKey, err)
+	}
+	return nil
+}
+
+// FundInfoByKey returns the stored info of the fund with fundKey
+func FundInfoByKey(ctx context.Context, db *sql.DB, tableName, fundKey string) (FundInfo, error) {
+	var info FundInfo
+	row := db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT fund_house, base_currency, share_class, risk_rating, inception_date, fund_size, expense_ratio, dealing_frequency, min_investment FROM %s WHERE fund_key = ?",
+		tableName), fundKey)
+	err := row.Scan(&info.FundHouse, &info.BaseCurrency, &info.ShareClass, &info.RiskRating, &info.InceptionDate, &info.FundSize,
+		&info.ExpenseRatio, &info.DealingFrequency, &info.MinInvestment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FundInfo{}, fmt.Errorf("%s: %w", fundKey, ErrFundNotFound)
+	}
+	if err != nil {
+		return FundInfo{}, fmt.Errorf("error getting info for %s: %w", fundKey, err)
+	}
+	return info, nil
+}
+
+// Distribution is one dividend or other distribution paid by a fund
+type Distribution struct {
+	ExDate   time.Time
+	PayDate  time.Time //zero if the page does not show it
+	Amount   float64   //per unit
+	Currency string
+	Type     string //e.g. Dividend or Capital
+}
+
+// DistributionTable is the table holding the distributions of the funds in tableName
+func DistributionTable(tableName string) string {
+	return tableName + "_distributions"
+}
+
+// CreateDistributionTable creates the table for distributions if it does not exist
+func CreateDistributionTable(ctx context.Context, db *sql.DB, tableName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		`
+		CREATE TABLE IF NOT EXISTS %s (
+			fund_key VARCHAR(128) NOT NULL,
+			ex_date DATE NOT NULL,
+			pay_date DATE,
+			amount DECIMAL(18, 8) NOT NULL,
+			currency VARCHAR(16) NOT NULL,
+			type VARCHAR(64) NOT NULL,
+			PRIMARY KEY (fund_key, ex_date, type)
+		);
+		`, tableName))
+	if err != nil {
+		return fmt.Errorf("error creating distribution table: %w", err)
+	}
+	return nil
+}
+
+// SaveDistributions stores the distributions of the fund with fundKey, replacing any already stored for the same
+// ex-date and type
+func SaveDistributions(ctx context.Context, db *sql.DB, tableName, fundKey string, distributions []Distribution) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error saving distributions for %s: %w", fundKey, err)
+	}
+	defer tx.Rollback()
+
+	template := fmt.Sprintf(
+		`
+		INSERT INTO %s (fund_key, ex_date, pay_date, amount, currency, type) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE pay_date = VALUES(pay_date), amount = VALUES(amount), currency = VALUES(currency)
+		`, tableName)
+	for _, d := range distributions {
+		var payDate any
+		if !d.PayDate.IsZero() {
+			payDate = d.PayDate.Format(time.DateOnly)
+		}
+		if _, err := tx.ExecContext(ctx, template, fundKey, d.ExDate.Format(time.DateOnly), payDate, d.Amount, d.Currency, d.Type); err != nil {
+			return fmt.Errorf("error saving distributions for %s: %w", fundKey, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error saving distributions for %s: %w", fundKey, err)
+	}
+	return nil
+}
+
+// DistributionsByKey returns the stored distributions of the fund with fundKey, oldest first
+func DistributionsByKey(ctx context.Context, db *sql.DB, tableName, fundKey string) ([]Distribution, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT ex_date, pay_date, amount, currency, type FROM %s WHERE fund_key = ? ORDER BY ex_date", tableName), fundKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting distributions for %s: %w", fundKey, err)
+	}
+	defer rows.Close()
+
+	var distributions []Distribution
+	for rows.Next() {
+		var d Distribution
+		var exDate string
+		var payDate sql.NullString
+		if err := rows.Scan(&exDate, &payDate, &d.Amount, &d.Currency, &d.Type); err != nil {
+			return nil, fmt.Errorf("error obtaining values from row: %w", err)
+		}
+		d.ExDate, _ = time.Parse(time.DateOnly, exDate)
+		if payDate.Valid {
+			d.PayDate, _ = time.Parse(time.DateOnly, payDate.String)
+		}
+		distributions = append(distributions, d)
+	}
+	return distributions, rows.Err()
+}
+
+// Kinds of Allocation
+const (
+	AllocationHolding    = "holding"
+	AllocationSector     = "sector"
+	AllocationRegion     = "region"
+	AllocationAssetClass = "asset_class"
+)
+
+// Allocation is the weight of one holding, sector, region or asset class in a fund's portfolio on AsOf
+type Allocation struct {
+	AsOf   time.Time
+	Kind   string
+	Name   string
+	Weight float64 //percent of the portfolio
+}
+
+// AllocationTable is the table holding the allocation snapshots of the funds in tableName
+func AllocationTable(tableName string) string {
+	return tableName + "_allocations"
+}
+
+// CreateAllocationTable creates the table for allocation snapshots if it does not exist
+func CreateAllocationTable(ctx context.Context, db *sql.DB, tableName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		`
+		CREATE TABLE IF NOT EXISTS %s (
+			fund_key VARCHAR(128) NOT NULL,
+			as_of DATE NOT NULL,
+			kind VARCHAR(16) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			weight DECIMAL(9, 4) NOT NULL,
+			PRIMARY KEY (fund_key, as_of, kind, name)
+		);
+		`, tableName))
+	if err != nil {
+		return fmt.Errorf("error creating allocation table: %w", err)
+	}
+	return nil
+}
+
+// SaveAllocations stores the allocations of the fund with fundKey as snapshots by their as-of date. A snapshot read
+// again replaces the one stored for the same date, older snapshots are kept.
+func SaveAllocations(ctx context.Context, db *sql.DB, tableName, fundKey string, allocations []Allocation) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error saving allocations for %s: %w", fundKey, err)
+	}
+	defer tx.Rollback()
+
+	cleared := map[string]bool{}
+	for _, a := range allocations {
+		asOf := a.AsOf.Format(time.DateOnly)
+		if !cleared[asOf] {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE fund_key = ? AND as_of = ?", tableName), fundKey, asOf); err != nil {
+				return fmt.Errorf("error saving allocations for %s: %w", fundKey, err)
+			}
+			cleared[asOf] = true
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s (fund_key, as_of, kind, name, weight) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE weight = VALUES(weight)",
+			tableName), fundKey, asOf, a.Kind, a.Name, a.Weight); err != nil {
+			return fmt.Errorf("error saving allocations for %s: %w", fundKey, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error saving allocations for %s: %w", fundKey, err)
+	}
+	return nil
+}
+
+// AllocationsByKey returns every stored allocation snapshot of the fund with fundKey, oldest first and heaviest first
+// within a snapshot and kind
+func AllocationsByKey(ctx context.Context, db *sql.DB, tableName, fundKey string) ([]Allocation, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT as_of, kind, name, weight FROM %s WHERE fund_key = ? ORDER BY as_of, kind, weight DESC, name", tableName), fundKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting allocations for %s: %w", fundKey, err)
+	}
+	defer rows.Close()
+
+	var allocations []Allocation
+	for rows.Next() {
+		var a Allocation
+		var asOf string
+		if err := rows.Scan(&asOf, &a.Kind, &a.Name, &a.Weight); err != nil {
+			return nil, fmt.Errorf("error obtaining values from row: %w", err)
+		}
+		a.AsOf, _ = time.Parse(time.DateOnly, asOf)
+		allocations = append(allocations, a)
+	}
+	return allocations, rows.Err()
+}
+
+// MigrateFactsheetTables moves the info, distribution and allocation tables of fundTable made before funds were keyed
+// on their codes to Fund.Key. The fundname column becomes fund_key, and rows of funds with a code in fundTable are
+// rekeyed to it. Tables that do not exist yet are skipped. Run it after MigrateFundTable, which fills in the codes.
+func MigrateFactsheetTables(ctx context.Context, db *sql.DB, fundTable string) error {
+	for _, tableName := range []string{InfoTable(fundTable), DistributionTable(fundTable), AllocationTable(fundTable)} {
+		exists, err := tableExists(ctx, db, tableName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		byName, err := columnExists(ctx, db, tableName, "fundname")
+		if err != nil {
+			return err
+		}
+		if byName {
+			log.Printf("Keying %s on fund codes", tableName)
+			if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s CHANGE fundname fund_key VARCHAR(128) NOT NULL", tableName)); err != nil {
+				return fmt.Errorf("error migrating %s: %w", tableName, err)
+			}
+		}
+
+		// IGNORE leaves rows under the name when the fund already has rows for the same key under its code
+		result, err := db.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE IGNORE %s t JOIN %s f ON t.fund_key = f.fundname SET t.fund_key = f.code WHERE f.code IS NOT NULL",
+			tableName, fundTable))
+		if err != nil {
+			return fmt.Errorf("error migrating %s: %w", tableName, err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			log.Printf("Rekeyed %d rows of %s on fund codes", n, tableName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"scraper/internal/database"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	Pending    State = "pending"
+	InProgress State = "in-progress"
+	Done       State = "done"
+	Failed     State = "failed"
+)
+
+// Entry is the latest known state of a fund in a run
+type Entry struct {
+	Fund     database.Fund `json:"fund"`
+	State    State         `json:"state"`
+	Error    string        `json:"error,omitempty"`
+	Attempts int           `json:"attempts"` //times the fund was started, including on resume
+	Updated  time.Time     `json:"updated"`
+}
+
+// header is the first line of a journal file, listing every fund in the run
+type header struct {
+	ID      string          `json:"id"`
+	Source  string          `json:"source"`
+	Started time.Time       `json:"started"`
+	Funds   []database.Fund `json:"funds"`
+}
+
+// event is every line after the header, recording a fund changing state
+type event struct {
+	Fundname string    `json:"fundname"`
+	State    State     `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Journal records the state of every fund in a run in an append only file, so a crashed run can be resumed
+type Journal struct {
+	ID      string
+	Source  string
+	Started time.Time
+
+	entries map[string]*Entry
+	order   []string
+	file    *os.File
+	mu      sync.Mutex
+}
+
+// New creates the journal for a run over funds in dir, with every fund pending
+func New(dir, source string, funds []database.Fund) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("could not create journal directory: %w", err)
+	}
+
+	h := header{Source: source, Funds: funds}
+
+	// Runs started within the same millisecond get the next free ID instead of failing
+	var f *os.File
+	var err error
+	for {
+		h.Started = time.Now()
+		h.ID = NewID(h.Started)
+		f, err = os.OpenFile(path(dir, h.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !errors.Is(err, os.ErrExist) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create journal: %w", err)
+	}
+
+	j := newJournal(h)
+	j.file = f
+	if err := j.write(h); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Open replays the journal for run id in dir so the run can be resumed. A partly written last line, left by a crash
+// while writing, is ignored.
+func Open(dir, id string) (*Journal, error) {
+	f, err := os.OpenFile(path(dir, id), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open journal for run %s: %w", id, err)
+	}
+
+	r := bufio.NewReader(f)
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read journal header for run %s: %w", id, err)
+	}
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read journal header for run %s: %w", id, err)
+	}
+
+	j := newJournal(h)
+	j.file = f
+	offset := int64(len(line))
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Drop the partly written line so new events start on a line of their own
+			if len(line) != 0 {
+				if err := f.Truncate(offset); err != nil {
+					f.Close()
+					return nil, fmt.Errorf("could not repair journal for run %s: %w", id, err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not read journal for run %s: %w", id, err)
+		}
+
+		var e event
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not read journal for run %s: %w", id, err)
+		}
+		j.apply(e)
+		offset += int64(len(line))
+	}
+
+	return j, nil
+}
+
+// List returns the ids of the runs with a journal in dir, oldest first
+func List(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal directory: %w", err)
+	}
+
+	var ids []string
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".jsonl" {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".jsonl"))
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// NewID names a run after the time it started, to the millisecond so IDs still sort in the order runs started
+func NewID(t time.Time) string {
+	return t.Format("20060102-150405.000")
+}
+
+func path(dir, id string) string {
+	return filepath.Join(dir, id+".jsonl")
+}
+
+func newJournal(h header) *Journal {
+	j := &Journal{ID: h.ID, Source: h.Source, Started: h.Started, entries: make(map[string]*Entry, len(h.Funds))}
+	for _, fund := range h.Funds {
+		j.entries[fund.Fundname] = &Entry{Fund: fund, State: Pending, Updated: h.Started}
+		j.order = append(j.order, fund.Fundname)
+	}
+	return j
+}
+
+// Start records an attempt at downloading fundName, it is called again for every retry
+func (j *Journal) Start(fundName string) error {
+	return j.record(event{Fundname: fundName, State: InProgress})
+}
+
+func (j *Journal) Done(fundName string) error {
+	return j.record(event{Fundname: fundName, State: Done})
+}
+
+func (j *Journal) Fail(fundName string, err error) error {
+	return j.record(event{Fundname: fundName, State: Failed, Error: err.Error()})
+}
+
+// Remaining returns the funds that still need downloading, in their original order: the ones that were pending or
+// in progress when the run stopped and the ones that failed
+func (j *Journal) Remaining() []database.Fund {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var funds []database.Fund
+	for _, fundName := range j.order {
+		if entry := j.entries[fundName]; entry.State != Done {
+			funds = append(funds, entry.Fund)
+		}
+	}
+	return funds
+}
+
+// Entries returns the latest state of every fund in the run, in their original order
+func (j *Journal) Entries() []Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]Entry, 0, len(j.order))
+	for _, fundName := range j.order {
+		entries = append(entries, *j.entries[fundName])
+	}
+	return entries
+}
+
+// Counts returns how many funds are in each state
+func (j *Journal) Counts() map[State]int {
+	counts := make(map[State]int)
+	for _, entry := range j.Entries() {
+		counts[entry.State]++
+	}
+	return counts
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+func (j *Journal) record(e event) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.entries[e.Fundname]; !ok {
+		return fmt.Errorf("%s is not in run %s", e.Fundname, j.ID)
+	}
+
+	e.Time = time.Now()
+	if err := j.write(e); err != nil {
+		return err
+	}
+	j.apply(e)
+
+	return nil
+}
+
+func (j *Journal) apply(e event) {
+	entry, ok := j.entries[e.Fundname]
+	if !ok {
+		return
+	}
+	entry.State = e.State
+	entry.Error = e.Error
+	if e.State == InProgress {
+		entry.Attempts++
+	}
+	entry.Updated = e.Time
+}
+
+// write appends v as a line and syncs it to disk so it survives a crash straight after
+func (j *Journal) write(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write journal for run %s: %w", j.ID, err)
+	}
+	return j.file.Sync()
+}
@@ -0,0 +1,147 @@
+package journal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"scraper/internal/database"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	funds := []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}, {Fundname: "fund3", Link: "link3"}, {Fundname: "fund4", Link: "link4"}}
+
+	t.Run("Testing resuming a crashed run", func(t *testing.T) {
+		dir := t.TempDir()
+
+		j, err := New(dir, "universe", funds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Start("fund1")
+		j.Done("fund1")
+		j.Start("fund2")
+		j.Fail("fund2", errors.New("fund name has been updated"))
+		j.Start("fund3")
+		j.Close() // crash while fund3 is in progress
+
+		resumed, err := Open(dir, j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resumed.Close()
+
+		if resumed.Source != "universe" {
+			t.Errorf("Expected universe run, got %s", resumed.Source)
+		}
+		assertFundNames(t, resumed.Remaining(), []string{"fund2", "fund3", "fund4"})
+
+		entries := resumed.Entries()
+		if entries[1].State != Failed || entries[1].Error != "fund name has been updated" {
+			t.Errorf("Expected fund2 to have failed with its error, got %+v", entries[1])
+		}
+		if entries[2].State != InProgress {
+			t.Errorf("Expected fund3 to be in progress, got %s", entries[2].State)
+		}
+		if entries[0].Attempts != 1 || entries[3].Attempts != 0 {
+			t.Errorf("Expected fund1 to have 1 attempt and fund4 none, got %d and %d", entries[0].Attempts, entries[3].Attempts)
+		}
+
+		counts := resumed.Counts()
+		if counts[Done] != 1 || counts[Failed] != 1 || counts[InProgress] != 1 || counts[Pending] != 1 {
+			t.Errorf("Unexpected counts %v", counts)
+		}
+	})
+
+	t.Run("Testing a partly written line is dropped", func(t *testing.T) {
+		dir := t.TempDir()
+
+		j, err := New(dir, "planning", funds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Done("fund1")
+		j.Close()
+
+		f, err := os.OpenFile(filepath.Join(dir, j.ID+".jsonl"), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(`{"fundname":"fund2","sta`)
+		f.Close()
+
+		resumed, err := Open(dir, j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumed.Done("fund2")
+		resumed.Close()
+
+		resumed, err = Open(dir, j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resumed.Close()
+		assertFundNames(t, resumed.Remaining(), []string{"fund3", "fund4"})
+	})
+
+	t.Run("Testing unknown funds and runs", func(t *testing.T) {
+		dir := t.TempDir()
+
+		j, err := New(dir, "planning", funds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer j.Close()
+
+		if err := j.Done("fund5"); err == nil {
+			t.Error("Expected error for fund not in run, none given")
+		}
+		if _, err := Open(dir, "20000101-000000"); err == nil {
+			t.Error("Expected error for missing run, none given")
+		}
+
+		ids, err := List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, []string{j.ID}) {
+			t.Errorf("Expected runs %v, got %v", []string{j.ID}, ids)
+		}
+	})
+
+	t.Run("Testing runs started at once get their own journal", func(t *testing.T) {
+		dir := t.TempDir()
+
+		var want []string
+		for i := 0; i < 5; i++ {
+			j, err := New(dir, "planning", funds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			j.Close()
+			want = append(want, j.ID)
+		}
+
+		ids, err := List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, want) {
+			t.Errorf("Expected runs %v in the order they started, got %v", want, ids)
+		}
+	})
+}
+
+func assertFundNames(t testing.TB, funds []database.Fund, want []string) {
+	t.Helper()
+
+	var got []string
+	for _, fund := range funds {
+		got = append(got, fund.Fundname)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected funds %v, got %v", want, got)
+	}
+}
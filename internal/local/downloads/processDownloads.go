@@ -12,16 +12,14 @@ import (
 	"github.com/xuri/excelize/v2"
 )
 
-func processDownloads(fundNames []string) error {
-	downloadsDir := getDownloadsDir()
-	dataDir := getDataDir()
-
+// ProcessDownloads moves the FSM exports for fundNames from downloadsDir into dataDir and compiles them with compileScript
+func ProcessDownloads(fundNames []string, downloadsDir, dataDir, compileScript string) error {
 	err := shiftFSMfiles(fundNames, downloadsDir, dataDir)
 	if err != nil {
 		return fmt.Errorf("error shifting FSM files: %s", err)
 	}
 
-	cmd := exec.Command("python", "compile_data.py")
+	cmd := exec.Command("python", compileScript)
 	_, err = cmd.Output()
 	if err != nil {
 		return fmt.Errorf("error running python script to compile fsm data: %s", err)
@@ -34,10 +32,12 @@ func shiftFSMfiles(fundNames []string, targetDir, destDir string) error {
 	// Read the contents of the Downloads directory
 	files, err := os.ReadDir(targetDir)
 	if err != nil {
-		log.Fatalf("Error reading Downloads directory: %s", err)
+		return fmt.Errorf("error reading Downloads directory: %w", err)
 	}
 
-	clearDataFolder(destDir)
+	if err := clearDataFolder(destDir); err != nil {
+		return err
+	}
 
 	// Get the current date
 	now := time.Now()
@@ -63,8 +63,12 @@ func shiftFSMfiles(fundNames []string, targetDir, destDir string) error {
 						// Check if file is already shifted over to the new folder
 						if !fundMap[fundName] {
 							FSMfilepath := filepath.Join(targetDir, FSMfilename)
-							renameColumn(FSMfilepath, fundName)
-							relocateExcel(FSMfilename, FSMfilepath, destDir)
+							if err := renameColumn(FSMfilepath, fundName); err != nil {
+								return err
+							}
+							if err := relocateExcel(FSMfilename, FSMfilepath, destDir); err != nil {
+								return err
+							}
 							fundMap[fundName] = true
 						}
 					}
@@ -86,19 +90,20 @@ func shiftFSMfiles(fundNames []string, targetDir, destDir string) error {
 	return nil
 }
 
-func relocateExcel(FSMfilename string, FSMfilepath string, destDir string) {
+func relocateExcel(FSMfilename string, FSMfilepath string, destDir string) error {
 	err := os.MkdirAll(destDir, 0777)
 	if err != nil {
-		log.Fatalf("Error creating directory to store FSM data: %s", err)
+		return fmt.Errorf("error creating directory to store FSM data: %w", err)
 	}
 
 	// Relocate excel file to new directory
 	destPath := filepath.Join(destDir, FSMfilename)
 	err = os.Rename(FSMfilepath, destPath)
 	if err != nil {
-		log.Fatalf("Error relocating file: %s", err)
+		return fmt.Errorf("error relocating file: %w", err)
 	}
 	log.Printf("Relocating %s from %s to %s", FSMfilename, FSMfilepath, destPath)
+	return nil
 }
 
 func sliceToMap(slice []string) map[string]bool {
@@ -113,30 +118,6 @@ func sliceToMap(slice []string) map[string]bool {
 	return m
 }
 
-func getDownloadsDir() string {
-	// Get the user's home directory
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("Error getting home directory: %s", err)
-	}
-
-	// Construct the path to the Downloads directory
-	downloadsDir := filepath.Join(homeDir, "Downloads")
-	return downloadsDir
-}
-
-func getDataDir() string {
-	curDir, err := os.Getwd()
-
-	if err != nil {
-		log.Fatalf("Error getting current working directory: %s", err)
-	}
-
-	// Create new directory to store data if it does not exist
-	dataDir := filepath.Join(curDir, "data")
-	return dataDir
-}
-
 func renameColumn(excelFilePath, fundName string) error {
 	// Open the existing Excel file
 	xlFile, err := excelize.OpenFile(excelFilePath)
@@ -165,8 +146,11 @@ func renameColumn(excelFilePath, fundName string) error {
 func clearDataFolder(destDir string) error {
 	// Delete all old files in data directory
 	files, err := os.ReadDir(destDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		log.Fatalf("Error reading data directory: %s", err)
+		return fmt.Errorf("error reading data directory: %w", err)
 	}
 
 	// Iterate over the list of files and delete each one
@@ -1,59 +1,45 @@
 package local
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"scraper/internal/database"
 	"strings"
+	"time"
 
 	"github.com/xuri/excelize/v2"
 )
 
 // const user string = "Liang"
 
-func GetAllFunds(fundsinfopath string) []string {
-	curDir, err := os.Getwd()
-
-	if err != nil {
-		log.Fatalf("Error getting current working directory: %s", err)
-	}
-
-	// Open the Excel file
-	f, err := excelize.OpenFile(filepath.Join(curDir, fundsinfopath))
-	if err != nil {
-		log.Fatalf("Error opening file: %v", err)
-	}
+// ErrNotFound is returned when a value is not in the sheet
+var ErrNotFound = errors.New("not found")
 
+func GetAllFunds(fundsinfopath string) ([]string, error) {
 	// Specify the sheet name
-	sheetName := strings.ReplaceAll(fundsinfopath, ".xlsx", "")
+	sheetName := strings.ReplaceAll(filepath.Base(fundsinfopath), ".xlsx", "")
 
-	// Get all the rows in the sheet
-	rows, err := f.GetRows(sheetName)
-	if err != nil {
-		log.Fatalf("Error getting rows: %v", err)
-	}
-
-	var fundNames []string
-	// Iterate through the rows and print the first column
-	for _, row := range rows {
-		if len(row) > 0 { //&& row[1] == user
-			fundNames = append(fundNames, row[0])
-		}
-	}
+	return GetFundNames(fundsinfopath, sheetName)
+}
 
-	return fundNames[1:]
+func GetFundsOwned(planningRelativeFilepath string) ([]string, error) {
+	return GetFundNames(planningRelativeFilepath, "Planning")
 }
 
-func GetFundsOwned(planningRelativeFilepath string) []string {
-	sheetName := "Planning"
-	f := openSheet(planningRelativeFilepath)
+// GetFundNames returns the fund names in the first column of sheetName, skipping the header row
+func GetFundNames(relativeFilepath, sheetName string) ([]string, error) {
+	f, err := openSheet(relativeFilepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
 	// Get all the rows in the sheet
 	rows, err := f.GetRows(sheetName)
 	if err != nil {
-		log.Fatalf("Error getting rows: %v", err)
+		return nil, fmt.Errorf("error getting rows: %w", err)
 	}
 
 	var fundNames []string
@@ -64,38 +50,59 @@ func GetFundsOwned(planningRelativeFilepath string) []string {
 		}
 	}
 
-	return fundNames[1:]
+	if len(fundNames) == 0 {
+		return nil, nil
+	}
+	return fundNames[1:], nil
 }
 
-func AddFunds(funds []database.Fund, planningRelativeFilepath, sheetName string) {
-	f := openSheet(planningRelativeFilepath)
+// AddFunds writes funds to sheetName as rows of name, link and code. A fund whose code already has a row is the same
+// fund under a new name or link, so its row is overwritten instead of a new one appended.
+func AddFunds(funds []database.Fund, planningRelativeFilepath, sheetName string) error {
+	f, err := openSheet(planningRelativeFilepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
 	for _, fund := range funds {
+		fund = fund.WithCode()
 		rows, err := f.GetRows(sheetName)
 		if err != nil {
-			log.Fatalf("Error getting rows: %v", err)
+			return fmt.Errorf("error getting rows: %w", err)
 		}
 
-		newRow := []interface{}{fund.Fundname, fund.Link}
+		newRow := []interface{}{fund.Fundname, fund.Link, fund.Code}
 
-		// Insert the new row at the end of the sheet
+		// Insert the new row at the end of the sheet, or over the row with the same code
 		rowIndex := len(rows) + 1
+		for i, row := range rows {
+			if fund.Code != "" && rowCode(row) == fund.Code {
+				rowIndex = i + 1
+				break
+			}
+		}
 		cellRange := fmt.Sprintf("A%d", rowIndex)
 		if err := f.SetSheetRow(sheetName, cellRange, &newRow); err != nil {
-			log.Fatalf("error setting sheet row: %v", err)
+			return fmt.Errorf("error setting sheet row: %w", err)
 		}
 	}
 
 	// Save the file with the updated row
 	if err := f.SaveAs(planningRelativeFilepath); err != nil {
-		log.Fatalf("error saving file: %v", err)
+		return fmt.Errorf("error saving file: %w", err)
 	}
 
 	fmt.Println("New row added successfully!")
+	return nil
 }
 
 func FundsByNames(planningRelativeFilepath, sheetName string, names []string) ([]database.Fund, error) {
-	f := openSheet(planningRelativeFilepath)
+	f, err := openSheet(planningRelativeFilepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 	var funds []database.Fund
 
 	for _, name := range names {
@@ -106,8 +113,8 @@ func FundsByNames(planningRelativeFilepath, sheetName string, names []string) ([
 
 		//fundFound := false
 		for _, row := range rows {
-			if row[0] == name {
-				funds = append(funds, database.Fund{Fundname: name, Link: row[1]})
+			if len(row) > 1 && row[0] == name {
+				funds = append(funds, database.Fund{Code: rowCode(row), Fundname: name, Link: row[1]})
 				//fundFound = true
 				break
 			}
@@ -123,6 +130,70 @@ func FundsByNames(planningRelativeFilepath, sheetName string, names []string) ([
 	return funds, nil
 }
 
+// RenameFund renames oldfundName to newfundName in the first column of sheetName, where funds are listed by name, and
+// leaves every other cell alone
+func RenameFund(oldfundName, newfundName, planningRelativeFilepath, sheetName string) error {
+	f, err := openSheet(planningRelativeFilepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows(sheetName)
+	if err != nil {
+		return fmt.Errorf("error getting rows: %w", err)
+	}
+	renamed := 0
+	for i, row := range rows {
+		if len(row) == 0 || row[0] != oldfundName {
+			continue
+		}
+		if err := f.SetCellValue(sheetName, fmt.Sprintf("A%d", i+1), newfundName); err != nil {
+			return fmt.Errorf("error setting cell value: %w", err)
+		}
+		renamed++
+	}
+	if renamed == 0 {
+		return fmt.Errorf("fund '%s' %w", oldfundName, ErrNotFound)
+	}
+
+	if err := f.SaveAs(planningRelativeFilepath); err != nil {
+		return fmt.Errorf("error saving file: %w", err)
+	}
+	return nil
+}
+
+// FundByCode returns the fund in sheetName with code
+func FundByCode(planningRelativeFilepath, sheetName, code string) (database.Fund, error) {
+	f, err := openSheet(planningRelativeFilepath)
+	if err != nil {
+		return database.Fund{}, err
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows(sheetName)
+	if err != nil {
+		return database.Fund{}, fmt.Errorf("error getting rows: %w", err)
+	}
+	for _, row := range rows {
+		if code != "" && rowCode(row) == code {
+			return database.Fund{Code: code, Fundname: row[0], Link: row[1]}, nil
+		}
+	}
+	return database.Fund{}, fmt.Errorf("fund code '%s' %w", code, ErrNotFound)
+}
+
+// rowCode returns the fund code of a row of the Link sheet, read from its link for rows added before the sheet had codes
+func rowCode(row []string) string {
+	if len(row) > 2 && row[2] != "" {
+		return row[2]
+	}
+	if len(row) > 1 {
+		return database.CodeFromLink(row[1])
+	}
+	return ""
+}
+
 func FundsNotInNames(planningRelativeFilepath, sheetName string, names []string) ([]string, error) {
 	funds, err := FundsByNames(planningRelativeFilepath, sheetName, names)
 	if err != nil {
@@ -140,7 +211,11 @@ func FundsNotInNames(planningRelativeFilepath, sheetName string, names []string)
 }
 
 func UpdateFundName(oldfundName, newfundName, planningRelativeFilepath, sheetName string) error {
-	f := openSheet(planningRelativeFilepath)
+	f, err := openSheet(planningRelativeFilepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
 	cellAddressList, err := findCellCords(oldfundName, planningRelativeFilepath, sheetName)
 	if err != nil {
@@ -150,13 +225,13 @@ func UpdateFundName(oldfundName, newfundName, planningRelativeFilepath, sheetNam
 	for _, cellAddress := range cellAddressList {
 		// Set the new value for the specified cell
 		if err := f.SetCellValue(sheetName, cellAddress, newfundName); err != nil {
-			log.Fatalf("error setting cell value: %v", err)
+			return fmt.Errorf("error setting cell value: %w", err)
 		}
 	}
 
 	// Save the file with the updated value
 	if err := f.SaveAs(planningRelativeFilepath); err != nil {
-		log.Fatalf("error saving file: %v", err)
+		return fmt.Errorf("error saving file: %w", err)
 	}
 
 	fmt.Println("Cell updated successfully!")
@@ -164,10 +239,15 @@ func UpdateFundName(oldfundName, newfundName, planningRelativeFilepath, sheetNam
 }
 
 func findCellCords(cellvalue, planningRelativeFilepath, sheetName string) ([]string, error) {
-	f := openSheet(planningRelativeFilepath)
+	f, err := openSheet(planningRelativeFilepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
 	rows, err := f.GetRows(sheetName)
 	if err != nil {
-		log.Fatalf("Error getting rows: %v", err)
+		return nil, fmt.Errorf("error getting rows: %w", err)
 	}
 
 	var cellAddressList []string
@@ -186,30 +266,215 @@ func findCellCords(cellvalue, planningRelativeFilepath, sheetName string) ([]str
 	}
 
 	if len(cellAddressList) == 0 {
-		return []string{""}, fmt.Errorf("value '%s' not found", cellvalue)
+		return []string{""}, fmt.Errorf("value '%s' %w", cellvalue, ErrNotFound)
 	}
 	return cellAddressList, nil
 }
 
-func openSheet(planningRelativeFilepath string) *excelize.File {
-	// Open the Excel file
-	f, err := excelize.OpenFile(planningRelativeFilepath)
+// fundInfoHeader is the header row of the Info sheet. Rows are found by Code, last so sheets made before it keep their
+// columns.
+var fundInfoHeader = []any{"Fund Name", "Fund House", "Base Currency", "Share Class", "Risk Rating", "Inception Date", "Fund Size", "Expense Ratio", "Dealing Frequency", "Min Investment", "Updated", "Code"}
+
+// SaveFundInfo writes info for fund to its row of sheetName, found by its code, adding the sheet with a header and the
+// row if they do not exist yet. The row's name is updated to the fund's current one.
+func SaveFundInfo(fund database.Fund, info database.FundInfo, updated time.Time, planningRelativeFilepath, sheetName string) error {
+	f, err := openSheet(planningRelativeFilepath)
 	if err != nil {
-		log.Fatalf("Error opening file: %v", err)
+		return err
 	}
+	defer f.Close()
 
-	return f
+	if err := ensureSheet(f, sheetName, fundInfoHeader); err != nil {
+		return err
+	}
+
+	fund = fund.WithCode()
+	codeCol := len(fundInfoHeader) - 1
+	rows, err := f.GetRows(sheetName)
+	if err != nil {
+		return fmt.Errorf("error getting rows: %w", err)
+	}
+	rowIndex := len(rows) + 1
+	for i, row := range rows {
+		if i > 0 && isFundRow(row, codeCol, fund) {
+			rowIndex = i + 1
+			break
+		}
+	}
+
+	newRow := []any{fund.Fundname, info.FundHouse, info.BaseCurrency, info.ShareClass, info.RiskRating, info.InceptionDate, info.FundSize,
+		info.ExpenseRatio, info.DealingFrequency, info.MinInvestment, updated.Format("2006-01-02 15:04"), fund.Code}
+	if err := f.SetSheetRow(sheetName, fmt.Sprintf("A%d", rowIndex), &newRow); err != nil {
+		return fmt.Errorf("error setting sheet row: %w", err)
+	}
+
+	if err := f.SaveAs(planningRelativeFilepath); err != nil {
+		return fmt.Errorf("error saving file: %w", err)
+	}
+	return nil
 }
 
-func ClearFolder(relDirPath string) error {
-	curDir, err := os.Getwd()
+// allocationHeader is the header row of the Allocations sheet. Rows are found by Code, last so sheets made before it
+// keep their columns.
+var allocationHeader = []any{"Fund Name", "As Of", "Kind", "Name", "Weight", "Code"}
 
+// SaveAllocations adds the allocation snapshots of fund to sheetName, replacing the rows of any snapshot of the fund's
+// code with the same as-of date and keeping older ones. The sheet is added with a header if it does not exist yet.
+func SaveAllocations(fund database.Fund, allocations []database.Allocation, planningRelativeFilepath, sheetName string) error {
+	f, err := openSheet(planningRelativeFilepath)
 	if err != nil {
-		log.Fatalf("Error getting current working directory: %s", err)
+		return err
 	}
+	defer f.Close()
 
+	if err := ensureSheet(f, sheetName, allocationHeader); err != nil {
+		return err
+	}
+	fund = fund.WithCode()
+	codeCol := len(allocationHeader) - 1
+
+	snapshots := map[string]bool{}
+	for _, a := range allocations {
+		snapshots[a.AsOf.Format(time.DateOnly)] = true
+	}
+	rows, err := f.GetRows(sheetName)
+	if err != nil {
+		return fmt.Errorf("error getting rows: %w", err)
+	}
+	//Bottom up, so removing a row does not move the ones still to check
+	for i := len(rows) - 1; i > 0; i-- {
+		if row := rows[i]; len(row) > 1 && isFundRow(row, codeCol, fund) && snapshots[row[1]] {
+			if err := f.RemoveRow(sheetName, i+1); err != nil {
+				return fmt.Errorf("error removing row: %w", err)
+			}
+			rows = append(rows[:i], rows[i+1:]...)
+		}
+	}
+
+	for i, a := range allocations {
+		newRow := []any{fund.Fundname, a.AsOf.Format(time.DateOnly), a.Kind, a.Name, a.Weight, fund.Code}
+		if err := f.SetSheetRow(sheetName, fmt.Sprintf("A%d", len(rows)+i+1), &newRow); err != nil {
+			return fmt.Errorf("error setting sheet row: %w", err)
+		}
+	}
+
+	if err := f.SaveAs(planningRelativeFilepath); err != nil {
+		return fmt.Errorf("error saving file: %w", err)
+	}
+	return nil
+}
+
+// isFundRow tells whether a row with the fund name first and its code in codeCol is fund's. Rows without a code, from
+// before the sheet had codes, are matched by name.
+func isFundRow(row []string, codeCol int, fund database.Fund) bool {
+	if codeCol < len(row) && row[codeCol] != "" {
+		return row[codeCol] == fund.Code
+	}
+	return len(row) > 0 && row[0] == fund.Fundname
+}
+
+// MigrateCodes fills in the Code column of the Info and Allocations sheets for rows made before the sheets had codes,
+// with the code the Link sheet has for their fund name. Sheets the workbook does not have are skipped.
+func MigrateCodes(planningRelativeFilepath, linkSheet, infoSheet, allocationSheet string) error {
+	f, err := openSheet(planningRelativeFilepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	links, err := f.GetRows(linkSheet)
+	if err != nil {
+		return fmt.Errorf("error getting rows: %w", err)
+	}
+	codes := map[string]string{}
+	for _, row := range links {
+		if code := rowCode(row); code != "" && len(row) > 0 {
+			codes[row[0]] = code
+		}
+	}
+
+	changed := false
+	for _, sheet := range []struct {
+		name   string
+		header []any
+	}{{infoSheet, fundInfoHeader}, {allocationSheet, allocationHeader}} {
+		if index, err := f.GetSheetIndex(sheet.name); err != nil || index == -1 {
+			continue
+		}
+		rows, err := f.GetRows(sheet.name)
+		if err != nil {
+			return fmt.Errorf("error getting rows: %w", err)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		codeCol := len(sheet.header) - 1
+		cell := func(row int) string {
+			name, _ := excelize.CoordinatesToCellName(codeCol+1, row)
+			return name
+		}
+		if len(rows[0]) <= codeCol || rows[0][codeCol] == "" {
+			if err := f.SetCellValue(sheet.name, cell(1), sheet.header[codeCol]); err != nil {
+				return fmt.Errorf("error setting cell value: %w", err)
+			}
+			changed = true
+		}
+		for i, row := range rows[1:] {
+			if len(row) == 0 || (codeCol < len(row) && row[codeCol] != "") || codes[row[0]] == "" {
+				continue
+			}
+			if err := f.SetCellValue(sheet.name, cell(i+2), codes[row[0]]); err != nil {
+				return fmt.Errorf("error setting cell value: %w", err)
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	if err := f.SaveAs(planningRelativeFilepath); err != nil {
+		return fmt.Errorf("error saving file: %w", err)
+	}
+	return nil
+}
+
+// ensureSheet adds sheetName with header as its first row if the workbook does not have it
+func ensureSheet(f *excelize.File, sheetName string, header []any) error {
+	index, err := f.GetSheetIndex(sheetName)
+	if err != nil {
+		return fmt.Errorf("error finding sheet: %w", err)
+	}
+	if index != -1 {
+		return nil
+	}
+	if _, err := f.NewSheet(sheetName); err != nil {
+		return fmt.Errorf("error adding sheet: %w", err)
+	}
+	if err := f.SetSheetRow(sheetName, "A1", &header); err != nil {
+		return fmt.Errorf("error setting sheet row: %w", err)
+	}
+	return nil
+}
+
+func openSheet(planningRelativeFilepath string) (*excelize.File, error) {
+	// Open the Excel file
+	f, err := excelize.OpenFile(planningRelativeFilepath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	return f, nil
+}
+
+// ClearFolder deletes the files in relDirPath, a folder that does not exist yet has nothing to clear
+func ClearFolder(relDirPath string) error {
 	// Open the directory
-	dir, err := os.Open(filepath.Join(curDir, relDirPath))
+	dir, err := os.Open(relDirPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("could not open directory: %w", err)
 	}
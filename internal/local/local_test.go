@@ -1,17 +1,25 @@
 package local
 
 import (
+	"errors"
 	"log"
+	"path/filepath"
 	"reflect"
 	"scraper/internal/database"
 	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
 )
 
 func TestIntialise(t *testing.T) {
 
 	t.Run("Testing", func(t *testing.T) {
 		filepath := "TestPlanning.xlsx"
-		fundNames := GetFundsOwned(filepath)
+		fundNames, err := GetFundsOwned(filepath)
+		if err != nil {
+			t.Fatal(err)
+		}
 		for _, fundName := range fundNames {
 			print(fundName)
 		}
@@ -22,12 +30,19 @@ func TestIntialise(t *testing.T) {
 
 		fund1 := database.Fund{Fundname: "fund1", Link: "link1"}
 		fundsToAdd := []database.Fund{fund1, fund1}
-		AddFunds(fundsToAdd, filepath, "Link")
-		AddFunds(fundsToAdd, filepath, "Planning")
-		err := UpdateFundName("fund1", "newfund1", filepath, "Link")
+		if err := AddFunds(fundsToAdd, filepath, "Link"); err != nil {
+			t.Fatal(err)
+		}
+		if err := AddFunds(fundsToAdd, filepath, "Planning"); err != nil {
+			t.Fatal(err)
+		}
+		err = UpdateFundName("fund1", "newfund1", filepath, "Link")
 		if err != nil {
 			t.Error(err)
 		}
+		if err := UpdateFundName("fund9", "newfund9", filepath, "Link"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound when renaming missing fund, got %v", err)
+		}
 
 		funds, err := FundsByNames(filepath, "Link", []string{"newfund1", "fund2"})
 		if err != nil {
@@ -44,4 +59,97 @@ func TestIntialise(t *testing.T) {
 			t.Errorf("FundsNotInNames not workign properly, got %+v", fundsNotIn)
 		}
 	})
+
+	t.Run("Testing a renamed fund keeps its Link row", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Planning.xlsx")
+		f := excelize.NewFile()
+		if err := f.SetSheetName("Sheet1", "Link"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.SetSheetRow("Link", "A1", &[]any{"Name", "Link", "Code"}); err != nil {
+			t.Fatal(err)
+		}
+		//A row from before the sheet had codes
+		if err := f.SetSheetRow("Link", "A2", &[]any{"AB American Income A2 USD", "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.SaveAs(path); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		renamed := database.Fund{Fundname: "AB American Income Portfolio A2 USD", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}
+		other := database.Fund{Fundname: "fund1", Link: "link1"}
+		if err := AddFunds([]database.Fund{renamed, other}, path, "Link"); err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := GetFundNames(path, "Link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{renamed.Fundname, other.Fundname}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("Expected rows %v, got %v", want, names)
+		}
+
+		funds, err := FundsByNames(path, "Link", []string{renamed.Fundname, other.Fundname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		renamed.Code = "ACM019"
+		if want := []database.Fund{renamed, other}; !reflect.DeepEqual(funds, want) {
+			t.Fatalf("Expected %+v, got %+v", want, funds)
+		}
+	})
+
+	t.Run("Testing fund info and allocations outlive a rename", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Planning.xlsx")
+		link := "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"
+		f := excelize.NewFile()
+		f.SetSheetName("Sheet1", "Link")
+		f.SetSheetRow("Link", "A1", &[]any{"AB American Income A2 USD", link})
+		//Sheets as they were made before they had codes
+		f.NewSheet("Info")
+		f.SetSheetRow("Info", "A1", &[]any{"Fund Name", "Fund House"})
+		f.SetSheetRow("Info", "A2", &[]any{"AB American Income A2 USD", "AllianceBernstein"})
+		f.NewSheet("Allocations")
+		f.SetSheetRow("Allocations", "A1", &[]any{"Fund Name", "As Of", "Kind", "Name", "Weight"})
+		f.SetSheetRow("Allocations", "A2", &[]any{"AB American Income A2 USD", "2024-05-31", "sector", "Technology", 30})
+		if err := f.SaveAs(path); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if err := MigrateCodes(path, "Link", "Info", "Allocations"); err != nil {
+			t.Fatal(err)
+		}
+		renamed := database.Fund{Fundname: "AB American Income Portfolio A2 USD", Link: link}
+		if err := SaveFundInfo(renamed, database.FundInfo{FundHouse: "AB"}, time.Now(), path, "Info"); err != nil {
+			t.Fatal(err)
+		}
+		may := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+		if err := SaveAllocations(renamed, []database.Allocation{{AsOf: may, Kind: database.AllocationSector, Name: "Technology", Weight: 31}}, path, "Allocations"); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := excelize.OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		info, _ := f.GetRows("Info")
+		if len(info) != 2 || info[0][11] != "Code" || info[1][0] != renamed.Fundname || info[1][1] != "AB" || info[1][11] != "ACM019" {
+			t.Fatalf("Expected the info row of ACM019 updated under its new name, got %v", info)
+		}
+		allocations, _ := f.GetRows("Allocations")
+		if len(allocations) != 2 || allocations[1][4] != "31" || allocations[1][5] != "ACM019" {
+			t.Fatalf("Expected the May snapshot of ACM019 replaced, got %v", allocations)
+		}
+	})
+
+	t.Run("Testing a missing folder has nothing to clear", func(t *testing.T) {
+		if err := ClearFolder(filepath.Join(t.TempDir(), "planning")); err != nil {
+			t.Fatalf("Expected no error for a missing folder, got %v", err)
+		}
+	})
 }
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+	"scraper/internal/database"
+	"scraper/internal/scraper"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// Crawl lists every fund on the fund selector with crawler and adds the ones the link store does not have yet, with
+// their factsheet links. It returns the funds listed and how many of them were added.
+func (p *Pipeline) Crawl(ctx context.Context, crawler *scraper.Crawler) (listed []scraper.ListedFund, added int, err error) {
+	var browser *rod.Browser
+	if p.Session != nil {
+		browser = p.Session.Browser
+	} else {
+		b, l, err := scraper.InitialiseBrowser(p.Browser)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer l.Cleanup()
+		defer b.Close()
+		browser = b
+	}
+
+	page, err := browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer page.Close()
+
+	listed, err = crawler.Crawl(ctx, page)
+	if err != nil {
+		return nil, 0, err
+	}
+	added, err = p.addListed(ctx, listed)
+	return listed, added, err
+}
+
+// addListed adds the listed funds the link store does not have yet, the first listed of any that share a name
+func (p *Pipeline) addListed(ctx context.Context, listed []scraper.ListedFund) (int, error) {
+	links := map[string]string{}
+	var names []string
+	for _, fund := range listed {
+		if _, ok := links[fund.Name]; !ok {
+			links[fund.Name] = fund.Link
+			names = append(names, fund.Name)
+		}
+	}
+
+	missing, err := p.Links.FundsNotInNames(ctx, names)
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range missing {
+		if err := p.Links.AddFund(ctx, database.Fund{Fundname: name, Link: links[name]}); err != nil {
+			return i, err
+		}
+	}
+	log.Printf("%d funds listed, %d added", len(names), len(missing))
+	return len(missing), nil
+}
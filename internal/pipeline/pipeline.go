@@ -0,0 +1,495 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"scraper/internal/config"
+	"scraper/internal/database"
+	"scraper/internal/journal"
+	"scraper/internal/local"
+	"scraper/internal/retry"
+	"scraper/internal/scraper"
+	"sync"
+	"time"
+
+	"github.com/go-rod/rod"
+)
+
+// Pipeline downloads prices for the funds listed by Source, looking up missing links with the browser and
+// storing them in Links, then telling every sink about each finished download
+type Pipeline struct {
+	Name   string //planning, universe or watchlist, recorded in the run journal
+	Source FundSource
+	Links  LinkStore
+	Select Selector //optional, e.g. StaleFunds to skip funds downloaded recently
+	Sinks  []DownloadSink
+	// Factsheets are told what was read from each fund page, errors are only logged as the prices are already saved
+	Factsheets []FactsheetSink
+
+	Browser        config.Browser
+	Login          config.Login
+	Export         config.Export
+	Factsheet      config.Factsheet
+	Match          config.Links      //when a search result is taken as the fund searched for
+	Range          string            //price range of every fund, a preset, from..to dates or auto
+	FundRanges     map[string]string //range by fund name, overriding Range
+	Batchsize      int               //0 downloads every selected fund
+	DownloadFolder string
+	ClearFolder    bool //delete previous downloads before starting
+
+	JournalDir string //where run journals are kept
+	Resume     string //id of a run to continue instead of starting a new one
+
+	GracePeriod time.Duration //how long funds already downloading get to finish once the run is cancelled
+
+	Retry    retry.Policy
+	Failures *retry.Ledger //optional, funds that failed too many runs in a row are left out of the batch
+
+	Review *LinkReview //optional, where funds whose search results are ambiguous are written for review
+
+	Session           *scraper.Session //optional logged in browser to reuse, Run logs in and closes its own if nil
+	CheckSessionEvery int              //funds between checks that the session is still logged in, 0 only checks before the batch
+
+	ReportDir string //optional, where a JSON and HTML report of each run is written
+}
+
+// Run downloads prices for the funds in the pipeline, recording each fund's progress in a run journal. A fund that
+// fails is recorded in the summary and the run carries on with the rest, the error is only for failures that stop
+// the whole run.
+//
+// Cancelling ctx stops new funds from being started. Funds already downloading get GracePeriod to finish and be
+// recorded in the sinks before their pages are cancelled, and are left in the journal to be retried on resume.
+func (p *Pipeline) Run(ctx context.Context) (*Summary, error) {
+	summary := &Summary{}
+	if err := p.checkRanges(); err != nil {
+		return summary, err
+	}
+
+	j, err := p.openJournal(ctx, summary)
+	if err != nil {
+		return summary, err
+	}
+	defer j.Close()
+	summary.RunID = j.ID
+	defer p.writeReport(j, summary, time.Now())
+
+	funds, skipped := p.skipBroken(j.Remaining())
+	summary.Skipped = append(summary.Skipped, skipped...)
+	total := len(j.Entries())
+	alreadyDownloaded := total - len(j.Remaining())
+
+	// Set up scraping tools, logging in unless the pipeline was given a session
+	session := p.Session
+	if session == nil {
+		session, err = scraper.Login(ctx, p.Browser, p.Login)
+		if err != nil {
+			return summary, err
+		}
+		defer session.Close()
+	}
+	if err := session.UseExport(p.Export); err != nil {
+		return summary, err
+	}
+	session.UseFactsheet(p.Factsheet)
+	session.UseMatch(p.Match)
+	// The daemon reuses its session, so only count what this run blocked
+	blockedBefore := session.Conc.Blocker.Stats()
+
+	// Downloads run on their own context so they can finish after ctx is cancelled
+	inflight, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stopGrace := context.AfterFunc(ctx, func() {
+		log.Printf("Stopping run %s, waiting up to %s for funds already downloading", j.ID, p.GracePeriod)
+		time.AfterFunc(p.GracePeriod, cancel)
+	})
+	defer stopGrace()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	downloaded := 0
+	workers := make(chan struct{}, max(1, p.Browser.PoolLimit))
+
+	// Downloads hold a read lock so checking the session pauses them until it is logged in again
+	var sessionMu sync.RWMutex
+	var runErr error
+
+	for i, fund := range funds {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		if i == 0 || (p.CheckSessionEvery > 0 && i%p.CheckSessionEvery == 0) {
+			sessionMu.Lock()
+			err := session.EnsureLoggedIn(ctx)
+			sessionMu.Unlock()
+			if err != nil {
+				runErr = fmt.Errorf("could not log in again: %w", err)
+				<-workers
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			started := time.Now()
+			rng, _ := p.rangeFor(fund, started) //checked before the run started
+			attempts, err := p.Retry.Do(ctx, func(attempt int) error {
+				if err := j.Start(fund.Fundname); err != nil {
+					return retry.MarkPermanent(err)
+				}
+				if attempt > 1 {
+					log.Printf("Retrying %s, attempt %d", fund.Fundname, attempt)
+				}
+
+				sessionMu.RLock()
+				defer sessionMu.RUnlock()
+
+				attemptCtx, cancel := p.Retry.WithTimeout(inflight)
+				defer cancel()
+
+				err := p.download(attemptCtx, fund, func() (*scraper.Factsheet, error) {
+					return session.Scrape(attemptCtx, fund, rng, p.DownloadFolder)
+				})
+				if err != nil && inflight.Err() == nil {
+					log.Printf("Attempt %d for %s failed with a %s error: %v", attempt, fund.Fundname, retry.Classify(err), err)
+					if err := j.Fail(fund.Fundname, err); err != nil {
+						log.Print(err)
+					}
+				}
+				return err
+			})
+			if err != nil && (inflight.Err() != nil || errors.Is(err, context.Canceled)) {
+				// Left unfinished in the journal so resuming downloads it again
+				log.Printf("Download of %s cancelled", fund.Fundname)
+				return
+			}
+			result := Result{Fund: fund, Step: "download", Attempts: attempts, Duration: time.Since(started), Err: err}
+			if err == nil {
+				result.Path = scraper.DownloadPath(p.DownloadFolder, fund)
+			}
+			summary.add(result)
+			p.recordAttempts(fund, attempts, err)
+
+			if err != nil {
+				log.Printf("Failed to download %s after %d attempts: %v", fund.Fundname, attempts, err)
+				return
+			}
+
+			if err := j.Done(fund.Fundname); err != nil {
+				log.Print(err)
+			}
+
+			mu.Lock()
+			downloaded++
+			log.Printf("%d/%d funds successfully downloaded, %d/%d funds in run %s", downloaded, len(funds), alreadyDownloaded+downloaded, total, j.ID)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		summary.Interrupted = true
+	}
+	if summary.Blocked = session.Conc.Blocker.Stats().Sub(blockedBefore); summary.Blocked.Requests != 0 {
+		log.Printf("Blocked %s in run %s", summary.Blocked, j.ID)
+	}
+
+	return summary, runErr
+}
+
+// download runs scrape and tells the sinks about the download and the factsheet. A panic from a rod Must call is
+// returned as an error so one fund cannot stop the run.
+func (p *Pipeline) download(ctx context.Context, fund database.Fund, scrape func() (*scraper.Factsheet, error)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	sheet, err := scrape()
+	if err != nil {
+		return err
+	}
+
+	if sheet != nil && sheet.Renamed != "" {
+		// Stored again under its code, so the link store keeps one entry for the fund with its new name
+		renamed := fund.WithCode()
+		renamed.Fundname = sheet.Renamed
+		if err := p.Links.AddFund(ctx, renamed); err != nil {
+			log.Printf("Could not record that %s was renamed to %s: %v", fund.Fundname, sheet.Renamed, err)
+		} else {
+			fund = renamed
+		}
+	}
+
+	for _, sink := range p.Sinks {
+		if err := sink.Downloaded(ctx, fund, scraper.DownloadPath(p.DownloadFolder, fund)); err != nil {
+			return fmt.Errorf("error recording download: %w", err)
+		}
+	}
+
+	if sheet != nil {
+		for _, sink := range p.Factsheets {
+			if err := sink.Factsheet(ctx, fund, sheet); err != nil {
+				log.Printf("Could not record the factsheet of %s: %v", fund.Fundname, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// recordAttempts updates the failure ledger with the outcome of fund
+func (p *Pipeline) recordAttempts(fund database.Fund, attempts int, err error) {
+	if p.Failures == nil {
+		return
+	}
+
+	if err == nil {
+		err = p.Failures.Succeeded(fund.WithCode().Key())
+	} else {
+		err = p.Failures.Failed(fund.WithCode().Key(), attempts, err)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// skipBroken leaves out the funds that failed too many runs in a row, so they do not use up the batch
+func (p *Pipeline) skipBroken(funds []database.Fund) (kept, broken []database.Fund) {
+	if p.Failures == nil {
+		return funds, nil
+	}
+
+	keys := make(map[string]string, len(funds))
+	for _, fund := range funds {
+		keys[fund.Fundname] = fund.WithCode().Key()
+	}
+	p.Failures.Migrate(keys)
+
+	for _, fund := range funds {
+		if p.Failures.Broken(fund.WithCode().Key()) {
+			broken = append(broken, fund)
+		} else {
+			kept = append(kept, fund)
+		}
+	}
+	if len(broken) != 0 {
+		log.Printf("Skipping %d funds that failed %d runs in a row", len(broken), p.Failures.SkipAfter)
+	}
+	return kept, broken
+}
+
+// openJournal reopens the journal of the run being resumed, or works out which funds to download and starts a new
+// one. Funds whose links could not be found are added to the summary.
+func (p *Pipeline) openJournal(ctx context.Context, summary *Summary) (*journal.Journal, error) {
+	if p.Resume != "" {
+		j, err := journal.Open(p.JournalDir, p.Resume)
+		if err != nil {
+			return nil, err
+		}
+		if j.Source != p.Name {
+			j.Close()
+			return nil, fmt.Errorf("run %s was a %s run, not %s", j.ID, j.Source, p.Name)
+		}
+
+		log.Printf("Resuming run %s, %d funds remaining", j.ID, len(j.Remaining()))
+		return j, nil
+	}
+
+	fundNames, err := p.Source.FundNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting fund names: %w", err)
+	}
+
+	// Get fund links to directly scrape from fund page
+	funds, failed, err := p.ResolveLinks(ctx, fundNames)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range failed {
+		summary.add(result)
+	}
+	log.Print("Fund links successfully obtained")
+
+	funds, err = p.selectFunds(ctx, funds)
+	if err != nil {
+		return nil, err
+	}
+	funds, summary.Skipped = p.skipBroken(funds)
+	funds, _ = p.batch(funds)
+
+	if p.ClearFolder {
+		// Auto ranges read the prices already downloaded, the journal keeps them once the files are gone
+		p.rememberLastDownloads(funds)
+		if err := local.ClearFolder(p.DownloadFolder); err != nil {
+			return nil, err
+		}
+	}
+
+	j, err := journal.New(p.JournalDir, p.Name, funds)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Starting run %s with %d funds, continue with -resume %s if it stops early", j.ID, len(funds), j.ID)
+	return j, nil
+}
+
+// ResolveLinks returns the funds for fundNames with their factsheet links, searching the fund selector for any
+// fund that is not in the link store yet. The browser is only launched when there are links to search for.
+// Funds whose links could not be found are returned as failed results and left out of the funds. Cancelling ctx
+// stops the search and returns the context error.
+func (p *Pipeline) ResolveLinks(ctx context.Context, fundNames []string) ([]database.Fund, []Result, error) {
+	fundsNotIn, err := p.Links.FundsNotInNames(ctx, fundNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	fundsNotIn, err = p.applyPicks(ctx, fundsNotIn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(fundsNotIn) == 0 {
+		funds, err := p.Links.FundsByNames(ctx, fundNames)
+		return funds, nil, err
+	}
+
+	log.Printf("%s not in link store, starting scrape to get fund links", fundsNotIn)
+
+	// Set up scraping tools, searching in the session's browser if there is one
+	var browser *rod.Browser
+	if p.Session != nil {
+		browser = p.Session.Browser
+	} else {
+		b, l, err := scraper.InitialiseBrowser(p.Browser)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer l.Cleanup()
+		defer b.Close()
+		browser = b
+	}
+
+	pool := rod.NewPagePool(p.Browser.PoolLimit)
+	defer pool.Cleanup(func(p *rod.Page) { p.Close() })
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []Result
+	found := 0
+	workers := make(chan struct{}, max(1, p.Browser.PoolLimit))
+
+	for _, fundName := range fundsNotIn {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			err := p.findLink(ctx, browser, &pool, fundName)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Failed to get link for %s: %v", fundName, err)
+				failed = append(failed, Result{Fund: database.Fund{Fundname: fundName}, Step: "links", Err: err})
+				return
+			}
+			found++
+			log.Printf("%d/%d links successfully extracted", found, len(fundsNotIn))
+		}()
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	funds, err := p.Links.FundsByNames(ctx, fundNames)
+	return funds, failed, err
+}
+
+// applyPicks adds the links picked in the link review for fundNames to the link store, and returns the funds that
+// still need to be searched for
+func (p *Pipeline) applyPicks(ctx context.Context, fundNames []string) ([]string, error) {
+	if p.Review == nil || len(fundNames) == 0 {
+		return fundNames, nil
+	}
+	picked, err := p.Review.Picked(fundNames)
+	if err != nil {
+		log.Printf("Could not read picks from the link review, searching again: %v", err)
+		return fundNames, nil
+	}
+
+	var remaining, added []string
+	for _, fundName := range fundNames {
+		link, ok := picked[fundName]
+		if !ok {
+			remaining = append(remaining, fundName)
+			continue
+		}
+		if err := p.Links.AddFund(ctx, database.Fund{Fundname: fundName, Link: link}); err != nil {
+			return nil, err
+		}
+		log.Printf("Added the link picked for %s in the link review", fundName)
+		added = append(added, fundName)
+	}
+
+	if len(added) != 0 {
+		if err := p.Review.Remove(added); err != nil {
+			log.Printf("Could not remove picked funds from the link review: %v", err)
+		}
+	}
+	return remaining, nil
+}
+
+// findLink searches the fund selector for fundName and adds its link to the link store
+func (p *Pipeline) findLink(ctx context.Context, browser *rod.Browser, pool *rod.Pool[rod.Page], fundName string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	page, err := pool.Get(func() (*rod.Page, error) {
+		//Create a new page in page pool, must use .MustIncognito for concurrency
+		return browser.MustIncognito().MustPage(scraper.FSMfundSelectorSite).MustWaitLoad(), nil
+	})
+	if err != nil {
+		return fmt.Errorf("error creating new page from pool: %w", err)
+	}
+	defer pool.Put(page)
+
+	log.Printf("Getting link for %s", fundName)
+	fundLink, err := scraper.FindFundLink(ctx, fundName, page, p.Match)
+	var ambiguous *scraper.AmbiguousLinkError
+	if errors.As(err, &ambiguous) && p.Review != nil {
+		if err := p.Review.Add(ambiguous); err != nil {
+			log.Printf("Could not add %s to the link review: %v", fundName, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return p.Links.AddFund(ctx, database.Fund{Fundname: fundName, Link: fundLink})
+}
@@ -0,0 +1,768 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"scraper/internal/config"
+	"scraper/internal/database"
+	"scraper/internal/journal"
+	"scraper/internal/local"
+	"scraper/internal/retry"
+	"scraper/internal/scraper"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestPipelineDB(t *testing.T) {
+	cfg := testConfig(t)
+	tableName := "testfunds"
+	ctx := context.Background()
+	db, err := database.ConnectDB(ctx, cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.CreateTestFundTable(ctx, db, tableName); err != nil {
+		t.Fatal(err)
+	}
+	funds := []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}, {Fundname: "fund3", Link: "link3"}}
+
+	for _, fund := range funds {
+		if _, err := database.AddFund(ctx, db, tableName, fund); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Pipeline{Links: DBLinks{DB: db, TableName: tableName}, Browser: cfg.Browser}
+
+	t.Run("Testing getting links", func(t *testing.T) {
+		assertLinksResolved(t, p, funds)
+	})
+}
+
+func TestPipelineLocal(t *testing.T) {
+	cfg := testConfig(t)
+	filepath := "../local/TestPlanning.xlsx"
+
+	funds := []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}, {Fundname: "fund3", Link: "link3"}}
+
+	if err := local.AddFunds(funds, filepath, "Link"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Pipeline{Links: &ExcelLinks{Path: filepath, Sheet: "Link"}, Browser: cfg.Browser}
+
+	t.Run("Testing getting links", func(t *testing.T) {
+		assertLinksResolved(t, p, funds)
+	})
+}
+
+func TestSources(t *testing.T) {
+	t.Run("Testing CSV watchlist", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "watchlist.csv")
+		content := "Fund Name,Owner\n# funds to review\nfund1,Liang\n\n\"fund2, with comma\",Liang\nfund3\n"
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := CSVSource{Path: path}.FundNames(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"fund1", "fund2, with comma", "fund3"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Testing missing CSV watchlist", func(t *testing.T) {
+		if _, err := (CSVSource{Path: filepath.Join(t.TempDir(), "missing.csv")}).FundNames(context.Background()); err == nil {
+			t.Fatal("Expected error, none given")
+		}
+	})
+
+	t.Run("Testing fund list from reader", func(t *testing.T) {
+		got, err := ListSource{Reader: strings.NewReader("fund1\n  fund2  \n\n# fund3\nfund4")}.FundNames(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"fund1", "fund2", "fund4"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	})
+}
+
+func TestSinks(t *testing.T) {
+	t.Run("Testing CSV download log", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "downloads.csv")
+		sink := &CSVSink{Path: path}
+
+		for _, fund := range []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}} {
+			if err := sink.Downloaded(context.Background(), fund, "data/"+fund.Fundname+".csv"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records) != 3 || records[0][0] != "Fund Name" || records[2][0] != "fund2" || records[2][2] != "data/fund2.csv" {
+			t.Fatalf("Unexpected download log %v", records)
+		}
+	})
+
+	t.Run("Testing a renamed fund is stored again under its new name", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "downloads.csv")
+		links := &fakeLinks{}
+		p := &Pipeline{DownloadFolder: t.TempDir(), Links: links, Sinks: []DownloadSink{&CSVSink{Path: path}}}
+
+		fund := database.Fund{Fundname: "AB American Income A2 USD", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}
+		err := p.download(context.Background(), fund, func() (*scraper.Factsheet, error) {
+			return &scraper.Factsheet{Renamed: "AB American Income Portfolio A2 USD"}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := database.Fund{Code: "ACM019", Fundname: "AB American Income Portfolio A2 USD", Link: fund.Link}
+		if links.added != 1 || !reflect.DeepEqual(links.funds[0], want) {
+			t.Fatalf("Expected %+v added to the links, got %+v", want, links.funds)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want.Fundname) || !strings.Contains(string(data), "ACM019.csv") {
+			t.Fatalf("Expected the download logged under the new name and code, got %q", data)
+		}
+	})
+
+	t.Run("Testing a renamed fund is renamed in the Planning sheet too", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Planning.xlsx")
+		link := "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"
+		f := excelize.NewFile()
+		f.SetSheetName("Sheet1", "Planning")
+		f.SetSheetRow("Planning", "A1", &[]any{"Fund Name"})
+		f.SetSheetRow("Planning", "A2", &[]any{"AB American Income A2 USD", "Liang", "AB American Income A2 USD"})
+		f.NewSheet("Link")
+		f.SetSheetRow("Link", "A1", &[]any{"AB American Income A2 USD", link})
+		if err := f.SaveAs(path); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		p := &Pipeline{DownloadFolder: t.TempDir(), Links: &ExcelLinks{Path: path, Sheet: "Link", Listing: "Planning"}}
+
+		err := p.download(context.Background(), database.Fund{Fundname: "AB American Income A2 USD", Link: link}, func() (*scraper.Factsheet, error) {
+			return &scraper.Factsheet{Renamed: "AB American Income Portfolio A2 USD"}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := local.GetFundNames(path, "Planning")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, []string{"AB American Income Portfolio A2 USD"}) {
+			t.Fatalf("Expected the Planning sheet to list the new name, got %v", names)
+		}
+		f, err = excelize.OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if note, _ := f.GetCellValue("Planning", "C2"); note != "AB American Income A2 USD" {
+			t.Fatalf("Expected only the name column renamed, got %q in C2", note)
+		}
+		funds, err := p.Links.FundsByNames(context.Background(), names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(funds) != 1 || funds[0].Code != "ACM019" {
+			t.Fatalf("Expected ACM019 in the Link sheet under its new name, got %+v", funds)
+		}
+	})
+
+	t.Run("Testing links and factsheets saved at once to one workbook are all kept", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Planning.xlsx")
+		f := excelize.NewFile()
+		f.SetSheetName("Sheet1", "Link")
+		if err := f.SaveAs(path); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		links := &ExcelLinks{Path: path, Sheet: "Link"}
+		sheets := &ExcelFactsheets{Path: path, InfoSheet: "Info"}
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 20; i++ {
+			fund := database.Fund{Fundname: fmt.Sprintf("fund%d", i), Link: fmt.Sprintf("link%d", i)}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if err := links.AddFund(context.Background(), fund); err != nil {
+					t.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				if err := sheets.Factsheet(context.Background(), fund, &scraper.Factsheet{Info: &database.FundInfo{FundHouse: "AB"}}); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		linked, err := local.GetFundNames(path, "Link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := local.GetFundNames(path, "Info")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The Link sheet has no header, so its first fund is skipped as one
+		if len(linked) != 19 || len(info) != 20 {
+			t.Fatalf("Expected every link and fund info kept, got links %v and info %v", linked, info)
+		}
+	})
+
+	t.Run("Testing fund info is kept in the Info sheet", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Planning.xlsx")
+		if err := excelize.NewFile().SaveAs(path); err != nil {
+			t.Fatal(err)
+		}
+		p := &Pipeline{DownloadFolder: t.TempDir(), Factsheets: []FactsheetSink{&ExcelFactsheets{Path: path, InfoSheet: "Info"}}}
+
+		for _, house := range []string{"AllianceBernstein", "AB"} {
+			info := &database.FundInfo{FundHouse: house, BaseCurrency: "USD", RiskRating: "4"}
+			err := p.download(context.Background(), database.Fund{Fundname: "fund1"}, func() (*scraper.Factsheet, error) {
+				return &scraper.Factsheet{Info: info}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := excelize.OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		rows, err := f.GetRows("Info")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[0][1] != "Fund House" || rows[1][0] != "fund1" || rows[1][1] != "AB" || rows[1][2] != "USD" {
+			t.Fatalf("Expected one row with the latest info of fund1, got %v", rows)
+		}
+	})
+
+	t.Run("Testing allocation snapshots are kept in the Allocations sheet", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Planning.xlsx")
+		if err := excelize.NewFile().SaveAs(path); err != nil {
+			t.Fatal(err)
+		}
+		p := &Pipeline{DownloadFolder: t.TempDir(), Factsheets: []FactsheetSink{&ExcelFactsheets{Path: path, InfoSheet: "Info", AllocationSheet: "Allocations"}}}
+
+		may := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+		june := time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)
+		for _, allocations := range [][]database.Allocation{
+			{{AsOf: may, Kind: database.AllocationSector, Name: "Technology", Weight: 30}},
+			{{AsOf: june, Kind: database.AllocationSector, Name: "Technology", Weight: 31}},
+			// June read again replaces the June snapshot
+			{{AsOf: june, Kind: database.AllocationSector, Name: "Technology", Weight: 32.5}, {AsOf: june, Kind: database.AllocationSector, Name: "Health Care", Weight: 12}},
+		} {
+			err := p.download(context.Background(), database.Fund{Fundname: "fund1"}, func() (*scraper.Factsheet, error) {
+				return &scraper.Factsheet{Allocations: allocations}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := excelize.OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		rows, err := f.GetRows("Allocations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][]string{
+			{"Fund Name", "As Of", "Kind", "Name", "Weight", "Code"},
+			{"fund1", "2024-05-31", "sector", "Technology", "30"},
+			{"fund1", "2024-06-30", "sector", "Technology", "32.5"},
+			{"fund1", "2024-06-30", "sector", "Health Care", "12"},
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Fatalf("Expected %v, got %v", want, rows)
+		}
+	})
+}
+
+func TestSummary(t *testing.T) {
+	t.Run("Testing failed funds are summarised", func(t *testing.T) {
+		summary := &Summary{RunID: "run1"}
+		summary.add(Result{Fund: database.Fund{Fundname: "fund1"}, Step: "download"})
+		summary.add(Result{Fund: database.Fund{Fundname: "fund2"}, Step: "links", Err: errors.New("fund link not found")})
+
+		failed := summary.Failed()
+		if len(failed) != 1 || failed[0].Fund.Fundname != "fund2" {
+			t.Fatalf("Expected only fund2 to fail, got %+v", failed)
+		}
+
+		var b strings.Builder
+		summary.Print(&b)
+		if !strings.Contains(b.String(), "FAILED  fund2 (links): fund link not found") || !strings.Contains(b.String(), "1/2 funds downloaded, 1 failed") {
+			t.Fatalf("Unexpected summary:\n%s", b.String())
+		}
+	})
+	t.Run("Testing interrupted run tells how to resume", func(t *testing.T) {
+		summary := &Summary{RunID: "run1", Interrupted: true}
+		summary.add(Result{Fund: database.Fund{Fundname: "fund1"}, Step: "download"})
+
+		var b strings.Builder
+		summary.Print(&b)
+		if !strings.Contains(b.String(), "continue with -resume run1") {
+			t.Fatalf("Unexpected summary:\n%s", b.String())
+		}
+	})
+}
+
+func TestPlan(t *testing.T) {
+	links := &fakeLinks{funds: []database.Fund{
+		{Fundname: "fund1", Link: "link1"},
+		{Fundname: "fund2", Link: "link2", Lastdownloaded: []uint8("2024-08-01")},
+		{Fundname: "fund3", Link: "link3"},
+	}}
+	p := &Pipeline{
+		Source:         ListSource{Reader: strings.NewReader("fund1\nfund2\nfund3\nfund4\nfund5")},
+		Links:          links,
+		Select:         neverDownloaded{},
+		Batchsize:      2,
+		DownloadFolder: "data/planning",
+		ClearFolder:    true,
+	}
+
+	plan, err := p.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFundNames(t, plan.Selected, []string{"fund1", "fund3"})
+	assertFundNames(t, plan.SkippedByBatch, []string{"fund4", "fund5"})
+	assertFundNames(t, plan.NotSelected, []string{"fund2"})
+	if !reflect.DeepEqual(plan.MissingLinks, []string{"fund4", "fund5"}) {
+		t.Fatalf("Expected fund4 and fund5 to be missing links, got %v", plan.MissingLinks)
+	}
+	if links.added != 0 {
+		t.Fatalf("Plan should not add links, added %d", links.added)
+	}
+
+	var out strings.Builder
+	plan.Print(&out)
+	for _, want := range []string{"5 funds in source", "Would clear data/planning", "Would scrape (2)", "fund1\tlink1", "Skipped by batchsize (2)", "fund4\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected plan to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 8, 23, 19, 0, 0, 0, time.Local)
+	// Saved under its name before files were named after fund codes
+	if err := os.WriteFile(scraper.DownloadPath(dir, database.Fund{Fundname: "fund3"}), []byte("Date,fund3\n2024-05-01,1.01\n2024-05-02,1.02\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fund5 := database.Fund{Fundname: "fund5", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}
+	if err := os.WriteFile(scraper.DownloadPath(dir, fund5), []byte("Date,fund5\n2024-07-31,1.01\n2024-08-01,1.02\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &Pipeline{Range: AutoRange, FundRanges: map[string]string{"fund1": "2020-01-01.."}, DownloadFolder: dir}
+
+	t.Run("Testing a fund's own range is used first", func(t *testing.T) {
+		assertRangeFor(t, p, database.Fund{Fundname: "fund1"}, now, "2020-01-01..")
+	})
+
+	t.Run("Testing auto covers the gap since lastdownloaded", func(t *testing.T) {
+		assertRangeFor(t, p, database.Fund{Fundname: "fund2", Lastdownloaded: []uint8("2024-08-01 00:00:00")}, now, "1M")
+	})
+
+	t.Run("Testing auto falls back to the prices already downloaded", func(t *testing.T) {
+		assertRangeFor(t, p, fund5, now, "1M")
+	})
+
+	t.Run("Testing prices saved under the fund's name are found", func(t *testing.T) {
+		assertRangeFor(t, p, database.Fund{Fundname: "fund3", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/FUND3"}, now, "6M")
+	})
+
+	t.Run("Testing auto gets the full history of funds never downloaded", func(t *testing.T) {
+		assertRangeFor(t, p, database.Fund{Fundname: "fund4"}, now, "10Y")
+	})
+
+	t.Run("Testing auto still sees prices in a folder cleared for the run", func(t *testing.T) {
+		dir := t.TempDir()
+		fund1 := database.Fund{Fundname: "fund1", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/FUND1"}
+		last := time.Now().AddDate(0, 0, -10).Format(time.DateOnly)
+		if err := os.WriteFile(scraper.DownloadPath(dir, fund1), []byte("Date,fund1\n"+last+",1.01\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cleared := &Pipeline{
+			Name:           "planning",
+			Source:         ListSource{Reader: strings.NewReader("fund1\nfund2")},
+			Links:          &fakeLinks{funds: []database.Fund{fund1, {Fundname: "fund2", Link: "link2"}}},
+			Range:          AutoRange,
+			DownloadFolder: dir,
+			ClearFolder:    true,
+			JournalDir:     filepath.Join(t.TempDir(), "runs"),
+		}
+
+		j, err := cleared.openJournal(context.Background(), &Summary{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if _, err := os.Stat(scraper.DownloadPath(dir, fund1)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected the download folder to be cleared, got %v", err)
+		}
+
+		cleared.Resume = j.ID
+		resumed, err := cleared.openJournal(context.Background(), &Summary{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resumed.Close()
+		funds := resumed.Remaining()
+		assertFundNames(t, funds, []string{"fund1", "fund2"})
+		assertRangeFor(t, cleared, funds[0], time.Now(), "1M")
+		assertRangeFor(t, cleared, funds[1], time.Now(), "10Y")
+	})
+
+	t.Run("Testing invalid ranges stop the run before it starts", func(t *testing.T) {
+		bad := &Pipeline{FundRanges: map[string]string{"fund1": "2W"}}
+		if _, err := bad.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "fund1") {
+			t.Fatalf("Expected an error for the range of fund1, got %v", err)
+		}
+	})
+}
+
+func TestPlanSkipsBroken(t *testing.T) {
+	failures, err := retry.OpenLedger(filepath.Join(t.TempDir(), "failures.json"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fund1 failed before the ledger was keyed on fund codes, fund4 failed under the name it had before a rename
+	if err := failures.Failed("fund1", 1, retry.MarkPermanent(errors.New("fund name has been updated"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := failures.Failed("FUND4", 1, retry.MarkPermanent(errors.New("fund name has been updated"))); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Pipeline{
+		Source: ListSource{Reader: strings.NewReader("fund1\nfund2\nfund3\nfund4 renamed")},
+		Links: &fakeLinks{funds: []database.Fund{
+			{Fundname: "fund1", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/FUND1"},
+			{Fundname: "fund2", Link: "link2"},
+			{Fundname: "fund3", Link: "link3"},
+			{Fundname: "fund4 renamed", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/FUND4"},
+		}},
+		Batchsize: 2,
+		Failures:  failures,
+	}
+
+	plan, err := p.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fund1 and fund4 do not use up the batch
+	assertFundNames(t, plan.Broken, []string{"fund1", "fund4 renamed"})
+	assertFundNames(t, plan.Selected, []string{"fund2", "fund3"})
+	if _, ok := failures.Record("FUND1"); !ok {
+		t.Error("Expected the failures of fund1 to be moved to its code")
+	}
+	if _, ok := failures.Record("fund1"); ok {
+		t.Error("Expected no failures left under the name of fund1")
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	t.Run("Testing only funds missing from the link store are added", func(t *testing.T) {
+		links := &fakeLinks{funds: []database.Fund{{Fundname: "fund1", Link: "link1"}}}
+		p := &Pipeline{Links: links}
+
+		added, err := p.addListed(context.Background(), []scraper.ListedFund{
+			{Name: "fund1", Code: "AAA001", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/AAA001"},
+			{Name: "fund2", Code: "BBB002", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/BBB002"},
+			{Name: "fund2", Code: "BBB003", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/BBB003"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != 1 || links.added != 1 {
+			t.Fatalf("Expected only fund2 to be added, added %d", added)
+		}
+		if fund := links.funds[1]; fund.Fundname != "fund2" || !strings.HasSuffix(fund.Link, "/BBB002") {
+			t.Fatalf("Expected fund2 with the first link listed, got %+v", fund)
+		}
+	})
+}
+
+func TestLinkReview(t *testing.T) {
+	review := &LinkReview{Path: filepath.Join(t.TempDir(), "review", "links_review.csv")}
+	add := func(t *testing.T, fundName string) {
+		t.Helper()
+		err := review.Add(&scraper.AmbiguousLinkError{Fundname: fundName, Candidates: []scraper.Candidate{
+			{ListedFund: scraper.ListedFund{Name: fundName + " A SGD", Code: "AAA001", Link: fundName + "link1"}, Score: 0.9},
+			{ListedFund: scraper.ListedFund{Name: fundName + " A USD", Code: "AAA002", Link: fundName + "link2"}, Score: 0.9},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Testing ambiguous results are listed once per fund", func(t *testing.T) {
+		for _, fundName := range []string{"fund1", "fund2", "fund1"} {
+			add(t, fundName)
+		}
+
+		rows := readReview(t, review.Path)
+		if len(rows) != 5 || rows[0][0] != "Fund Name" || rows[0][7] != "Pick" || rows[2][0] != "fund2" || rows[4][0] != "fund1" || rows[4][1] != "2" || rows[4][3] != "AAA002" || rows[4][5] != "0.90" {
+			t.Fatalf("Expected a header and two rows per fund, got %v", rows)
+		}
+	})
+
+	t.Run("Testing picked links are added to the link store", func(t *testing.T) {
+		add(t, "fund3")
+		rows := readReview(t, review.Path)
+		for _, row := range rows {
+			if row[0] == "fund1" && row[1] == "2" {
+				row[7] = "x"
+			}
+		}
+		f, err := os.Create(review.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csv.NewWriter(f).WriteAll(rows)
+		f.Close()
+
+		links := &fakeLinks{funds: []database.Fund{{Fundname: "fund2", Link: "fund2link1"}}}
+		p := &Pipeline{Links: links, Review: review}
+		funds, failed, err := p.ResolveLinks(context.Background(), []string{"fund1", "fund2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(failed) != 0 || links.added != 1 {
+			t.Fatalf("Expected only the picked link to be added, added %d, failed %+v", links.added, failed)
+		}
+		if len(funds) != 2 || funds[1].Fundname != "fund1" || funds[1].Link != "fund1link2" {
+			t.Fatalf("Expected fund1 with its picked link, got %+v", funds)
+		}
+
+		var left []string
+		for _, row := range readReview(t, review.Path)[1:] {
+			left = append(left, row[0])
+		}
+		if !reflect.DeepEqual(left, []string{"fund2", "fund2", "fund3", "fund3"}) {
+			t.Errorf("Expected fund1 to be removed from the review, got %v", left)
+		}
+	})
+}
+
+func readReview(t testing.TB, path string) [][]string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestReport(t *testing.T) {
+	dir := t.TempDir()
+	p := &Pipeline{Name: "planning", DownloadFolder: dir, JournalDir: filepath.Join(dir, "runs"), ReportDir: filepath.Join(dir, "reports")}
+
+	funds := []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}, {Fundname: "fund3", Link: "link3"}}
+	j, err := journal.New(p.JournalDir, p.Name, funds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	path := scraper.DownloadPath(dir, funds[0])
+	if err := os.WriteFile(path, []byte("Date,fund1\n2024-08-21,1.01\n2024-08-22,1.02\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := &Summary{RunID: j.ID, Interrupted: true}
+	summary.add(Result{Fund: funds[0], Step: "download", Attempts: 1, Path: path})
+	summary.add(Result{Fund: funds[1], Step: "download", Attempts: 3, Err: errors.New("wait for download: context deadline exceeded")})
+	summary.add(Result{Fund: database.Fund{Fundname: "fund4"}, Step: "links", Err: scraper.ErrLinkNotFound})
+
+	r := p.report(j, summary, time.Now())
+
+	var got []string
+	for _, fund := range r.Funds {
+		got = append(got, fmt.Sprintf("%s %s %d", fund.Fund, fund.Outcome, fund.Rows))
+	}
+	want := []string{"fund1 downloaded 2", "fund2 failed 0", "fund3 not finished 0", "fund4 failed 0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected report %v, got %v", want, got)
+	}
+	if r.Funds[0].To != "2024-08-22" || r.Funds[1].Attempts != 3 || !r.Interrupted {
+		t.Fatalf("Unexpected report %+v", r)
+	}
+}
+
+type fakeLinks struct {
+	funds []database.Fund
+	added int
+}
+
+func (l *fakeLinks) FundsByNames(ctx context.Context, names []string) ([]database.Fund, error) {
+	var funds []database.Fund
+	for _, fund := range l.funds {
+		for _, name := range names {
+			if fund.Fundname == name {
+				funds = append(funds, fund)
+			}
+		}
+	}
+	return funds, nil
+}
+
+func (l *fakeLinks) FundsNotInNames(ctx context.Context, names []string) ([]string, error) {
+	funds, _ := l.FundsByNames(ctx, names)
+	var found []string
+	for _, fund := range funds {
+		found = append(found, fund.Fundname)
+	}
+	return database.Difference(names, found), nil
+}
+
+func (l *fakeLinks) AddFund(ctx context.Context, fund database.Fund) error {
+	l.funds = append(l.funds, fund)
+	l.added++
+	return nil
+}
+
+type neverDownloaded struct{}
+
+func (neverDownloaded) Select(ctx context.Context, funds []database.Fund) ([]database.Fund, error) {
+	var selected []database.Fund
+	for _, fund := range funds {
+		if fund.Lastdownloaded == nil {
+			selected = append(selected, fund)
+		}
+	}
+	return selected, nil
+}
+
+func assertFundNames(t testing.TB, funds []database.Fund, want []string) {
+	t.Helper()
+
+	var got []string
+	for _, fund := range funds {
+		got = append(got, fund.Fundname)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected funds %v, got %v", want, got)
+	}
+}
+
+func assertLinksResolved(t testing.TB, p *Pipeline, funds []database.Fund) {
+	t.Helper()
+
+	actualFunds := []database.Fund{{Fundname: "AB FCP I Global Equity Blend A SGD", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}, {Fundname: "abrdn SICAV I - Asian Credit Sustainable Bond A Gross MIncA SGD-H", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ABD035"}}
+	fundNames := []string{"fund1", "fund2", "fund3"}
+	expected := funds
+
+	// Add new actual funds to expected funds
+	for _, fund := range actualFunds {
+		fundNames = append(fundNames, fund.Fundname)
+		expected = append(expected, fund)
+	}
+
+	gotFunds, failed, err := p.ResolveLinks(context.Background(), fundNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("Expected every link to be found, failed %+v", failed)
+	}
+
+	var got []database.Fund
+	for _, fund := range gotFunds {
+		fund.ID = 0
+		got = append(got, fund)
+	}
+
+	got = sortFunds(t, got)
+	expected = sortFunds(t, expected)
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Get fund links failed. Expected: %+v, Got: %+v", expected, got)
+	}
+}
+
+func testConfig(t testing.TB) *config.Config {
+	t.Helper()
+
+	cfg, err := config.Load("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func sortFunds(t testing.TB, funds []database.Fund) []database.Fund {
+	t.Helper()
+	sort.Slice(funds, func(i, j int) bool {
+		return funds[i].Fundname > funds[j].Fundname
+	})
+	return funds
+}
+
+func assertRangeFor(t testing.TB, p *Pipeline, fund database.Fund, now time.Time, want string) {
+	t.Helper()
+
+	rng, err := p.rangeFor(fund, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng.String() != want {
+		t.Errorf("Expected %s for %s, got %s", want, fund.Fundname, rng)
+	}
+}
@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"scraper/internal/database"
+	"time"
+)
+
+// Plan describes what Run would do without launching a browser
+type Plan struct {
+	FundNames      []string
+	MissingLinks   []string          //would be searched for with FindFundLink before scraping
+	NotSelected    []database.Fund   //skipped by the selector, e.g. downloaded recently
+	Selected       []database.Fund   //would be scraped, funds without links have an empty Link
+	Broken         []database.Fund   //selected but left out for failing too many runs in a row
+	SkippedByBatch []database.Fund   //selected but over the batchsize
+	ClearFolder    string            //folder that would be emptied before starting
+	Ranges         map[string]string //price range each selected fund would be downloaded with
+}
+
+// Plan works out which funds Run would look up links for, scrape and skip. Funds without links are assumed to be
+// selected, as they have never been downloaded.
+func (p *Pipeline) Plan(ctx context.Context) (*Plan, error) {
+	if err := p.checkRanges(); err != nil {
+		return nil, err
+	}
+
+	fundNames, err := p.Source.FundNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting fund names: %w", err)
+	}
+
+	plan := &Plan{FundNames: fundNames, Ranges: map[string]string{}}
+	if p.ClearFolder {
+		plan.ClearFolder = p.DownloadFolder
+	}
+
+	plan.MissingLinks, err = p.Links.FundsNotInNames(ctx, fundNames)
+	if err != nil {
+		return nil, err
+	}
+
+	funds, err := p.Links.FundsByNames(ctx, fundNames)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := p.selectFunds(ctx, funds)
+	if err != nil {
+		return nil, err
+	}
+	plan.NotSelected = excludeFunds(funds, selected)
+
+	for _, fundName := range plan.MissingLinks {
+		selected = append(selected, database.Fund{Fundname: fundName})
+	}
+	selected, plan.Broken = p.skipBroken(selected)
+	plan.Selected, plan.SkippedByBatch = p.batch(selected)
+	for _, fund := range plan.Selected {
+		rng, _ := p.rangeFor(fund, time.Now())
+		plan.Ranges[fund.Fundname] = rng.String()
+	}
+
+	return plan, nil
+}
+
+// Print writes the plan out for an operator to read before a long run
+func (plan *Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d funds in source\n", len(plan.FundNames))
+	if plan.ClearFolder != "" {
+		fmt.Fprintf(w, "Would clear %s before starting\n", plan.ClearFolder)
+	}
+
+	fmt.Fprintf(w, "\nMissing links, would search fund selector (%d):\n", len(plan.MissingLinks))
+	for _, fundName := range plan.MissingLinks {
+		fmt.Fprintf(w, "  %s\n", fundName)
+	}
+
+	fmt.Fprintf(w, "\nWould scrape (%d):\n", len(plan.Selected))
+	for _, fund := range plan.Selected {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", fund.Fundname, linkOrMissing(fund), plan.Ranges[fund.Fundname])
+	}
+
+	fmt.Fprintf(w, "\nSkipped, downloaded recently (%d):\n", len(plan.NotSelected))
+	for _, fund := range plan.NotSelected {
+		fmt.Fprintf(w, "  %s\tlast downloaded %s\n", fund.Fundname, fund.Lastdownloaded)
+	}
+
+	fmt.Fprintf(w, "\nSkipped, failed too many runs in a row (%d):\n", len(plan.Broken))
+	for _, fund := range plan.Broken {
+		fmt.Fprintf(w, "  %s\n", fund.Fundname)
+	}
+
+	fmt.Fprintf(w, "\nSkipped by batchsize (%d):\n", len(plan.SkippedByBatch))
+	for _, fund := range plan.SkippedByBatch {
+		fmt.Fprintf(w, "  %s\n", fund.Fundname)
+	}
+}
+
+func linkOrMissing(fund database.Fund) string {
+	if fund.Link == "" {
+		return "(link to be found)"
+	}
+	return fund.Link
+}
+
+// selectFunds applies the pipeline's selector, keeping every fund if there is none
+func (p *Pipeline) selectFunds(ctx context.Context, funds []database.Fund) ([]database.Fund, error) {
+	if p.Select == nil {
+		return funds, nil
+	}
+
+	selected, err := p.Select.Select(ctx, funds)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting funds to download: %w", err)
+	}
+	return selected, nil
+}
+
+// batch splits funds into the ones within the batchsize and the ones over it
+func (p *Pipeline) batch(funds []database.Fund) (kept, skipped []database.Fund) {
+	if p.Batchsize <= 0 || len(funds) <= p.Batchsize {
+		return funds, nil
+	}
+	return funds[:p.Batchsize], funds[p.Batchsize:]
+}
+
+func excludeFunds(funds, exclude []database.Fund) []database.Fund {
+	excluded := make(map[string]struct{}, len(exclude))
+	for _, fund := range exclude {
+		excluded[fund.Fundname] = struct{}{}
+	}
+
+	var remaining []database.Fund
+	for _, fund := range funds {
+		if _, ok := excluded[fund.Fundname]; !ok {
+			remaining = append(remaining, fund)
+		}
+	}
+	return remaining
+}
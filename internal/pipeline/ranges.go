@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"fmt"
+	"scraper/internal/database"
+	"scraper/internal/report"
+	"scraper/internal/scraper"
+	"time"
+)
+
+// AutoRange picks the smallest preset that covers the days since the fund was last downloaded
+const AutoRange = "auto"
+
+// lastDownloadedLayouts are how the funds table returns lastdownloaded
+var lastDownloadedLayouts = []string{"2006-01-02 15:04:05", "2006-01-02"}
+
+// checkRanges returns an error for the first range setting that cannot be read
+func (p *Pipeline) checkRanges() error {
+	if _, err := parseRange(p.Range); err != nil {
+		return err
+	}
+	for fund, rng := range p.FundRanges {
+		if _, err := parseRange(rng); err != nil {
+			return fmt.Errorf("range for %s: %w", fund, err)
+		}
+	}
+	return nil
+}
+
+// rangeFor returns the price range to download for fund, its own range if it has one and Range otherwise
+func (p *Pipeline) rangeFor(fund database.Fund, now time.Time) (scraper.Range, error) {
+	spec := p.Range
+	if rng, ok := p.FundRanges[fund.Fundname]; ok {
+		spec = rng
+	}
+	if spec != AutoRange {
+		return scraper.ParseRange(spec)
+	}
+
+	last, ok := p.lastDownload(fund)
+	if !ok {
+		// Nothing downloaded yet, so get all the history there is
+		return scraper.Range{Preset: scraper.Presets[len(scraper.Presets)-1]}, nil
+	}
+	return scraper.CoveringRange(last, now), nil
+}
+
+// lastDownload returns when fund was last downloaded according to the funds table, or else the newest price in the
+// file already in the download folder, which is named after the fund's name if it was saved before files had codes
+func (p *Pipeline) lastDownload(fund database.Fund) (time.Time, bool) {
+	for _, layout := range lastDownloadedLayouts {
+		if last, err := time.ParseInLocation(layout, string(fund.Lastdownloaded), time.Local); err == nil {
+			return last, true
+		}
+	}
+
+	for _, path := range []string{scraper.DownloadPath(p.DownloadFolder, fund), scraper.DownloadPath(p.DownloadFolder, database.Fund{Fundname: fund.Fundname})} {
+		if prices, err := report.InspectPrices(path); err == nil && !prices.To.IsZero() {
+			return prices.To, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// rememberLastDownloads gives funds without a lastdownloaded date the date of the newest price in their file in the
+// download folder, so lastDownload still finds it after the folder is cleared
+func (p *Pipeline) rememberLastDownloads(funds []database.Fund) {
+	for i, fund := range funds {
+		if len(fund.Lastdownloaded) != 0 {
+			continue
+		}
+		if last, ok := p.lastDownload(fund); ok {
+			funds[i].Lastdownloaded = []uint8(last.Format(time.DateOnly))
+		}
+	}
+}
+
+func parseRange(spec string) (scraper.Range, error) {
+	if spec == AutoRange {
+		return scraper.Range{}, nil
+	}
+	return scraper.ParseRange(spec)
+}
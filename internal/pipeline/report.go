@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"log"
+	"scraper/internal/journal"
+	"scraper/internal/report"
+	"scraper/internal/scraper"
+	"time"
+)
+
+// writeReport writes the report of the run to ReportDir, if set. Errors are only logged as the downloads themselves
+// have already been saved.
+func (p *Pipeline) writeReport(j *journal.Journal, summary *Summary, started time.Time) {
+	if p.ReportDir == "" {
+		return
+	}
+
+	path, err := p.report(j, summary, started).Write(p.ReportDir)
+	if err != nil {
+		log.Printf("Could not write report for run %s: %v", j.ID, err)
+		return
+	}
+	log.Printf("Report for run %s written to %s", j.ID, path)
+}
+
+// report lists every fund in the journal with its result in this run, followed by the funds that failed before
+// they reached the journal and the ones skipped
+func (p *Pipeline) report(j *journal.Journal, summary *Summary, started time.Time) *report.Report {
+	summary.mu.Lock()
+	results := make(map[string]Result, len(summary.Results))
+	var linkFailures []Result
+	for _, result := range summary.Results {
+		if result.Step == "links" {
+			linkFailures = append(linkFailures, result)
+		} else {
+			results[result.Fund.Fundname] = result
+		}
+	}
+	skippedFunds := summary.Skipped
+	skipped := make(map[string]bool, len(skippedFunds))
+	for _, fund := range skippedFunds {
+		skipped[fund.Fundname] = true
+	}
+	summary.mu.Unlock()
+
+	r := &report.Report{RunID: j.ID, Source: j.Source, Started: started, Finished: time.Now(), Interrupted: summary.Interrupted}
+	r.BlockedRequests, r.BlockedBytes = summary.Blocked.Requests, summary.Blocked.Bytes
+
+	inJournal := make(map[string]bool)
+	for _, entry := range j.Entries() {
+		inJournal[entry.Fund.Fundname] = true
+		fund := report.Fund{Fund: entry.Fund.Fundname, Link: entry.Fund.Link, Attempts: entry.Attempts}
+
+		result, ok := results[entry.Fund.Fundname]
+		switch {
+		case ok:
+			fund.Attempts = result.Attempts
+			fund.DurationSeconds = result.Duration.Seconds()
+			fund.Path = result.Path
+			if result.Err != nil {
+				fund.Outcome, fund.Step, fund.Error = report.Failed, result.Step, result.Err.Error()
+			} else {
+				fund.Outcome = report.Downloaded
+			}
+		case entry.State == journal.Done:
+			// Downloaded before the run was resumed
+			fund.Outcome = report.Downloaded
+			fund.Path = scraper.DownloadPath(p.DownloadFolder, entry.Fund)
+		case skipped[entry.Fund.Fundname]:
+			fund.Outcome = report.Skipped
+		default:
+			fund.Outcome, fund.Error = report.NotFinished, entry.Error
+		}
+
+		if fund.Path != "" {
+			prices, err := report.InspectPrices(fund.Path)
+			if err != nil {
+				log.Print(err)
+			}
+			fund.Bytes, fund.Rows = prices.Bytes, prices.Rows
+			if prices.Rows != 0 {
+				fund.From, fund.To = prices.From.Format(time.DateOnly), prices.To.Format(time.DateOnly)
+			}
+		}
+
+		r.Funds = append(r.Funds, fund)
+	}
+
+	for _, result := range linkFailures {
+		r.Funds = append(r.Funds, report.Fund{Fund: result.Fund.Fundname, Outcome: report.Failed, Step: result.Step, Error: result.Err.Error()})
+	}
+	for _, fund := range skippedFunds {
+		if !inJournal[fund.Fundname] {
+			r.Funds = append(r.Funds, report.Fund{Fund: fund.Fundname, Link: fund.Link, Outcome: report.Skipped})
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,135 @@
+package pipeline
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"scraper/internal/scraper"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var reviewHeader = []string{"Fund Name", "Rank", "Result", "Code", "Link", "Score", "Searched", "Pick"}
+
+const (
+	reviewFund = 0
+	reviewLink = 4
+	reviewPick = 7
+)
+
+// LinkReview keeps the ranked search results of funds whose link could not be picked confidently in a CSV file, one
+// set of rows per fund. Someone picks the right result by filling in its Pick column, and the next run that looks the
+// fund up adds that link to the link store instead of searching again.
+type LinkReview struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Add replaces the rows of ambiguous's fund with its ranked results, so funds searched again are not listed twice
+func (r *LinkReview) Add(ambiguous *scraper.AmbiguousLinkError) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rows, err := r.read()
+	if err != nil {
+		return err
+	}
+	rows = slices.DeleteFunc(rows, func(row []string) bool { return row[reviewFund] == ambiguous.Fundname })
+
+	searched := time.Now().Format(time.RFC3339)
+	for i, c := range ambiguous.Candidates {
+		rows = append(rows, []string{ambiguous.Fundname, strconv.Itoa(i + 1), c.Name, c.Code, c.Link, strconv.FormatFloat(c.Score, 'f', 2, 64), searched, ""})
+	}
+
+	return r.write(rows)
+}
+
+// Picked returns the links picked for any of fundNames, by fund name
+func (r *LinkReview) Picked(fundNames []string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rows, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+
+	picked := make(map[string]string)
+	for _, row := range rows {
+		if strings.TrimSpace(row[reviewPick]) != "" && slices.Contains(fundNames, row[reviewFund]) {
+			picked[row[reviewFund]] = row[reviewLink]
+		}
+	}
+	return picked, nil
+}
+
+// Remove drops the rows of fundNames, once their picked links are in the link store
+func (r *LinkReview) Remove(fundNames []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rows, err := r.read()
+	if err != nil {
+		return err
+	}
+	return r.write(slices.DeleteFunc(rows, func(row []string) bool { return slices.Contains(fundNames, row[reviewFund]) }))
+}
+
+// read returns the rows of the review file without its header, padded to every column for files written before the
+// Pick column was added
+func (r *LinkReview) read() ([][]string, error) {
+	f, err := os.Open(r.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open link review file: %w", err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not read link review file: %w", err)
+	}
+	if len(rows) != 0 && rows[0][reviewFund] == reviewHeader[reviewFund] {
+		rows = rows[1:]
+	}
+	for i, row := range rows {
+		for len(row) < len(reviewHeader) {
+			row = append(row, "")
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// write rewrites the review file through a temporary file so a crash cannot leave it half written
+func (r *LinkReview) write(rows [][]string) error {
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		return fmt.Errorf("could not create link review folder: %w", err)
+	}
+
+	tmp := r.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not write link review file: %w", err)
+	}
+	w := csv.NewWriter(f)
+	w.Write(reviewHeader)
+	w.WriteAll(rows)
+	if err := errors.Join(w.Error(), f.Close()); err != nil {
+		return fmt.Errorf("could not write link review file: %w", err)
+	}
+
+	if err := os.Rename(tmp, r.Path); err != nil {
+		return fmt.Errorf("could not write link review file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"scraper/internal/database"
+	"scraper/internal/local"
+	"scraper/internal/scraper"
+	"sync"
+	"time"
+)
+
+// DownloadSink is told about every fund whose prices were downloaded successfully
+type DownloadSink interface {
+	Downloaded(ctx context.Context, fund database.Fund, path string) error
+}
+
+// FactsheetSink is told what was read from the page of every fund downloaded in the browser
+type FactsheetSink interface {
+	Factsheet(ctx context.Context, fund database.Fund, sheet *scraper.Factsheet) error
+}
+
+// DBSink records the download date in the funds table so the fund is not picked again within downloadWithinDays
+type DBSink struct {
+	DB        *sql.DB
+	TableName string
+}
+
+func (s DBSink) Downloaded(ctx context.Context, fund database.Fund, path string) error {
+	return database.UpdateLastDownloaded(ctx, s.DB, s.TableName, fund)
+}
+
+// Factsheet keeps the fund info, distributions and allocations in their tables next to the funds table, keyed on the
+// fund's code so they outlive a rename
+func (s DBSink) Factsheet(ctx context.Context, fund database.Fund, sheet *scraper.Factsheet) error {
+	if sheet.Info != nil {
+		if err := database.SaveFundInfo(ctx, s.DB, database.InfoTable(s.TableName), fund.WithCode().Key(), *sheet.Info); err != nil {
+			return err
+		}
+	}
+	if len(sheet.Distributions) != 0 {
+		if err := database.SaveDistributions(ctx, s.DB, database.DistributionTable(s.TableName), fund.WithCode().Key(), sheet.Distributions); err != nil {
+			return err
+		}
+	}
+	if len(sheet.Allocations) != 0 {
+		return database.SaveAllocations(ctx, s.DB, database.AllocationTable(s.TableName), fund.WithCode().Key(), sheet.Allocations)
+	}
+	return nil
+}
+
+// ExcelFactsheets keeps the fund info and allocation snapshots in sheets of the Planning workbook, normally the Info
+// and Allocations sheets
+type ExcelFactsheets struct {
+	Path            string
+	InfoSheet       string
+	AllocationSheet string
+}
+
+func (s *ExcelFactsheets) Factsheet(ctx context.Context, fund database.Fund, sheet *scraper.Factsheet) error {
+	defer lockWorkbook(s.Path)()
+
+	if sheet.Info != nil {
+		if err := local.SaveFundInfo(fund, *sheet.Info, time.Now(), s.Path, s.InfoSheet); err != nil {
+			return err
+		}
+	}
+	if len(sheet.Allocations) != 0 {
+		return local.SaveAllocations(fund, sheet.Allocations, s.Path, s.AllocationSheet)
+	}
+	return nil
+}
+
+// CSVSink appends a line per download to a CSV log, creating it with a header if it does not exist
+type CSVSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *CSVSink) Downloaded(ctx context.Context, fund database.Fund, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := os.Stat(s.Path)
+	newFile := os.IsNotExist(err)
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open download log: %w", err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if newFile {
+		w.Write([]string{"Fund Name", "Link", "File", "Downloaded"})
+	}
+	w.Write([]string{fund.Fundname, fund.Link, path, time.Now().Format(time.RFC3339)})
+	w.Flush()
+
+	return w.Error()
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"scraper/internal/database"
+	"scraper/internal/local"
+	"strings"
+)
+
+// FundSource lists the names of the funds a run should cover
+type FundSource interface {
+	FundNames(ctx context.Context) ([]string, error)
+}
+
+// ExcelSource reads fund names from the first column of a sheet, e.g. the Planning sheet of Planning.xlsx.
+// An empty Sheet reads the sheet named after the file, which is how FSM names its exported fund lists.
+type ExcelSource struct {
+	Path  string
+	Sheet string
+}
+
+func (s ExcelSource) FundNames(ctx context.Context) ([]string, error) {
+	defer lockWorkbook(s.Path)()
+	if s.Sheet == "" {
+		return local.GetAllFunds(s.Path)
+	}
+	return local.GetFundNames(s.Path, s.Sheet)
+}
+
+// DBSource lists every fund already in the funds table
+type DBSource struct {
+	DB        *sql.DB
+	TableName string
+}
+
+func (s DBSource) FundNames(ctx context.Context) ([]string, error) {
+	funds, err := database.AllFunds(ctx, s.DB, s.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var fundNames []string
+	for _, fund := range funds {
+		fundNames = append(fundNames, fund.Fundname)
+	}
+	return fundNames, nil
+}
+
+// CSVSource reads fund names from the first column of a CSV watchlist. Lines starting with # are ignored, as is a
+// "Fund Name" header.
+type CSVSource struct {
+	Path string
+}
+
+func (s CSVSource) FundNames(ctx context.Context) ([]string, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open watchlist: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	var fundNames []string
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read watchlist %s: %w", s.Path, err)
+		}
+
+		fundName := strings.TrimSpace(record[0])
+		if fundName == "" || isHeader(fundName) {
+			continue
+		}
+		fundNames = append(fundNames, fundName)
+	}
+
+	return fundNames, nil
+}
+
+// ListSource reads one fund name per line, e.g. from stdin
+type ListSource struct {
+	Reader io.Reader
+}
+
+func (s ListSource) FundNames(ctx context.Context) ([]string, error) {
+	var fundNames []string
+
+	scanner := bufio.NewScanner(s.Reader)
+	for scanner.Scan() {
+		fundName := strings.TrimSpace(scanner.Text())
+		if fundName == "" || strings.HasPrefix(fundName, "#") {
+			continue
+		}
+		fundNames = append(fundNames, fundName)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read fund list: %w", err)
+	}
+
+	return fundNames, nil
+}
+
+func isHeader(cell string) bool {
+	return strings.EqualFold(strings.ReplaceAll(cell, " ", ""), "fundname")
+}
@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"path/filepath"
+	"scraper/internal/database"
+	"scraper/internal/local"
+	"sync"
+)
+
+// LinkStore remembers the factsheet link found for each fund so it only has to be searched for once
+type LinkStore interface {
+	FundsByNames(ctx context.Context, names []string) ([]database.Fund, error)
+	FundsNotInNames(ctx context.Context, names []string) ([]string, error)
+	AddFund(ctx context.Context, fund database.Fund) error
+}
+
+// ExcelLinks keeps fund links in a sheet of the Planning workbook, normally the Link sheet
+type ExcelLinks struct {
+	Path  string
+	Sheet string
+	// Listing is an optional sheet listing funds by name, normally the Planning sheet, where a fund stored again under
+	// a new name is renamed too so the next run looks it up by that name
+	Listing string
+}
+
+func (s *ExcelLinks) FundsByNames(ctx context.Context, names []string) ([]database.Fund, error) {
+	defer lockWorkbook(s.Path)()
+	return local.FundsByNames(s.Path, s.Sheet, names)
+}
+
+func (s *ExcelLinks) FundsNotInNames(ctx context.Context, names []string) ([]string, error) {
+	defer lockWorkbook(s.Path)()
+	return local.FundsNotInNames(s.Path, s.Sheet, names)
+}
+
+func (s *ExcelLinks) AddFund(ctx context.Context, fund database.Fund) error {
+	defer lockWorkbook(s.Path)()
+
+	fund = fund.WithCode()
+	old, err := local.FundByCode(s.Path, s.Sheet, fund.Code)
+	if err != nil && !errors.Is(err, local.ErrNotFound) {
+		return err
+	}
+	if err := local.AddFunds([]database.Fund{fund}, s.Path, s.Sheet); err != nil {
+		return err
+	}
+
+	if s.Listing == "" || old.Fundname == "" || old.Fundname == fund.Fundname {
+		return nil
+	}
+	log.Printf("Renaming %s to %s in the %s sheet", old.Fundname, fund.Fundname, s.Listing)
+	if err := local.RenameFund(old.Fundname, fund.Fundname, s.Path, s.Listing); err != nil && !errors.Is(err, local.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// workbooks holds a lock per workbook path. excelize rewrites the whole workbook on every save, so the Link sheet and
+// the factsheet sinks writing to the same Planning.xlsx must take turns or one save loses the other's changes.
+var workbooks sync.Map
+
+// lockWorkbook locks the workbook at path and returns its unlock
+func lockWorkbook(path string) func() {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	mu, _ := workbooks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// DBLinks keeps fund links in the funds table
+type DBLinks struct {
+	DB        *sql.DB
+	TableName string
+}
+
+func (s DBLinks) FundsByNames(ctx context.Context, names []string) ([]database.Fund, error) {
+	return database.FundsByNames(ctx, s.DB, s.TableName, names)
+}
+
+func (s DBLinks) FundsNotInNames(ctx context.Context, names []string) ([]string, error) {
+	return database.FundsNotInNames(ctx, s.DB, s.TableName, names)
+}
+
+func (s DBLinks) AddFund(ctx context.Context, fund database.Fund) error {
+	_, err := database.AddFund(ctx, s.DB, s.TableName, fund)
+	return err
+}
+
+// Selector narrows down the linked funds to the ones that should be downloaded in this run
+type Selector interface {
+	Select(ctx context.Context, funds []database.Fund) ([]database.Fund, error)
+}
+
+// StaleFunds selects funds that have not been downloaded within Days according to the funds table
+type StaleFunds struct {
+	DB        *sql.DB
+	TableName string
+	Days      int
+}
+
+func (s StaleFunds) Select(ctx context.Context, funds []database.Fund) ([]database.Fund, error) {
+	fundsNotDownloaded, err := database.FundsNotDownloadedWithinDays(ctx, s.DB, s.TableName, s.Days)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyed on code, so a fund renamed since its name was listed is still found
+	stale := make(map[string]struct{}, len(fundsNotDownloaded))
+	for _, fund := range fundsNotDownloaded {
+		stale[fund.Key()] = struct{}{}
+	}
+
+	var selected []database.Fund
+	for _, fund := range funds {
+		if _, ok := stale[fund.WithCode().Key()]; ok {
+			selected = append(selected, fund)
+		}
+	}
+
+	return selected, nil
+}
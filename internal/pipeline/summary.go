@@ -0,0 +1,85 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"scraper/internal/database"
+	"scraper/internal/scraper"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of one fund in a run, Err is nil if it was downloaded
+type Result struct {
+	Fund     database.Fund
+	Step     string //links or download
+	Attempts int
+	Duration time.Duration
+	Path     string //where the prices were saved
+	Err      error
+}
+
+// Summary collects the result of every fund attempted in a run
+type Summary struct {
+	RunID       string
+	Results     []Result
+	Interrupted bool            //the run was cancelled before every fund was attempted
+	Skipped     []database.Fund //left out because they failed too many runs in a row
+	Blocked     scraper.BlockStats
+	mu          sync.Mutex
+}
+
+func (s *Summary) add(result Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Results = append(s.Results, result)
+}
+
+// Failed returns the results of the funds that could not be downloaded
+func (s *Summary) Failed() []Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failed []Result
+	for _, result := range s.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Print writes a line per fund followed by the totals
+func (s *Summary) Print(w io.Writer) {
+	failed := s.Failed()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "\nSummary for run %s:\n", s.RunID)
+	for _, result := range s.Results {
+		if result.Err == nil {
+			fmt.Fprintf(w, "  OK      %s\n", result.Fund.Fundname)
+		} else {
+			fmt.Fprintf(w, "  FAILED  %s (%s%s): %v\n", result.Fund.Fundname, result.Step, attempts(result), result.Err)
+		}
+	}
+	for _, fund := range s.Skipped {
+		fmt.Fprintf(w, "  SKIPPED %s, kept failing in earlier runs\n", fund.Fundname)
+	}
+	fmt.Fprintf(w, "%d/%d funds downloaded, %d failed\n", len(s.Results)-len(failed), len(s.Results), len(failed))
+	if s.Blocked.Requests != 0 {
+		fmt.Fprintf(w, "Blocked %s\n", s.Blocked)
+	}
+	if s.Interrupted {
+		fmt.Fprintf(w, "Run interrupted, continue with -resume %s\n", s.RunID)
+	}
+}
+
+func attempts(result Result) string {
+	if result.Attempts <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(", %d attempts", result.Attempts)
+}
@@ -0,0 +1,153 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// dateLayouts are the date formats seen in the first column of FSM price exports
+var dateLayouts = []string{"2006-01-02", "02/01/2006", "2/1/2006", "02-01-2006", "2006/01/02", "02 Jan 2006", "2 Jan 2006", "Jan 02, 2006", "01-02-06", "1-2-06"}
+
+// PriceFile describes a downloaded price file
+type PriceFile struct {
+	Bytes    int64
+	Rows     int //rows with a date in the first column
+	From, To time.Time
+}
+
+// InspectPrices reads the price file at path, which may be a CSV or an xlsx workbook, and counts its price rows and the
+// dates they cover
+func InspectPrices(path string) (PriceFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PriceFile{}, fmt.Errorf("could not read price file: %w", err)
+	}
+
+	rows, err := readRows(data)
+	if err != nil {
+		return PriceFile{Bytes: int64(len(data))}, fmt.Errorf("could not read price file %s: %w", path, err)
+	}
+
+	file := PriceFile{Bytes: int64(len(data))}
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		date, ok := ParseDate(row[0])
+		if !ok {
+			continue //header
+		}
+
+		file.Rows++
+		if file.From.IsZero() || date.Before(file.From) {
+			file.From = date
+		}
+		if date.After(file.To) {
+			file.To = date
+		}
+	}
+
+	return file, nil
+}
+
+// TrimPrices drops the price rows of an export dated before from or after to, keeping the header and any other rows.
+// Workbooks keep their formatting, only the rows of their first sheet are removed.
+func TrimPrices(data []byte, from, to time.Time) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return trimWorkbook(data, from, to)
+	}
+
+	rows, err := readRows(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not read prices: %w", err)
+	}
+
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	for _, row := range rows {
+		if len(row) != 0 {
+			if date, ok := ParseDate(row[0]); ok && (date.Before(from) || date.After(to)) {
+				continue
+			}
+		}
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return out.Bytes(), w.Error()
+}
+
+func trimWorkbook(data []byte, from, to time.Time) ([]byte, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not read prices: %w", err)
+	}
+	defer f.Close()
+
+	sheet := f.GetSheetName(0)
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("could not read prices: %w", err)
+	}
+	// From the bottom so removing a row does not move the ones still to check
+	for i := len(rows) - 1; i >= 0; i-- {
+		if len(rows[i]) == 0 {
+			continue
+		}
+		if date, ok := ParseDate(rows[i][0]); ok && (date.Before(from) || date.After(to)) {
+			if err := f.RemoveRow(sheet, i+1); err != nil {
+				return nil, fmt.Errorf("could not trim prices: %w", err)
+			}
+		}
+	}
+
+	out, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, fmt.Errorf("could not write prices: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+func readRows(data []byte) ([][]string, error) {
+	// xlsx files are zip archives
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		f, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.GetRows(f.GetSheetName(0))
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	return r.ReadAll()
+}
+
+// ParseDate reads a date as FSM writes it in exports and on its pages
+func ParseDate(cell string) (time.Time, bool) {
+	cell = strings.TrimSpace(cell)
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, cell); err == nil {
+			return date, true
+		}
+	}
+
+	// Dates in workbooks without a date format are read as serial numbers
+	if serial, err := strconv.ParseFloat(cell, 64); err == nil && serial > 1 && serial < 100000 {
+		if date, err := excelize.ExcelDateToTime(serial, false); err == nil {
+			return date, true
+		}
+	}
+
+	return time.Time{}, false
+}
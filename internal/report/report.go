@@ -0,0 +1,117 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Outcome string
+
+const (
+	Downloaded  Outcome = "downloaded"
+	Failed      Outcome = "failed"
+	Skipped     Outcome = "skipped"      //left out for failing too many runs in a row
+	NotFinished Outcome = "not finished" //not attempted or cancelled before the run stopped
+)
+
+// Fund is what happened to one fund in a run
+type Fund struct {
+	Fund            string  `json:"fund"`
+	Link            string  `json:"link,omitempty"`
+	Outcome         Outcome `json:"outcome"`
+	Step            string  `json:"step,omitempty"` //where it failed, links or download
+	Attempts        int     `json:"attempts,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Bytes           int64   `json:"bytes"`
+	Rows            int     `json:"rows"`
+	From            string  `json:"from,omitempty"` //first price date in the file, 2006-01-02
+	To              string  `json:"to,omitempty"`   //last price date in the file
+	Path            string  `json:"path,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Report lists every fund in a run, written as JSON and HTML so runs can be archived and compared
+type Report struct {
+	RunID       string    `json:"run_id"`
+	Source      string    `json:"source"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Interrupted bool      `json:"interrupted"`
+	Funds       []Fund    `json:"funds"`
+
+	BlockedRequests int   `json:"blocked_requests"` //requests of fund pages failed instead of sent
+	BlockedBytes    int64 `json:"blocked_bytes"`    //measured size of the blocked requests
+}
+
+// Count returns how many funds had outcome
+func (r *Report) Count(outcome Outcome) int {
+	n := 0
+	for _, fund := range r.Funds {
+		if fund.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// Write saves the report as <run id>.json and <run id>.html in dir, returning the path of the JSON file
+func (r *Report) Write(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", fmt.Errorf("could not create report directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	jsonPath := filepath.Join(dir, r.RunID+".json")
+	if err := os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("could not write report: %w", err)
+	}
+
+	f, err := os.Create(filepath.Join(dir, r.RunID+".html"))
+	if err != nil {
+		return "", fmt.Errorf("could not write report: %w", err)
+	}
+	defer f.Close()
+	if err := page.Execute(f, r); err != nil {
+		return "", fmt.Errorf("could not write report: %w", err)
+	}
+
+	return jsonPath, f.Close()
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"seconds": func(s float64) string { return fmt.Sprintf("%.1fs", s) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Run {{.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.number { text-align: right; }
+tr.failed { background: #fdd; }
+tr.skipped, tr.not-finished { background: #eee; }
+</style>
+</head>
+<body>
+<h1>Run {{.RunID}} ({{.Source}})</h1>
+<p>Started {{.Started.Format "2006-01-02 15:04:05"}}, finished {{.Finished.Format "2006-01-02 15:04:05"}}{{if .Interrupted}}, interrupted{{end}}</p>
+<p>{{.Count "downloaded"}} downloaded, {{.Count "failed"}} failed, {{.Count "skipped"}} skipped, {{.Count "not finished"}} not finished</p>
+{{if .BlockedRequests}}<p>{{.BlockedRequests}} requests blocked, {{.BlockedBytes}} bytes saved</p>
+{{end}}<table>
+<tr><th>Fund</th><th>Outcome</th><th>Attempts</th><th>Duration</th><th>Bytes</th><th>Rows</th><th>From</th><th>To</th><th>File</th><th>Error</th></tr>
+{{range .Funds}}<tr class="{{if eq .Outcome "not finished"}}not-finished{{else}}{{.Outcome}}{{end}}">
+<td>{{if .Link}}<a href="{{.Link}}">{{.Fund}}</a>{{else}}{{.Fund}}{{end}}</td><td>{{.Outcome}}{{if .Step}} ({{.Step}}){{end}}</td><td class="number">{{.Attempts}}</td><td class="number">{{seconds .DurationSeconds}}</td><td class="number">{{.Bytes}}</td><td class="number">{{.Rows}}</td><td>{{.From}}</td><td>{{.To}}</td><td>{{.Path}}</td><td>{{.Error}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,150 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestReport(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Testing CSV prices are inspected", func(t *testing.T) {
+		path := filepath.Join(dir, "fund1.csv")
+		content := "Date,fund1\n2024-08-21,1.01\n2024-05-23,0.98\n2024-08-22,1.02\n"
+		writeFile(t, path, content)
+
+		prices, err := InspectPrices(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPrices(t, prices, 3, "2024-05-23", "2024-08-22")
+		if prices.Bytes != int64(len(content)) {
+			t.Errorf("Expected %d bytes, got %d", len(content), prices.Bytes)
+		}
+	})
+
+	t.Run("Testing xlsx prices saved as csv are inspected", func(t *testing.T) {
+		path := filepath.Join(dir, "fund2.csv")
+		f := excelize.NewFile()
+		for i, row := range [][]any{{"Date", "fund2"}, {"23/05/2024", 5.1}, {"22/08/2024", 5.3}} {
+			cell, _ := excelize.CoordinatesToCellName(1, i+1)
+			if err := f.SetSheetRow("Sheet1", cell, &row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf, err := f.WriteToBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, path, buf.String())
+
+		prices, err := InspectPrices(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPrices(t, prices, 2, "2024-05-23", "2024-08-22")
+	})
+
+	t.Run("Testing prices outside a custom range are trimmed", func(t *testing.T) {
+		data := []byte("Date,fund1\n2024-05-23,0.98\n2024-08-21,1.01\n2024-08-22,1.02\n2024-08-23,1.03\n")
+		from := time.Date(2024, 8, 21, 0, 0, 0, 0, time.UTC)
+		to := time.Date(2024, 8, 22, 0, 0, 0, 0, time.UTC)
+
+		trimmed, err := TrimPrices(data, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(trimmed), "Date,fund1\n2024-08-21,1.01\n2024-08-22,1.02\n"; got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("Testing prices outside a custom range are trimmed from workbooks", func(t *testing.T) {
+		f := excelize.NewFile()
+		for i, row := range [][]any{{"Date", "fund2"}, {"23/05/2024", 5.1}, {"21/08/2024", 5.2}, {"22/08/2024", 5.3}, {"23/08/2024", 5.4}} {
+			cell, _ := excelize.CoordinatesToCellName(1, i+1)
+			if err := f.SetSheetRow("Sheet1", cell, &row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf, err := f.WriteToBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trimmed, err := TrimPrices(buf.Bytes(), time.Date(2024, 8, 21, 0, 0, 0, 0, time.UTC), time.Date(2024, 8, 22, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := readRows(trimmed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][]string{{"Date", "fund2"}, {"21/08/2024", "5.2"}, {"22/08/2024", "5.3"}}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("Expected %v, got %v", want, rows)
+		}
+	})
+
+	t.Run("Testing report is written as JSON and HTML", func(t *testing.T) {
+		r := &Report{
+			RunID:   "20240823-190000",
+			Source:  "planning",
+			Started: time.Date(2024, 8, 23, 19, 0, 0, 0, time.UTC),
+			Funds: []Fund{
+				{Fund: "fund1", Outcome: Downloaded, Rows: 3, From: "2024-05-23", To: "2024-08-22", Path: "data/planning/fund1.csv"},
+				{Fund: "fund<2>", Outcome: Failed, Step: "download", Attempts: 3, Error: "wait for download: context deadline exceeded"},
+			},
+		}
+
+		path, err := r.Write(filepath.Join(dir, "reports"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Report
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Funds) != 2 || got.Funds[1].Outcome != Failed || got.Funds[0].To != "2024-08-22" {
+			t.Fatalf("Unexpected report %+v", got)
+		}
+
+		html, err := os.ReadFile(filepath.Join(dir, "reports", "20240823-190000.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"1 downloaded, 1 failed, 0 skipped, 0 not finished", "fund&lt;2&gt;", "failed (download)"} {
+			if !strings.Contains(string(html), want) {
+				t.Errorf("Expected HTML report to contain %q, got:\n%s", want, html)
+			}
+		}
+	})
+}
+
+func writeFile(t testing.TB, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertPrices(t testing.TB, prices PriceFile, rows int, from, to string) {
+	t.Helper()
+
+	if prices.Rows != rows || prices.From.Format(time.DateOnly) != from || prices.To.Format(time.DateOnly) != to {
+		t.Fatalf("Expected %d rows from %s to %s, got %d rows from %s to %s", rows, from, to, prices.Rows, prices.From.Format(time.DateOnly), prices.To.Format(time.DateOnly))
+	}
+}
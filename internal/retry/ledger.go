@@ -0,0 +1,138 @@
+package retry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record is how a fund has been failing across runs
+type Record struct {
+	FailedRuns    int       `json:"failed_runs"`    //runs in a row the fund failed in
+	PermanentRuns int       `json:"permanent_runs"` //runs in a row the fund failed in with a permanent failure
+	Attempts      int       `json:"attempts"`       //attempts over those runs
+	Class         Class     `json:"class"`          //class of the last failure
+	Error         string    `json:"error"`
+	Updated       time.Time `json:"updated"`
+}
+
+// Ledger keeps a Record for every fund that failed in its last run, so funds that keep failing can be left out of
+// batches instead of using up the batchsize every run. Funds are keyed on their code so renames keep their failures.
+type Ledger struct {
+	Path      string
+	SkipAfter int //permanently failed runs in a row before a fund is skipped, 0 never skips
+
+	records map[string]Record
+	mu      sync.Mutex
+}
+
+// OpenLedger reads the ledger at path, which may not exist yet
+func OpenLedger(path string, skipAfter int) (*Ledger, error) {
+	l := &Ledger{Path: path, SkipAfter: skipAfter, records: make(map[string]Record)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read failure ledger: %w", err)
+	}
+	if err := json.Unmarshal(data, &l.records); err != nil {
+		return nil, fmt.Errorf("could not read failure ledger %s: %w", path, err)
+	}
+
+	return l, nil
+}
+
+// Failed records that the fund with key failed this run after attempts with err
+func (l *Ledger) Failed(key string, attempts int, err error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record := l.records[key]
+	record.FailedRuns++
+	record.Attempts += attempts
+	record.Class = Classify(err)
+	if record.Class == Permanent {
+		record.PermanentRuns++
+	} else {
+		record.PermanentRuns = 0 //a timeout says nothing about whether the fund is broken
+	}
+	record.Error = err.Error()
+	record.Updated = time.Now()
+	l.records[key] = record
+
+	return l.save()
+}
+
+// Succeeded forgets earlier failures of the fund with key
+func (l *Ledger) Succeeded(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.records[key]; !ok {
+		return nil
+	}
+	delete(l.records, key)
+
+	return l.save()
+}
+
+// Record returns the failures of the fund with key, ok is false if it did not fail in its last run
+func (l *Ledger) Record(key string) (record Record, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, ok = l.records[key]
+	return record, ok
+}
+
+// Migrate moves records stored under a fund's name, as they were before funds were keyed on their codes, to the key
+// keys gives for that name. A record already under the key is kept. The move is saved with the next change to the
+// ledger, so dry runs can migrate without writing.
+func (l *Ledger) Migrate(keys map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for name, key := range keys {
+		record, ok := l.records[name]
+		if !ok || name == key {
+			continue
+		}
+		if _, ok := l.records[key]; !ok {
+			l.records[key] = record
+		}
+		delete(l.records, name)
+	}
+}
+
+// Broken reports whether the fund with key has failed permanently SkipAfter runs in a row, funds that only time out
+// are never skipped as they are likely to work once the site recovers
+func (l *Ledger) Broken(key string) bool {
+	record, ok := l.Record(key)
+	return ok && l.SkipAfter > 0 && record.PermanentRuns >= l.SkipAfter
+}
+
+// save rewrites the ledger through a temporary file so a crash cannot leave it half written
+func (l *Ledger) save() error {
+	data, err := json.MarshalIndent(l.records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0777); err != nil {
+		return fmt.Errorf("could not create failure ledger directory: %w", err)
+	}
+	tmp := l.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("could not write failure ledger: %w", err)
+	}
+	if err := os.Rename(tmp, l.Path); err != nil {
+		return fmt.Errorf("could not write failure ledger: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"scraper/internal/config"
+	"time"
+)
+
+// Class says whether trying again could fix a failure
+type Class string
+
+const (
+	Transient Class = "transient" //e.g. a navigation timeout or a download that never started
+	Permanent Class = "permanent" //e.g. the fund was renamed or has no factsheet link
+)
+
+// permanentError marks an error that retrying will not fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+func (e *permanentError) Permanent() bool {
+	return true
+}
+
+// MarkPermanent wraps err so Classify treats it as permanent, errors.Is and errors.As still see err
+func MarkPermanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Classify returns Permanent if any error in err's chain has a Permanent method returning true, and Transient
+// otherwise. Unknown failures are assumed to be transient so they get retried.
+func Classify(err error) Class {
+	var p interface{ Permanent() bool }
+	if errors.As(err, &p) && p.Permanent() {
+		return Permanent
+	}
+	return Transient
+}
+
+// Policy decides how often and how soon a failing fund is tried again
+type Policy struct {
+	TransientAttempts int           //attempts allowed when the last failure was transient, including the first
+	PermanentAttempts int           //attempts allowed when the last failure was permanent, normally 1
+	BaseDelay         time.Duration //wait before the second attempt, doubled for every attempt after
+	MaxDelay          time.Duration
+	AttemptTimeout    time.Duration //0 lets an attempt run until its context is cancelled
+}
+
+// Attempts returns how many attempts the policy allows for failures of class
+func (p Policy) Attempts(class Class) int {
+	attempts := p.TransientAttempts
+	if class == Permanent {
+		attempts = p.PermanentAttempts
+	}
+	return max(1, attempts)
+}
+
+// Do calls fn until it succeeds or runs out of attempts for the class of its last error, waiting with exponential
+// backoff and jitter in between. Cancelling ctx stops further attempts but not one already running; the returned error
+// then also wraps ctx.Err().
+func (p Policy) Do(ctx context.Context, fn func(attempt int) error) (attempts int, err error) {
+	for {
+		attempts++
+		err = fn(attempts)
+		if err == nil {
+			return attempts, nil
+		}
+
+		if attempts >= p.Attempts(Classify(err)) {
+			return attempts, err
+		}
+
+		timer := time.NewTimer(p.Backoff(attempts))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, fmt.Errorf("%w, not retried: %w", err, ctx.Err())
+		}
+	}
+}
+
+// Backoff returns how long to wait after the given attempt failed: BaseDelay doubled for each earlier attempt, capped
+// at MaxDelay, with up to half of it taken off at random so funds failing together do not retry together
+func (p Policy) Backoff(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay - rand.N(delay/2+1)
+}
+
+// WithTimeout limits ctx to the policy's AttemptTimeout, so a page waiting for an element that never appears fails
+// instead of hanging
+func (p Policy) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.AttemptTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.AttemptTimeout)
+}
+
+// NewPolicy returns the policy set in the retry section of the config
+func NewPolicy(cfg config.Retry) Policy {
+	return Policy{
+		TransientAttempts: cfg.TransientAttempts,
+		PermanentAttempts: cfg.PermanentAttempts,
+		BaseDelay:         cfg.BaseDelay,
+		MaxDelay:          cfg.MaxDelay,
+		AttemptTimeout:    cfg.AttemptTimeout,
+	}
+}
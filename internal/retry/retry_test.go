@@ -0,0 +1,179 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type renamedError struct{}
+
+func (renamedError) Error() string   { return "fund renamed" }
+func (renamedError) Permanent() bool { return true }
+
+func TestRetry(t *testing.T) {
+	policy := Policy{TransientAttempts: 3, PermanentAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond}
+
+	t.Run("Testing errors are classified", func(t *testing.T) {
+		timeout := errors.New("navigation timed out")
+		for _, tc := range []struct {
+			err  error
+			want Class
+		}{
+			{timeout, Transient},
+			{MarkPermanent(timeout), Permanent},
+			{fmt.Errorf("fund1: open fund page: %w", MarkPermanent(timeout)), Permanent},
+			{fmt.Errorf("fund1: %w", renamedError{}), Permanent},
+		} {
+			if got := Classify(tc.err); got != tc.want {
+				t.Errorf("Expected %v to be %s, got %s", tc.err, tc.want, got)
+			}
+		}
+
+		if !errors.Is(MarkPermanent(timeout), timeout) {
+			t.Error("Expected permanent error to wrap the original error")
+		}
+	})
+
+	t.Run("Testing transient failures are retried up to the limit", func(t *testing.T) {
+		attempts, err := policy.Do(context.Background(), func(attempt int) error {
+			return errors.New("download never started")
+		})
+		assertAttempts(t, attempts, err, 3, true)
+	})
+
+	t.Run("Testing permanent failures are not retried", func(t *testing.T) {
+		attempts, err := policy.Do(context.Background(), func(attempt int) error {
+			return renamedError{}
+		})
+		assertAttempts(t, attempts, err, 1, true)
+	})
+
+	t.Run("Testing success after a transient failure", func(t *testing.T) {
+		attempts, err := policy.Do(context.Background(), func(attempt int) error {
+			if attempt == 1 {
+				return errors.New("element not found")
+			}
+			return nil
+		})
+		assertAttempts(t, attempts, err, 2, false)
+	})
+
+	t.Run("Testing cancelling stops retries", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		slow := Policy{TransientAttempts: 3, BaseDelay: time.Hour}
+
+		attempts, err := slow.Do(ctx, func(attempt int) error {
+			cancel()
+			return errors.New("navigation timed out")
+		})
+		assertAttempts(t, attempts, err, 1, true)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected error to wrap context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("Testing backoff grows and is capped", func(t *testing.T) {
+		policy := Policy{BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+		for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 8 * time.Second} {
+			delay := policy.Backoff(attempt)
+			if delay < max/2 || delay > max {
+				t.Errorf("Expected backoff after attempt %d to be between %s and %s, got %s", attempt, max/2, max, delay)
+			}
+		}
+	})
+}
+
+func TestLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.json")
+
+	ledger, err := OpenLedger(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		if err := ledger.Failed("fund1", 3, errors.New("navigation timed out")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ledger.Failed("fund2", 1, renamedError{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ledger.Failed("fund3", 1, renamedError{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.Succeeded("fund2"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Testing funds that keep failing permanently are broken", func(t *testing.T) {
+		reopened, err := OpenLedger(path, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record, ok := reopened.Record("fund1")
+		if !ok || record.FailedRuns != 2 || record.PermanentRuns != 0 || record.Attempts != 6 || record.Class != Transient {
+			t.Fatalf("Unexpected record for fund1 %+v", record)
+		}
+		if reopened.Broken("fund1") {
+			t.Error("Expected fund1 not to be broken after only timing out")
+		}
+		if !reopened.Broken("fund3") {
+			t.Error("Expected fund3 to be broken after failing permanently 2 runs")
+		}
+		if reopened.Broken("fund2") {
+			t.Error("Expected fund2 to be forgotten after it succeeded")
+		}
+	})
+
+	t.Run("Testing a transient failure starts the count again", func(t *testing.T) {
+		if err := ledger.Failed("fund3", 3, errors.New("navigation timed out")); err != nil {
+			t.Fatal(err)
+		}
+		if ledger.Broken("fund3") {
+			t.Error("Expected fund3 not to be broken after a transient failure")
+		}
+		if err := ledger.Failed("fund3", 1, renamedError{}); err != nil {
+			t.Fatal(err)
+		}
+		if ledger.Broken("fund3") {
+			t.Error("Expected fund3 not to be broken after 1 permanent failure in a row")
+		}
+	})
+
+	t.Run("Testing records under fund names are moved to their keys", func(t *testing.T) {
+		ledger.Migrate(map[string]string{"fund1": "ACM019", "fund3": "fund3"})
+		if _, ok := ledger.Record("fund1"); ok {
+			t.Error("Expected fund1 to be moved")
+		}
+		if record, ok := ledger.Record("ACM019"); !ok || record.FailedRuns != 2 {
+			t.Errorf("Expected the record of fund1 under ACM019, got %+v", record)
+		}
+		if _, ok := ledger.Record("fund3"); !ok {
+			t.Error("Expected fund3 to stay under its name")
+		}
+	})
+
+	t.Run("Testing 0 never skips", func(t *testing.T) {
+		ledger.SkipAfter = 0
+		if ledger.Broken("fund3") {
+			t.Error("Expected no fund to be broken when SkipAfter is 0")
+		}
+	})
+}
+
+func assertAttempts(t testing.TB, attempts int, err error, want int, wantErr bool) {
+	t.Helper()
+
+	if attempts != want {
+		t.Errorf("Expected %d attempts, got %d", want, attempts)
+	}
+	if (err != nil) != wantErr {
+		t.Errorf("Expected error %v, got %v", wantErr, err)
+	}
+}
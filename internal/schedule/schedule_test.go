@@ -0,0 +1,50 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	sgt, err := time.LoadLocation("Asia/Singapore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 8, 23, 19, 30, 15, 0, sgt) //a Friday
+
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 19 * * *", time.Date(2024, 8, 24, 19, 0, 0, 0, sgt)},
+		{"45 19 * * *", time.Date(2024, 8, 23, 19, 45, 0, 0, sgt)},
+		{"*/15 * * * *", time.Date(2024, 8, 23, 19, 45, 0, 0, sgt)},
+		{"0 2 * * 1-5", time.Date(2024, 8, 26, 2, 0, 0, 0, sgt)},
+		{"0 9 * * 7", time.Date(2024, 8, 25, 9, 0, 0, 0, sgt)},
+		{"0 0 1,15 * *", time.Date(2024, 9, 1, 0, 0, 0, 0, sgt)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, sgt)},
+		{"@daily", time.Date(2024, 8, 24, 0, 0, 0, 0, sgt)},
+		{"0 0 */1 * 1", time.Date(2024, 8, 26, 0, 0, 0, 0, sgt)},
+		{"0 0 1-31 * 1", time.Date(2024, 8, 26, 0, 0, 0, 0, sgt)},
+		{"0 0 1 * 1-7", time.Date(2024, 9, 1, 0, 0, 0, 0, sgt)},
+		{"0 0 1 * 5", time.Date(2024, 8, 30, 0, 0, 0, 0, sgt)},
+	} {
+		t.Run("Testing "+tc.spec, func(t *testing.T) {
+			s, err := Parse(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(now); !got.Equal(tc.want) {
+				t.Fatalf("Expected next run at %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("Testing invalid schedules", func(t *testing.T) {
+		for _, spec := range []string{"0 19 * *", "60 * * * *", "0 19 * * mon", "*/0 * * * *", "5-1 * * * *"} {
+			if _, err := Parse(spec); err == nil {
+				t.Errorf("Expected error for %q", spec)
+			}
+		}
+	})
+}
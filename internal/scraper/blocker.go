@@ -0,0 +1,238 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"scraper/internal/config"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+const (
+	measureTimeout     = 10 * time.Second
+	measureConcurrency = 4
+	// maxMeasuredURLs caps the urls whose size is kept, so a daemon running for weeks does not grow without limit
+	maxMeasuredURLs = 1000
+)
+
+// BlockStats counts the requests a Blocker failed. Bytes only covers the blocked urls whose size has been measured.
+type BlockStats struct {
+	Requests int            `json:"requests"`
+	Bytes    int64          `json:"bytes"`
+	ByType   map[string]int `json:"by_type,omitempty"`
+}
+
+// Sub returns the requests blocked since earlier was taken
+func (s BlockStats) Sub(earlier BlockStats) BlockStats {
+	diff := BlockStats{Requests: s.Requests - earlier.Requests, Bytes: s.Bytes - earlier.Bytes}
+	for typ, n := range s.ByType {
+		if n -= earlier.ByType[typ]; n != 0 {
+			if diff.ByType == nil {
+				diff.ByType = map[string]int{}
+			}
+			diff.ByType[typ] = n
+		}
+	}
+	return diff
+}
+
+func (s BlockStats) String() string {
+	types := make([]string, 0, len(s.ByType))
+	for typ := range s.ByType {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for i, typ := range types {
+		types[i] = fmt.Sprintf("%s %d", typ, s.ByType[typ])
+	}
+
+	out := fmt.Sprintf("%d requests, %.1f MB", s.Requests, float64(s.Bytes)/1e6)
+	if len(types) != 0 {
+		out += " (" + strings.Join(types, ", ") + ")"
+	}
+	return out
+}
+
+// Blocker fails the requests of worker pages that fund downloads do not need, such as images, fonts, analytics and chat
+// widgets, and counts what that saved
+type Blocker struct {
+	types    map[proto.NetworkResourceType]bool
+	patterns []*regexp.Regexp
+	client   *http.Client //measures blocked urls, nil unless cfg.MeasureBytes
+	measure  chan struct{}
+
+	mu       sync.Mutex
+	routers  map[proto.TargetTargetID]*rod.HijackRouter
+	requests int
+	byType   map[string]int
+	byURL    map[string]int   //blocked requests per measured url
+	sizes    map[string]int64 //size per measured url, -1 while unknown
+}
+
+// NewBlocker returns a blocker for the resource types and url patterns in cfg
+func NewBlocker(cfg config.Block) (*Blocker, error) {
+	b := &Blocker{
+		types:   map[proto.NetworkResourceType]bool{},
+		routers: map[proto.TargetTargetID]*rod.HijackRouter{},
+		byType:  map[string]int{},
+		byURL:   map[string]int{},
+		sizes:   map[string]int64{},
+	}
+	for _, typ := range cfg.ResourceTypes {
+		b.types[proto.NetworkResourceType(typ)] = true
+	}
+	for _, pattern := range cfg.URLPatterns {
+		reg, err := regexp.Compile(proto.PatternToReg(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid block pattern %s: %w", pattern, err)
+		}
+		b.patterns = append(b.patterns, reg)
+	}
+	if cfg.MeasureBytes {
+		b.client = &http.Client{Timeout: measureTimeout}
+		b.measure = make(chan struct{}, measureConcurrency)
+	}
+	return b, nil
+}
+
+// Blocks reports whether a request of resource type typ to url is blocked
+func (b *Blocker) Blocks(typ proto.NetworkResourceType, url string) bool {
+	blocked, _ := b.blockedBy(typ, url)
+	return blocked
+}
+
+// blockedBy reports whether a request is blocked and whether its url matched a pattern, as trackers do
+func (b *Blocker) blockedBy(typ proto.NetworkResourceType, url string) (blocked, tracker bool) {
+	for _, reg := range b.patterns {
+		if reg.MatchString(url) {
+			return true, true
+		}
+	}
+	return b.types[typ], false
+}
+
+// Attach starts blocking the requests of page until Detach. A nil Blocker blocks nothing.
+func (b *Blocker) Attach(page *rod.Page) error {
+	if b == nil {
+		return nil
+	}
+
+	router := page.HijackRequests()
+	if err := router.Add("*", "", b.handle); err != nil {
+		return err
+	}
+	go router.Run()
+
+	b.mu.Lock()
+	b.routers[page.TargetID] = router
+	b.mu.Unlock()
+	return nil
+}
+
+// Detach stops blocking the requests of page
+func (b *Blocker) Detach(page *rod.Page) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	router, ok := b.routers[page.TargetID]
+	delete(b.routers, page.TargetID)
+	b.mu.Unlock()
+
+	if ok {
+		if err := router.Stop(); err != nil {
+			log.Printf("Could not stop blocking requests: %v", err)
+		}
+	}
+}
+
+// Stats returns the requests blocked so far
+func (b *Blocker) Stats() BlockStats {
+	if b == nil {
+		return BlockStats{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := BlockStats{Requests: b.requests, ByType: make(map[string]int, len(b.byType))}
+	for typ, n := range b.byType {
+		stats.ByType[typ] = n
+	}
+	for url, n := range b.byURL {
+		if size := b.sizes[url]; size > 0 {
+			stats.Bytes += int64(n) * size
+		}
+	}
+	return stats
+}
+
+func (b *Blocker) handle(h *rod.Hijack) {
+	typ, url := h.Request.Type(), h.Request.URL().String()
+	blocked, tracker := b.blockedBy(typ, url)
+	if !blocked {
+		h.ContinueRequest(&proto.FetchContinueRequest{})
+		return
+	}
+
+	h.Response.Fail(proto.NetworkErrorReasonBlockedByClient)
+	b.count(typ, url, tracker)
+}
+
+// count records a blocked request and measures its url the first time it is blocked. Trackers are never measured, as
+// asking their servers anything sends the hit the blocker is there to stop. Urls blocked while every measuring slot is
+// busy, or once maxMeasuredURLs are kept, are counted without their size.
+func (b *Blocker) count(typ proto.NetworkResourceType, url string, tracker bool) {
+	b.mu.Lock()
+	b.requests++
+	b.byType[string(typ)]++
+	measure := false
+	if _, seen := b.sizes[url]; seen {
+		b.byURL[url]++
+	} else if b.client != nil && !tracker && strings.HasPrefix(url, "http") && len(b.sizes) < maxMeasuredURLs {
+		select {
+		case b.measure <- struct{}{}:
+			b.sizes[url] = -1
+			b.byURL[url]++
+			measure = true
+		default:
+		}
+	}
+	b.mu.Unlock()
+
+	if measure {
+		go b.measureURL(url)
+	}
+}
+
+// measureURL asks the server how big url is without downloading it, then frees the slot count took for it
+func (b *Blocker) measureURL(url string) {
+	defer func() { <-b.measure }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), measureTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusOK && res.ContentLength > 0 {
+		b.mu.Lock()
+		b.sizes[url] = res.ContentLength
+		b.mu.Unlock()
+	}
+}
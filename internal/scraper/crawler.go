@@ -0,0 +1,170 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"scraper/internal/config"
+	"scraper/internal/selectors"
+	"strings"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// FSMsite is prepended to the links on FSM pages, which are relative
+const FSMsite = "https://secure.fundsupermart.com"
+
+// pagePoll is how often a listing page is checked for the next page's funds after clicking Next
+const pagePoll = 250 * time.Millisecond
+
+// ListedFund is a fund as the fund selector lists it
+type ListedFund struct {
+	Name string
+	Code string
+	Link string
+}
+
+// NewListedFund reads a fund from its name and factsheet href in the listing. Links that are not to a factsheet are
+// not funds.
+func NewListedFund(name, href string) (ListedFund, bool) {
+	link := strings.TrimSpace(href)
+	if strings.HasPrefix(link, "/") {
+		link = FSMsite + link
+	}
+	fund := ListedFund{Name: strings.Join(strings.Fields(name), " "), Code: FundCode(link), Link: link}
+	return fund, fund.Name != "" && fund.Code != ""
+}
+
+// Crawler walks the fund selector listing page by page, once for every filter in cfg
+type Crawler struct {
+	cfg config.Crawl
+}
+
+func NewCrawler(cfg config.Crawl) *Crawler {
+	return &Crawler{cfg: cfg}
+}
+
+// Crawl opens the fund selector in page and returns every fund it lists, each once however many filters list it.
+// Cancelling ctx stops the crawl and returns the context error.
+func (c *Crawler) Crawl(ctx context.Context, page *rod.Page) ([]ListedFund, error) {
+	page = page.Context(ctx)
+	if err := page.Navigate(FSMfundSelectorSite); err != nil {
+		return nil, step("", "open fund selector", err)
+	}
+	//The popup does not always show, so only wait for it briefly
+	_ = click(page.Timeout(popupTimeout), "popup_close")
+
+	filters := c.cfg.Filters
+	if len(filters) == 0 {
+		filters = []string{""}
+	}
+
+	var funds []ListedFund
+	seen := map[string]bool{}
+	for _, filter := range filters {
+		if filter != "" {
+			log.Printf("Crawling the fund selector filtered by %s", filter)
+			if err := click(page.Timeout(c.cfg.PageTimeout), "listing_filter", filter); err != nil {
+				return nil, step("", "filter by "+filter, err)
+			}
+		}
+
+		listed, err := c.crawlPages(page)
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, fund := range listed {
+			if !seen[fund.Code] {
+				seen[fund.Code] = true
+				funds = append(funds, fund)
+				added++
+			}
+		}
+		log.Printf("%d funds listed, %d not seen before", len(listed), added)
+
+		//Filters toggle, so click it again to clear it for the next one
+		if filter != "" {
+			if err := click(page.Timeout(c.cfg.PageTimeout), "listing_filter", filter); err != nil {
+				return nil, step("", "clear filter "+filter, err)
+			}
+		}
+	}
+	return funds, nil
+}
+
+// crawlPages reads the funds on the listing page open in page and every page after it, up to MaxPages
+func (c *Crawler) crawlPages(page *rod.Page) ([]ListedFund, error) {
+	var funds []ListedFund
+	for n := 1; c.cfg.MaxPages == 0 || n <= c.cfg.MaxPages; n++ {
+		listed, err := c.listed(page)
+		if err != nil {
+			return nil, step("", fmt.Sprintf("read listing page %d", n), err)
+		}
+		funds = append(funds, listed...)
+		log.Printf("Listing page %d: %d funds", n, len(listed))
+
+		candidates, err := Selectors.Candidates("listing_next")
+		if err != nil {
+			return nil, err
+		}
+		next, _ := selectors.First(page, candidates)
+		if next == nil {
+			return funds, nil
+		}
+		if err := next.Click(proto.InputMouseButtonLeft, 1); err != nil {
+			return nil, step("", fmt.Sprintf("click Next on page %d", n), err)
+		}
+		if err := c.waitForPage(page, listed[0].Link); err != nil {
+			return nil, step("", fmt.Sprintf("open listing page %d", n+1), err)
+		}
+	}
+	log.Printf("Stopped after %d listing pages", c.cfg.MaxPages)
+	return funds, nil
+}
+
+// listed reads the funds on the listing page open in page
+func (c *Crawler) listed(page *rod.Page) ([]ListedFund, error) {
+	links, err := Selectors.Elements(page.Timeout(c.cfg.PageTimeout), "listing_fund_link")
+	if err != nil {
+		return nil, err
+	}
+
+	var funds []ListedFund
+	for _, link := range links {
+		href, err := link.Attribute("href")
+		if err != nil || href == nil {
+			continue
+		}
+		name, err := link.Text()
+		if err != nil {
+			continue
+		}
+		if fund, ok := NewListedFund(name, *href); ok {
+			funds = append(funds, fund)
+		}
+	}
+	if len(funds) == 0 {
+		return nil, ErrLinkNotFound
+	}
+	return funds, nil
+}
+
+// waitForPage waits until the first fund listed in page is no longer firstLink, meaning the next page has loaded
+func (c *Crawler) waitForPage(page *rod.Page, firstLink string) error {
+	ctx, cancel := context.WithTimeout(page.GetContext(), c.cfg.PageTimeout)
+	defer cancel()
+
+	for {
+		if listed, err := c.listed(page.Context(ctx)); err == nil && listed[0].Link != firstLink {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pagePoll):
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+var ErrDownloadCanceled = errors.New("download canceled by the browser")
+
+// Downloads ties each browser download to the page that started it, so several pages can export at once. Chrome saves
+// every download into dir named by its GUID and reports which frame started it.
+type Downloads struct {
+	dir    string
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	byFrame map[proto.PageFrameID]*pendingDownload
+	byGUID  map[string]*pendingDownload
+}
+
+type pendingDownload struct {
+	guid string
+	done chan error
+}
+
+// WatchDownloads makes browser save downloads into a new temporary directory and starts following their progress
+// until Close is called
+func WatchDownloads(browser *rod.Browser) (*Downloads, error) {
+	dir, err := os.MkdirTemp("", "fsm-downloads-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create download directory: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Downloads{
+		dir:     dir,
+		cancel:  cancel,
+		byFrame: make(map[proto.PageFrameID]*pendingDownload),
+		byGUID:  make(map[string]*pendingDownload),
+	}
+
+	if err := d.Allow(browser); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	wait := browser.Context(ctx).EachEvent(d.began, d.progressed)
+	go wait()
+
+	return d, nil
+}
+
+// Allow sets the download behaviour of browser, which may be an incognito context of the watched browser, so its
+// downloads are followed too
+func (d *Downloads) Allow(browser *rod.Browser) error {
+	err := proto.BrowserSetDownloadBehavior{
+		Behavior:         proto.BrowserSetDownloadBehaviorBehaviorAllowAndName,
+		BrowserContextID: browser.BrowserContextID,
+		DownloadPath:     d.dir,
+		EventsEnabled:    true,
+	}.Call(browser)
+	if err != nil {
+		return fmt.Errorf("could not set download behaviour: %w", err)
+	}
+	return nil
+}
+
+// Expect registers that page is about to start a download and returns a function that waits for it to finish and
+// returns its contents. Call it before triggering the download.
+func (d *Downloads) Expect(page *rod.Page) func(ctx context.Context) ([]byte, error) {
+	p := &pendingDownload{done: make(chan error, 1)}
+
+	d.mu.Lock()
+	d.byFrame[page.FrameID] = p
+	d.mu.Unlock()
+
+	return func(ctx context.Context) ([]byte, error) {
+		select {
+		case err := <-p.done:
+			if err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			d.forget(page.FrameID, p)
+			return nil, ctx.Err()
+		}
+
+		path := filepath.Join(d.dir, p.guid)
+		defer os.Remove(path)
+		return os.ReadFile(path)
+	}
+}
+
+// Close stops following downloads and removes any left in the download directory
+func (d *Downloads) Close() {
+	d.cancel()
+	os.RemoveAll(d.dir)
+}
+
+func (d *Downloads) began(e *proto.BrowserDownloadWillBegin) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.byFrame[e.FrameID]
+	if !ok {
+		return false //not started by a page that expects it
+	}
+	delete(d.byFrame, e.FrameID)
+	p.guid = e.GUID
+	d.byGUID[e.GUID] = p
+	return false
+}
+
+func (d *Downloads) progressed(e *proto.BrowserDownloadProgress) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.byGUID[e.GUID]
+	if !ok {
+		return false
+	}
+	switch e.State {
+	case proto.BrowserDownloadProgressStateCompleted:
+		p.done <- nil
+	case proto.BrowserDownloadProgressStateCanceled:
+		p.done <- ErrDownloadCanceled
+	default:
+		return false
+	}
+	delete(d.byGUID, e.GUID)
+	return false
+}
+
+// forget drops a download that is no longer waited for
+func (d *Downloads) forget(frame proto.PageFrameID, p *pendingDownload) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.byFrame[frame] == p {
+		delete(d.byFrame, frame)
+	}
+	if p.guid != "" {
+		delete(d.byGUID, p.guid)
+		os.Remove(filepath.Join(d.dir, p.guid))
+	}
+}
@@ -0,0 +1,54 @@
+package scraper
+
+import (
+	"errors"
+	"fmt"
+	"scraper/internal/retry"
+)
+
+var (
+	// ErrLinkNotFound is returned when the fund selector search has no result for a fund
+	ErrLinkNotFound = retry.MarkPermanent(errors.New("fund link not found"))
+)
+
+// StepError is returned when a step on an FSM page fails, e.g. navigating to the fund page or clicking Export
+type StepError struct {
+	Fundname string
+	Step     string
+	Err      error
+}
+
+func (e *StepError) Error() string {
+	if e.Fundname == "" {
+		return fmt.Sprintf("%s: %v", e.Step, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Fundname, e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// NameMismatchError is returned when the fund page shows a different name to the one we have, usually because FSM
+// renamed the fund
+type NameMismatchError struct {
+	Fundname     string
+	PageFundname string
+}
+
+func (e *NameMismatchError) Error() string {
+	return fmt.Sprintf("fund name has been updated from %s to %s", e.Fundname, e.PageFundname)
+}
+
+// Permanent tells the retry policy that opening the page again will show the same name
+func (e *NameMismatchError) Permanent() bool {
+	return true
+}
+
+// step wraps err as a StepError, returning nil if err is nil
+func step(fundName, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StepError{Fundname: fundName, Step: name, Err: err}
+}
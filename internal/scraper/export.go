@@ -0,0 +1,415 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"scraper/internal/config"
+	"scraper/internal/database"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+	"github.com/go-rod/rod/lib/utils"
+)
+
+var ErrNoEndpoint = errors.New("export endpoint not learned yet")
+
+// unixMillis is the DateLayout of dates sent as milliseconds since the epoch
+const unixMillis = "unixms"
+
+// dateFormats are the date layouts looked for in a captured export request
+var dateFormats = []struct {
+	pattern *regexp.Regexp
+	layout  string
+}{
+	{regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`), "2006-01-02"},
+	{regexp.MustCompile(`\b\d{2}/\d{2}/\d{4}\b`), "02/01/2006"},
+	{regexp.MustCompile(`\b\d{8}\b`), "20060102"},
+	{regexp.MustCompile(`\b1\d{12}\b`), unixMillis},
+}
+
+// CapturedRequest is a request the browser sent while exporting a fund's prices
+type CapturedRequest struct {
+	Method  string
+	URL     string
+	Body    string
+	Headers map[string]string
+}
+
+// ExportEndpoint is the backend request behind the Export button, with the fund code and date range replaced by
+// {code}, {from} and {to} so it can be sent for any fund over plain HTTP
+type ExportEndpoint struct {
+	Method     string            `json:"method"`
+	URL        string            `json:"url"`
+	Body       string            `json:"body,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	DateLayout string            `json:"date_layout,omitempty"` //Go layout of {from} and {to}, or unixms
+	Learned    time.Time         `json:"learned"`
+}
+
+// FundCode returns the FSM fund code at the end of a factsheet link, or "" if link is not a factsheet link
+func FundCode(link string) string {
+	return database.CodeFromLink(link)
+}
+
+// LearnEndpoint turns the request that exported the fund with code into an endpoint template. The request must
+// contain the code, any dates in it are taken to be the range, the earliest being {from} and the latest {to}.
+func LearnEndpoint(req CapturedRequest, code string) (*ExportEndpoint, error) {
+	if !strings.Contains(req.URL, code) && !strings.Contains(req.Body, code) {
+		return nil, fmt.Errorf("fund code %s not found in export request %s", code, req.URL)
+	}
+
+	var dates []string
+	var layout string
+	scan := func(s string) string {
+		for _, f := range dateFormats {
+			if layout != "" && f.layout != layout {
+				continue //dates in one request share a layout
+			}
+			found := false
+			for _, match := range f.pattern.FindAllString(s, -1) {
+				if _, err := parseDate(match, f.layout); err == nil {
+					dates = append(dates, match)
+					layout, found = f.layout, true
+				}
+			}
+			if found {
+				break
+			}
+		}
+		return s
+	}
+	eachValue(req.URL, scan)
+	if len(dates) == 0 {
+		scan(req.Body)
+	}
+
+	vars := map[string]string{code: "{code}"}
+	if len(dates) != 0 {
+		sort.Slice(dates, func(i, j int) bool {
+			a, _ := parseDate(dates[i], layout)
+			b, _ := parseDate(dates[j], layout)
+			return a.Before(b)
+		})
+		vars[dates[0]] = "{from}"
+		if len(dates) > 1 {
+			vars[dates[len(dates)-1]] = "{to}"
+		}
+	}
+	replace := func(s string) string {
+		for value, placeholder := range vars {
+			s = strings.ReplaceAll(s, value, placeholder)
+		}
+		return s
+	}
+
+	headers := map[string]string{}
+	for name, value := range req.Headers {
+		switch strings.ToLower(name) {
+		case "cookie", "content-length", "host":
+		default:
+			headers[name] = value
+		}
+	}
+
+	return &ExportEndpoint{
+		Method:     req.Method,
+		URL:        eachValue(req.URL, replace),
+		Body:       replace(req.Body),
+		Headers:    headers,
+		DateLayout: layout,
+		Learned:    time.Now(),
+	}, nil
+}
+
+// Request builds the export request for the fund with code over from to to
+func (e *ExportEndpoint) Request(ctx context.Context, code string, from, to time.Time) (*http.Request, error) {
+	vars := map[string]string{"{code}": code, "{from}": formatDate(from, e.DateLayout), "{to}": formatDate(to, e.DateLayout)}
+	fill := func(s string) string {
+		for placeholder, value := range vars {
+			s = strings.ReplaceAll(s, placeholder, value)
+		}
+		return s
+	}
+
+	var body io.Reader
+	if e.Body != "" {
+		body = strings.NewReader(fill(e.Body))
+	}
+	req, err := http.NewRequestWithContext(ctx, e.Method, eachValue(e.URL, fill), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// FetchExport sends the export request for the fund with code with the logged in cookies and returns the prices
+func FetchExport(ctx context.Context, client *http.Client, e *ExportEndpoint, cookies []*proto.NetworkCookie, code string, from, to time.Time) ([]byte, error) {
+	req, err := e.Request(ctx, code, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, cookie := range cookies {
+		if cookieMatches(cookie, req.URL.Hostname()) {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("export endpoint returned %s", res.Status)
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		return nil, errors.New("export endpoint returned a web page instead of prices, the session may have expired")
+	}
+	return io.ReadAll(res.Body)
+}
+
+// SaveEndpoint writes e to path as JSON so later runs do not need to learn it again
+func SaveEndpoint(path string, e *ExportEndpoint) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("could not save export endpoint: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("could not save export endpoint: %w", err)
+	}
+	return nil
+}
+
+// LoadEndpoint reads the endpoint saved at path, returning ErrNoEndpoint if there is none
+func LoadEndpoint(path string) (*ExportEndpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoEndpoint
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read export endpoint: %w", err)
+	}
+
+	var e ExportEndpoint
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("could not read export endpoint %s: %w", path, err)
+	}
+	return &e, nil
+}
+
+// captureRequests records every document, XHR and fetch request page sends until the returned stop is called
+func captureRequests(page *rod.Page) (stop func() []CapturedRequest, err error) {
+	var mu sync.Mutex
+	var captured []CapturedRequest
+
+	router := page.HijackRequests()
+	err = router.Add("*", "", func(h *rod.Hijack) {
+		switch h.Request.Type() {
+		case proto.NetworkResourceTypeDocument, proto.NetworkResourceTypeXHR, proto.NetworkResourceTypeFetch:
+			headers := map[string]string{}
+			for name, value := range h.Request.Headers() {
+				headers[name] = value.String()
+			}
+			mu.Lock()
+			captured = append(captured, CapturedRequest{Method: h.Request.Method(), URL: h.Request.URL().String(), Body: h.Request.Body(), Headers: headers})
+			mu.Unlock()
+		}
+		h.ContinueRequest(&proto.FetchContinueRequest{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	go router.Run()
+
+	return func() []CapturedRequest {
+		if err := router.Stop(); err != nil {
+			log.Printf("Could not stop request capture: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return captured
+	}, nil
+}
+
+// exportRequest picks the request that exported the fund with code, the last one that mentions the code
+func exportRequest(captured []CapturedRequest, code string) (CapturedRequest, bool) {
+	for i := len(captured) - 1; i >= 0; i-- {
+		if strings.Contains(captured[i].URL, code) || strings.Contains(captured[i].Body, code) {
+			return captured[i], true
+		}
+	}
+	return CapturedRequest{}, false
+}
+
+// eachValue applies f to every query value of rawURL, so values are matched unescaped
+func eachValue(rawURL string, f func(string) string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return f(rawURL)
+	}
+	u.Path = f(u.Path)
+	u.RawPath = ""
+	query := u.Query()
+	for key, values := range query {
+		for i := range values {
+			values[i] = f(values[i])
+		}
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return strings.NewReplacer("%7B", "{", "%7D", "}").Replace(u.String())
+}
+
+func parseDate(value, layout string) (time.Time, error) {
+	if layout == unixMillis {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(layout, value)
+}
+
+func formatDate(t time.Time, layout string) string {
+	switch layout {
+	case "":
+		return ""
+	case unixMillis:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		return t.Format(layout)
+	}
+}
+
+// cookieMatches reports whether cookie is sent to host
+func cookieMatches(cookie *proto.NetworkCookie, host string) bool {
+	domain := strings.TrimPrefix(cookie.Domain, ".")
+	return domain == "" || host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// UseFactsheet sets what the session reads from fund pages besides their prices
+func (s *Session) UseFactsheet(cfg config.Factsheet) {
+	s.Conc.Factsheet = cfg
+}
+
+// UseMatch sets how close a new name on a fund page must be to the fund's to be taken as a rename
+func (s *Session) UseMatch(cfg config.Links) {
+	s.Conc.Match = cfg
+}
+
+// UseExport sets how the session downloads prices. In direct mode a saved endpoint is loaded, otherwise it is learned
+// from the first fund scraped.
+func (s *Session) UseExport(cfg config.Export) error {
+	s.exportMu.Lock()
+	defer s.exportMu.Unlock()
+
+	s.export, s.endpoint = cfg, nil
+	if cfg.Mode != "direct" {
+		return nil
+	}
+	s.client = &http.Client{Timeout: cfg.Timeout}
+
+	endpoint, err := LoadEndpoint(cfg.Endpoint)
+	if errors.Is(err, ErrNoEndpoint) {
+		log.Print("Export endpoint not learned yet, it will be captured from the first fund")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.endpoint = endpoint
+	return nil
+}
+
+// directExport fetches the prices in rng of fund with code from the export endpoint, learning it from this fund first
+// if there is none yet
+func (s *Session) directExport(ctx context.Context, fund database.Fund, code string, rng Range, downloadFolderPath string) (*Factsheet, error) {
+	s.exportMu.Lock()
+	endpoint := s.endpoint
+	if endpoint == nil {
+		defer s.exportMu.Unlock() //other funds wait for the endpoint to be learned
+		return s.learnExport(ctx, fund, code, rng, downloadFolderPath)
+	}
+	s.exportMu.Unlock()
+
+	from, to := rng.Dates(time.Now())
+	data, err := FetchExport(ctx, s.client, endpoint, s.BrowserCookies, code, from, to)
+	if err != nil {
+		return nil, step(fund.Fundname, "fetch export", err)
+	}
+	if err := utils.OutputFile(DownloadPath(downloadFolderPath, fund), data); err != nil {
+		return nil, step(fund.Fundname, "save download", err)
+	}
+
+	log.Println(fund.Fundname, "successfully downloaded from the export endpoint")
+	return nil, nil
+}
+
+// learnExport downloads fund by clicking Export while capturing the requests the page sends, and keeps the one that
+// exported it as the endpoint for later funds
+func (s *Session) learnExport(ctx context.Context, fund database.Fund, code string, rng Range, downloadFolderPath string) (*Factsheet, error) {
+	//Capturing needs the only request router on the page, so learn with a worker that blocks nothing
+	learner := &ConcBrowser{Browser: s.Browser, Downloads: s.Conc.Downloads, Factsheet: s.Conc.Factsheet, Match: s.Conc.Match}
+	worker, err := learner.newWorker(s.PageCookies, s.BrowserCookies, s.SessionStorage, s.LocalStorage)
+	if err != nil {
+		return nil, step(fund.Fundname, "create page", err)
+	}
+	defer learner.closeWorker(worker)
+	page := worker.Context(ctx)
+
+	stop, err := captureRequests(page)
+	if err != nil {
+		return nil, step(fund.Fundname, "capture export", err)
+	}
+	var sheet *Factsheet
+	if err = page.Navigate(fund.Link); err != nil {
+		err = step(fund.Fundname, "open fund page", err)
+	} else {
+		sheet, err = downloadFromFundPage(ctx, fund, page, learner, rng, downloadFolderPath)
+	}
+	captured := stop()
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := exportRequest(captured, code)
+	if !ok {
+		log.Printf("No request exporting %s was captured, carrying on with the browser", code)
+		s.export.Mode = "browser"
+		return sheet, nil
+	}
+	endpoint, err := LearnEndpoint(req, code)
+	if err != nil {
+		log.Printf("Could not learn the export endpoint, carrying on with the browser: %v", err)
+		s.export.Mode = "browser"
+		return sheet, nil
+	}
+	if err := SaveEndpoint(s.export.Endpoint, endpoint); err != nil {
+		log.Print(err)
+	}
+	s.endpoint = endpoint
+	log.Printf("Learned export endpoint %s %s", endpoint.Method, endpoint.URL)
+	return sheet, nil
+}
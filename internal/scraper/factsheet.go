@@ -0,0 +1,317 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"scraper/internal/config"
+	"scraper/internal/database"
+	"scraper/internal/report"
+	"scraper/internal/selectors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/utils"
+)
+
+// factsheetTimeout is how long the key facts get to show once the fund page has loaded
+const factsheetTimeout = 5 * time.Second
+
+// Factsheet is what was read from a fund page besides its prices
+type Factsheet struct {
+	Renamed       string                  //the name the page shows if FSM has renamed the fund, otherwise empty
+	Info          *database.FundInfo      //nil if none of the key facts were found
+	Distributions []database.Distribution //nil if not read or the page has no distribution section
+	Allocations   []database.Allocation   //top holdings and sector, region and asset class weights, nil if not read
+}
+
+// infoSelectors names the selector of each key fact
+var infoSelectors = []struct {
+	name  string
+	field func(*database.FundInfo) *string
+}{
+	{"info_fund_house", func(i *database.FundInfo) *string { return &i.FundHouse }},
+	{"info_base_currency", func(i *database.FundInfo) *string { return &i.BaseCurrency }},
+	{"info_share_class", func(i *database.FundInfo) *string { return &i.ShareClass }},
+	{"info_risk_rating", func(i *database.FundInfo) *string { return &i.RiskRating }},
+	{"info_inception_date", func(i *database.FundInfo) *string { return &i.InceptionDate }},
+	{"info_fund_size", func(i *database.FundInfo) *string { return &i.FundSize }},
+	{"info_expense_ratio", func(i *database.FundInfo) *string { return &i.ExpenseRatio }},
+	{"info_dealing_frequency", func(i *database.FundInfo) *string { return &i.DealingFrequency }},
+	{"info_min_investment", func(i *database.FundInfo) *string { return &i.MinInvestment }},
+}
+
+// ReadFundInfo reads the key facts from the overview of a fund page. Facts missing from the page are left empty, and
+// found is how many were read.
+func ReadFundInfo(page *rod.Page) (info database.FundInfo, found int) {
+	//The facts load after the title, wait for the first one briefly
+	_, _ = Selectors.Element(page.Timeout(factsheetTimeout), infoSelectors[0].name)
+
+	for _, sel := range infoSelectors {
+		candidates, err := Selectors.Candidates(sel.name)
+		if err != nil {
+			continue
+		}
+		el, _ := selectors.First(page, candidates)
+		if el == nil {
+			continue
+		}
+		text, err := el.Text()
+		if err != nil {
+			continue
+		}
+		if text = strings.Join(strings.Fields(text), " "); text != "" {
+			*sel.field(&info) = text
+			found++
+		}
+	}
+	return info, found
+}
+
+// readFactsheet reads the parts of the fund page set in cfg
+func readFactsheet(fundName string, page *rod.Page, cfg config.Factsheet) *Factsheet {
+	sheet := &Factsheet{}
+	if cfg.Info {
+		info, found := ReadFundInfo(page)
+		if found == 0 {
+			log.Printf("No key facts found on the page of %s", fundName)
+		} else {
+			sheet.Info = &info
+		}
+	}
+	if cfg.Distributions {
+		distributions, err := ReadDistributions(page)
+		if err != nil {
+			log.Printf("Could not read the distributions of %s: %v", fundName, err)
+		}
+		sheet.Distributions = distributions
+	}
+	if cfg.Allocations {
+		allocations, err := ReadAllocations(page, time.Now())
+		if err != nil {
+			log.Printf("Could not read the allocations of %s: %v", fundName, err)
+		} else if len(allocations) == 0 {
+			log.Printf("No holdings or allocations found on the page of %s", fundName)
+		}
+		sheet.Allocations = allocations
+	}
+	return sheet
+}
+
+// ReadDistributions opens the distribution section of a fund page and reads its table. Funds that do not distribute
+// have no such section, for them it returns nil.
+func ReadDistributions(page *rod.Page) ([]database.Distribution, error) {
+	if err := click(page.Timeout(factsheetTimeout), "distribution_tab"); err != nil {
+		return nil, nil
+	}
+
+	table, err := Selectors.Element(page.Timeout(factsheetTimeout), "distribution_table")
+	if err != nil {
+		//The section is there but nothing has been paid yet
+		return []database.Distribution{}, nil
+	}
+	rows, err := readTable(table)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDistributions(rows)
+}
+
+// ParseDistributions reads the rows of a distribution table, the first being its header. Columns are found by their
+// header, so their order does not matter. Rows without an ex-date are skipped.
+func ParseDistributions(rows [][]string) ([]database.Distribution, error) {
+	distributions := []database.Distribution{}
+	if len(rows) == 0 {
+		return distributions, nil
+	}
+
+	cols := map[string]int{"ex": -1, "pay": -1, "amount": -1, "currency": -1, "type": -1}
+	for i, cell := range rows[0] {
+		header := strings.ToLower(cell)
+		switch {
+		case strings.Contains(header, "ex"):
+			cols["ex"] = i
+		case strings.Contains(header, "pay"):
+			cols["pay"] = i
+		case strings.Contains(header, "currency"):
+			cols["currency"] = i
+		case strings.Contains(header, "type"):
+			cols["type"] = i
+		case strings.Contains(header, "amount"), strings.Contains(header, "dividend"), strings.Contains(header, "distribution"):
+			cols["amount"] = i
+		}
+	}
+	if cols["ex"] < 0 || cols["amount"] < 0 {
+		return nil, fmt.Errorf("distribution table has no ex-date or amount column: %v", rows[0])
+	}
+
+	cell := func(row []string, col string) string {
+		if i := cols[col]; i >= 0 && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	for _, row := range rows[1:] {
+		exDate, ok := report.ParseDate(cell(row, "ex"))
+		if !ok {
+			continue
+		}
+		currency, amount, err := parseAmount(cell(row, "amount"))
+		if err != nil {
+			return nil, fmt.Errorf("distribution on %s: %w", exDate.Format(time.DateOnly), err)
+		}
+		if c := cell(row, "currency"); c != "" {
+			currency = c
+		}
+
+		d := database.Distribution{ExDate: exDate, Amount: amount, Currency: currency, Type: cell(row, "type")}
+		d.PayDate, _ = report.ParseDate(cell(row, "pay"))
+		distributions = append(distributions, d)
+	}
+	return distributions, nil
+}
+
+// parseAmount reads amounts such as 0.0512, USD 0.0512 or $1,000.50
+func parseAmount(s string) (currency string, amount float64, err error) {
+	var number strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsDigit(r), r == '.', r == '-':
+			number.WriteRune(r)
+		case unicode.IsLetter(r) && number.Len() == 0:
+			currency += string(r)
+		}
+	}
+	amount, err = strconv.ParseFloat(number.String(), 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return currency, amount, nil
+}
+
+// DistributionsPath is where the distributions of fund are saved, next to its prices
+func DistributionsPath(downloadFolderPath string, fund database.Fund) string {
+	return strings.TrimSuffix(DownloadPath(downloadFolderPath, fund), ".csv") + "_distributions.csv"
+}
+
+// WriteDistributions saves distributions as a CSV at path
+func WriteDistributions(path string, distributions []database.Distribution) error {
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	w.Write([]string{"Ex Date", "Pay Date", "Amount", "Currency", "Type"})
+	for _, d := range distributions {
+		payDate := ""
+		if !d.PayDate.IsZero() {
+			payDate = d.PayDate.Format(time.DateOnly)
+		}
+		w.Write([]string{d.ExDate.Format(time.DateOnly), payDate, strconv.FormatFloat(d.Amount, 'f', -1, 64), d.Currency, d.Type})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return utils.OutputFile(path, out.Bytes())
+}
+
+// allocationSelectors names the table selector of each kind of allocation
+var allocationSelectors = []struct {
+	name string
+	kind string
+}{
+	{"holdings_table", database.AllocationHolding},
+	{"sector_table", database.AllocationSector},
+	{"region_table", database.AllocationRegion},
+	{"asset_class_table", database.AllocationAssetClass},
+}
+
+// ReadAllocations opens the holdings section of a fund page and reads its top holdings and allocation tables. They are
+// dated by the as-of date the page shows, or today's date if it shows none.
+func ReadAllocations(page *rod.Page, now time.Time) ([]database.Allocation, error) {
+	if err := click(page.Timeout(factsheetTimeout), "holdings_tab"); err != nil {
+		return nil, err
+	}
+	//The tables load after the tab, wait for the first one briefly
+	_, _ = Selectors.Element(page.Timeout(factsheetTimeout), allocationSelectors[0].name)
+
+	asOf := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if el, err := Selectors.Element(page.Timeout(factsheetTimeout), "allocation_as_of"); err == nil {
+		if text, err := el.Text(); err == nil {
+			if date, ok := ParseAsOf(text); ok {
+				asOf = date
+			}
+		}
+	}
+
+	var allocations []database.Allocation
+	for _, sel := range allocationSelectors {
+		candidates, err := Selectors.Candidates(sel.name)
+		if err != nil {
+			continue
+		}
+		table, _ := selectors.First(page, candidates)
+		if table == nil {
+			continue
+		}
+		rows, err := readTable(table)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sel.name, err)
+		}
+		allocations = append(allocations, ParseAllocations(sel.kind, asOf, rows)...)
+	}
+	return allocations, nil
+}
+
+// ParseAllocations reads the rows of a holdings or allocation table, each a name followed by a weight in its last
+// cell. Rows without a weight, such as the header, are skipped.
+func ParseAllocations(kind string, asOf time.Time, rows [][]string) []database.Allocation {
+	var allocations []database.Allocation
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		name := strings.Join(strings.Fields(row[0]), " ")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(row[len(row)-1]), "%")), 64)
+		if name == "" || err != nil {
+			continue
+		}
+		allocations = append(allocations, database.Allocation{AsOf: asOf, Kind: kind, Name: name, Weight: weight})
+	}
+	return allocations
+}
+
+// ParseAsOf finds the date in a label such as "As of 31 May 2024"
+func ParseAsOf(text string) (time.Time, bool) {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == '(' || r == ')'
+	})
+	//Longest first, so the day of "31 May 2024" is not read on its own
+	for n := 3; n > 0; n-- {
+		for i := 0; i+n <= len(fields); i++ {
+			words := strings.Join(fields[i:i+n], " ")
+			if _, err := strconv.ParseFloat(words, 64); err == nil {
+				continue
+			}
+			if date, ok := report.ParseDate(words); ok {
+				return date, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// readTable returns the text of every cell of a table element, row by row
+func readTable(table *rod.Element) ([][]string, error) {
+	res, err := table.Eval(`() => Array.from(this.rows, r => Array.from(r.cells, c => c.innerText.trim()))`)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	if err := res.Value.Unmarshal(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
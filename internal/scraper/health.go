@@ -0,0 +1,118 @@
+package scraper
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"scraper/internal/config"
+	"strings"
+
+	"github.com/go-rod/rod"
+)
+
+// LoggedIn opens login.CheckURL in page and reports whether it is still logged in. A redirect to the login page means
+// the session has lapsed. With an account selector the page must also show that element.
+func LoggedIn(ctx context.Context, page *rod.Page, login config.Login) (bool, error) {
+	loginURL, err := url.Parse(login.URL)
+	if err != nil {
+		return false, step("", "parse login url", err)
+	}
+
+	page = page.Context(ctx)
+	if login.Timeout > 0 {
+		page = page.Timeout(login.Timeout)
+		defer page.CancelTimeout()
+	}
+
+	if err := page.Navigate(login.CheckURL); err != nil {
+		return false, step("", "open session check page", err)
+	}
+	if err := page.WaitLoad(); err != nil {
+		return false, step("", "open session check page", err)
+	}
+
+	onLoginPage := func(p *rod.Page) bool {
+		info, err := p.Info()
+		return err == nil && strings.Contains(info.URL, loginURL.Path)
+	}
+
+	if login.Selectors.Account == "" {
+		return !onLoginPage(page), nil
+	}
+
+	loggedIn := false
+	_, err = page.Race().
+		ElementFunc(func(p *rod.Page) (*rod.Element, error) {
+			if !onLoginPage(p) {
+				return nil, &rod.ElementNotFoundError{}
+			}
+			return p.Element("body")
+		}).
+		Element(login.Selectors.Account).
+		Handle(func(*rod.Element) error {
+			loggedIn = true
+			return nil
+		}).
+		Do()
+	if err != nil {
+		return false, step("", "check session", err)
+	}
+	return loggedIn, nil
+}
+
+// Check reports whether the session is still logged in to FSM
+func (s *Session) Check(ctx context.Context) (bool, error) {
+	page, err := s.Pool.Get(s.newPage)
+	if err != nil {
+		s.Pool.Put(nil)
+		return false, step("", "create page", err)
+	}
+	defer s.Pool.Put(page)
+
+	return LoggedIn(ctx, page, s.login)
+}
+
+// EnsureLoggedIn checks the session and logs in again if it has lapsed, waiting for pages in use to be put back. A check
+// that cannot tell, e.g. because FSM is slow, leaves the session as it is.
+func (s *Session) EnsureLoggedIn(ctx context.Context) error {
+	ok, err := s.Check(ctx)
+	if err != nil {
+		log.Printf("Could not check the FSM session, carrying on: %v", err)
+		return nil
+	}
+	if ok {
+		log.Print("FSM session is still logged in")
+		return nil
+	}
+
+	log.Print("FSM session has lapsed, logging in again")
+	return s.Relogin(ctx)
+}
+
+// Relogin runs the login flow again in the session's browser and replaces the pooled workers, so workers opened
+// afterwards are seeded with the new cookies and storage. It waits for pages in use to be put back first.
+func (s *Session) Relogin(ctx context.Context) error {
+	if s.store != nil {
+		if err := s.store.Clear(); err != nil {
+			log.Print(err)
+		}
+	}
+	if err := s.Conc.resetPool(ctx, s.Pool); err != nil {
+		return err
+	}
+
+	pageCookies, browserCookies, sessionStorage, localStorage, err := LoginSteps(ctx, &s.Pool, s.Browser, s.login)
+	if err != nil {
+		return err
+	}
+	s.PageCookies, s.BrowserCookies, s.SessionStorage, s.LocalStorage = pageCookies, browserCookies, sessionStorage, localStorage
+	s.save()
+
+	// The login page was put back in the pool, workers get their own contexts
+	return s.Conc.resetPool(ctx, s.Pool)
+}
+
+// newPage opens a worker seeded with the session's login state
+func (s *Session) newPage() (*rod.Page, error) {
+	return s.Conc.newWorker(s.PageCookies, s.BrowserCookies, s.SessionStorage, s.LocalStorage)
+}
@@ -0,0 +1,164 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"scraper/internal/config"
+	"strings"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+	"github.com/joho/godotenv"
+)
+
+// Credentials are the FSM account details used to log in without the user
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// LoginError is returned when the login page shows an error after submitting the form, such as a wrong password.
+// Retrying does not help so it is permanent.
+type LoginError struct {
+	Message string
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("login rejected: %s", e.Message)
+}
+
+func (e *LoginError) Permanent() bool { return true }
+
+// LoadCredentials returns the username and password from the config, which includes FSM_USERNAME and FSM_PASSWORD,
+// falling back to the same names in the secrets file
+func LoadCredentials(cfg config.Login) (Credentials, error) {
+	creds := Credentials{Username: cfg.Username, Password: cfg.Password}
+
+	if (creds.Username == "" || creds.Password == "") && cfg.SecretsFile != "" {
+		secrets, err := godotenv.Read(cfg.SecretsFile)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("could not read secrets file: %w", err)
+		}
+		if creds.Username == "" {
+			creds.Username = secrets["FSM_USERNAME"]
+		}
+		if creds.Password == "" {
+			creds.Password = secrets["FSM_PASSWORD"]
+		}
+	}
+
+	if creds.Username == "" || creds.Password == "" {
+		return Credentials{}, errors.New("login mode auto needs FSM_USERNAME and FSM_PASSWORD, set them or add them to login.secrets_file")
+	}
+	return creds, nil
+}
+
+// FillLogin opens the login page, submits creds and waits until the page either leaves the login page (or shows the
+// success selector) or shows an error, for up to cfg.Timeout
+func FillLogin(ctx context.Context, page *rod.Page, cfg config.Login, creds Credentials) error {
+	loginURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return step("", "parse login url", err)
+	}
+
+	page = page.Context(ctx)
+	if cfg.Timeout > 0 {
+		page = page.Timeout(cfg.Timeout)
+		defer page.CancelTimeout()
+	}
+
+	if err := page.Navigate(cfg.URL); err != nil {
+		return step("", "open login page", err)
+	}
+	if err := input(page, cfg.Selectors.Username, creds.Username); err != nil {
+		return step("", "enter username", err)
+	}
+	if err := input(page, cfg.Selectors.Password, creds.Password); err != nil {
+		return step("", "enter password", err)
+	}
+	submit, err := page.Element(cfg.Selectors.Submit)
+	if err != nil {
+		return step("", "find login button", err)
+	}
+	if err := submit.Click(proto.InputMouseButtonLeft, 1); err != nil {
+		return step("", "click login button", err)
+	}
+
+	var loginErr error
+	_, err = page.Race().
+		ElementFunc(func(p *rod.Page) (*rod.Element, error) {
+			return loggedIn(p, loginURL.Path, cfg.Selectors.Success)
+		}).
+		ElementFunc(func(p *rod.Page) (*rod.Element, error) {
+			return visible(p, cfg.Selectors.Error)
+		}).
+		Handle(func(el *rod.Element) error {
+			message, err := el.Text()
+			if err != nil {
+				return err
+			}
+			loginErr = &LoginError{Message: strings.TrimSpace(message)}
+			return nil
+		}).
+		Do()
+	if err != nil {
+		return step("", "wait for login", err)
+	}
+	if loginErr != nil {
+		return loginErr
+	}
+
+	log.Print("Logged in to FSM")
+	return nil
+}
+
+// loggedIn finds the success element, or the page body once the page is no longer on loginPath
+func loggedIn(page *rod.Page, loginPath, successSelector string) (*rod.Element, error) {
+	if successSelector != "" {
+		elements, err := page.Elements(successSelector)
+		if err != nil || elements.Empty() {
+			return nil, &rod.ElementNotFoundError{}
+		}
+		return elements.First(), nil
+	}
+
+	info, err := page.Info()
+	if err != nil || strings.HasPrefix(info.URL, "about:") || strings.Contains(info.URL, loginPath) {
+		return nil, &rod.ElementNotFoundError{}
+	}
+	return page.Element("body")
+}
+
+// visible returns the first element matching selector that is shown and has text, without waiting. Errors while the
+// page navigates count as not found so a race keeps polling.
+func visible(page *rod.Page, selector string) (*rod.Element, error) {
+	elements, err := page.Elements(selector)
+	if err != nil {
+		return nil, &rod.ElementNotFoundError{}
+	}
+	for _, el := range elements {
+		shown, err := el.Visible()
+		if err != nil || !shown {
+			continue
+		}
+		if text, err := el.Text(); err == nil && strings.TrimSpace(text) != "" {
+			return el, nil
+		}
+	}
+	return nil, &rod.ElementNotFoundError{}
+}
+
+// input waits for the element at selector and replaces its text with value
+func input(page *rod.Page, selector, value string) error {
+	el, err := page.Element(selector)
+	if err != nil {
+		return err
+	}
+	if err := el.SelectAllText(); err != nil {
+		return err
+	}
+	return el.Input(value)
+}
@@ -1,9 +1,14 @@
 package persiststate
 
 import (
+	"errors"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-rod/rod"
 	"github.com/go-rod/rod/lib/proto"
@@ -54,6 +59,89 @@ func TestPersistSessionStates(t *testing.T) {
 	})
 }
 
+func TestSessionStore(t *testing.T) {
+	dir := t.TempDir()
+	captured := time.Date(2024, 8, 23, 19, 0, 0, 0, time.UTC)
+	saved := &Saved{
+		PageCookies:    []*proto.NetworkCookie{{Name: "JSESSIONID", Value: "abc", Domain: "secure.fundsupermart.com", Session: true}},
+		BrowserCookies: []*proto.NetworkCookie{{Name: "token", Value: "def", Domain: "secure.fundsupermart.com", Expires: proto.TimeSinceEpoch(captured.Add(6 * time.Hour).Unix())}},
+		SessionStorage: StorageData{"testSessionKey": "testSessionValue"},
+		LocalStorage:   StorageData{"testLocalKey": "testLocalValue"},
+		Captured:       captured,
+	}
+
+	t.Run("Testing a session saved with a passphrase loads back", func(t *testing.T) {
+		store, err := NewStore(filepath.Join(dir, "passphrase", "session.enc"), "correct horse", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Load(); !errors.Is(err, ErrNoSession) {
+			t.Fatalf("Expected no session before saving, got %v", err)
+		}
+		if err := store.Save(saved); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(store.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "testLocalValue") {
+			t.Fatal("Expected the session file to be encrypted")
+		}
+
+		loaded, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertCookiesEqual(t, loaded.BrowserCookies, saved.BrowserCookies)
+		assertStorageEqual(t, loaded.LocalStorage["testLocalKey"], "testLocalValue")
+		assertStorageEqual(t, loaded.SessionStorage["testSessionKey"], "testSessionValue")
+		if !loaded.Captured.Equal(captured) {
+			t.Errorf("Expected captured %s, got %s", captured, loaded.Captured)
+		}
+
+		wrong, err := NewStore(store.Path, "wrong horse", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wrong.Load(); !errors.Is(err, ErrWrongSecret) {
+			t.Fatalf("Expected a wrong passphrase error, got %v", err)
+		}
+	})
+
+	t.Run("Testing a session saved with a key file loads back", func(t *testing.T) {
+		keyFile := filepath.Join(dir, "session.key")
+		if err := os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		store, err := NewStore(filepath.Join(dir, "keyfile.enc"), "", keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(saved); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertCookiesEqual(t, loaded.PageCookies, saved.PageCookies)
+	})
+
+	t.Run("Testing a session expires with its max age or first cookie", func(t *testing.T) {
+		if saved.Expired(captured.Add(time.Hour), 24*time.Hour) {
+			t.Error("Expected the session to be usable after an hour")
+		}
+		if !saved.Expired(captured.Add(6*time.Hour), 24*time.Hour) {
+			t.Error("Expected the session to expire with its token cookie")
+		}
+		if !saved.Expired(captured.Add(2*time.Hour), time.Hour) {
+			t.Error("Expected the session to expire after its max age")
+		}
+	})
+}
+
 func assertStorageEqual(t testing.TB, got, want string) {
 	t.Helper()
 
@@ -0,0 +1,187 @@
+package persiststate
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-rod/rod/lib/proto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// magic starts every session file so other files are not mistaken for one
+const magic = "FSMSESS1"
+
+const saltSize = 16
+
+var (
+	ErrNoSession     = errors.New("no saved session")
+	ErrWrongSecret   = errors.New("could not decrypt saved session, wrong passphrase or key file")
+	ErrSessionFormat = errors.New("not a saved session file")
+)
+
+// Saved is a logged in browser state that can be restored with SetSessionData
+type Saved struct {
+	PageCookies    []*proto.NetworkCookie `json:"page_cookies"`
+	BrowserCookies []*proto.NetworkCookie `json:"browser_cookies"`
+	SessionStorage StorageData            `json:"session_storage"`
+	LocalStorage   StorageData            `json:"local_storage"`
+	Captured       time.Time              `json:"captured"`
+}
+
+// ExpiresAt is when the saved state stops being usable: maxAge after it was captured (0 for no limit) or when the
+// first of its cookies with an expiry date expires, whichever is sooner. It is zero if neither applies.
+func (s *Saved) ExpiresAt(maxAge time.Duration) time.Time {
+	var at time.Time
+	if maxAge > 0 {
+		at = s.Captured.Add(maxAge)
+	}
+
+	for _, cookies := range [][]*proto.NetworkCookie{s.PageCookies, s.BrowserCookies} {
+		for _, cookie := range cookies {
+			if cookie.Session || cookie.Expires <= 0 {
+				continue
+			}
+			if expires := cookie.Expires.Time(); at.IsZero() || expires.Before(at) {
+				at = expires
+			}
+		}
+	}
+
+	return at
+}
+
+// Expired reports whether the saved state can no longer be used at now
+func (s *Saved) Expired(now time.Time, maxAge time.Duration) bool {
+	at := s.ExpiresAt(maxAge)
+	return !at.IsZero() && !now.Before(at)
+}
+
+// Store keeps a Saved session in a file encrypted with AES-GCM, using a key derived from a passphrase or the contents
+// of a key file
+type Store struct {
+	Path   string
+	secret []byte
+}
+
+// NewStore returns a store for the session file at path. Exactly one of passphrase and keyFile should be set.
+func NewStore(path, passphrase, keyFile string) (*Store, error) {
+	switch {
+	case passphrase != "" && keyFile != "":
+		return nil, errors.New("set either a session passphrase or a key file, not both")
+	case passphrase != "":
+		return &Store{Path: path, secret: []byte(passphrase)}, nil
+	case keyFile != "":
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read session key file: %w", err)
+		}
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("session key file %s is empty", keyFile)
+		}
+		return &Store{Path: path, secret: key}, nil
+	default:
+		return nil, errors.New("a session passphrase or key file is needed to save sessions")
+	}
+}
+
+// Save encrypts saved and writes it to the store's file, replacing the previous session
+func (s *Store) Save(saved *Saved) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	gcm, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	out := append([]byte(magic), salt...)
+	out = append(out, nonce...)
+	out = gcm.Seal(out, nonce, data, []byte(magic))
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		return fmt.Errorf("could not create session directory: %w", err)
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0600); err != nil {
+		return fmt.Errorf("could not save session: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("could not save session: %w", err)
+	}
+	return nil
+}
+
+// Load reads and decrypts the store's file. It returns ErrNoSession if nothing has been saved yet.
+func (s *Store) Load() (*Saved, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read saved session: %w", err)
+	}
+
+	if !strings.HasPrefix(string(data), magic) || len(data) < len(magic)+saltSize {
+		return nil, ErrSessionFormat
+	}
+	data = data[len(magic):]
+	gcm, err := s.cipher(data[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[saltSize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrSessionFormat
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(magic))
+	if err != nil {
+		return nil, ErrWrongSecret
+	}
+
+	var saved Saved
+	if err := json.Unmarshal(plain, &saved); err != nil {
+		return nil, fmt.Errorf("could not read saved session: %w", err)
+	}
+	return &saved, nil
+}
+
+// Clear removes the saved session, e.g. once FSM has logged it out
+func (s *Store) Clear() error {
+	if err := os.Remove(s.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove saved session: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.secret, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,115 @@
+package scraper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Presets are the ranges the FSM price chart offers, smallest first
+var Presets = []string{"1M", "3M", "6M", "YTD", "1Y", "3Y", "5Y", "10Y"}
+
+// DefaultPreset is the range the price chart shows before one is clicked
+const DefaultPreset = "3M"
+
+const rangeDateLayout = "2006-01-02"
+
+// Range is the price history a download covers, either a chart preset or custom From and To dates
+type Range struct {
+	Preset   string
+	From, To time.Time //custom range, a zero To is today
+}
+
+// ParseRange reads a preset such as 1Y, or custom dates as 2020-01-01..2024-06-30 where the end may be left out for
+// today. An empty range is the chart's default.
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Range{Preset: DefaultPreset}, nil
+	}
+	for _, preset := range Presets {
+		if strings.EqualFold(s, preset) {
+			return Range{Preset: preset}, nil
+		}
+	}
+
+	start, end, ok := strings.Cut(s, "..")
+	if !ok {
+		return Range{}, fmt.Errorf("unknown range %s, use one of %s or from..to dates", s, strings.Join(Presets, ", "))
+	}
+	var r Range
+	var err error
+	if r.From, err = time.Parse(rangeDateLayout, start); err != nil {
+		return Range{}, fmt.Errorf("invalid range start %s: %w", start, err)
+	}
+	if end != "" {
+		if r.To, err = time.Parse(rangeDateLayout, end); err != nil {
+			return Range{}, fmt.Errorf("invalid range end %s: %w", end, err)
+		}
+		if r.To.Before(r.From) {
+			return Range{}, fmt.Errorf("range %s ends before it starts", s)
+		}
+	}
+	return r, nil
+}
+
+func (r Range) String() string {
+	if r.Preset != "" {
+		return r.Preset
+	}
+	if r.To.IsZero() {
+		return r.From.Format(rangeDateLayout) + ".."
+	}
+	return r.From.Format(rangeDateLayout) + ".." + r.To.Format(rangeDateLayout)
+}
+
+// Custom reports whether the range has its own dates rather than a preset
+func (r Range) Custom() bool {
+	return r.Preset == ""
+}
+
+// Dates returns the first and last day the range covers on now
+func (r Range) Dates(now time.Time) (from, to time.Time) {
+	if r.Custom() {
+		to = r.To
+		if to.IsZero() {
+			to = now
+		}
+		return r.From, to
+	}
+	return presetStart(r.Preset, now), now
+}
+
+// ChartPreset returns the preset to pick on the price chart, the smallest that covers a custom range
+func (r Range) ChartPreset(now time.Time) string {
+	if !r.Custom() {
+		return r.Preset
+	}
+	return CoveringRange(r.From, now).Preset
+}
+
+// CoveringRange returns the smallest preset that starts on or before since, or the longest one if none does
+func CoveringRange(since, now time.Time) Range {
+	best := Presets[len(Presets)-1]
+	var bestStart time.Time
+	for _, preset := range Presets {
+		start := presetStart(preset, now)
+		if !start.After(since) && start.After(bestStart) {
+			best, bestStart = preset, start
+		}
+	}
+	return Range{Preset: best}
+}
+
+func presetStart(preset string, now time.Time) time.Time {
+	if preset == "YTD" {
+		return time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+	}
+
+	n := 0
+	fmt.Sscanf(preset, "%d", &n)
+	if strings.HasSuffix(preset, "M") {
+		return now.AddDate(0, -n, 0)
+	}
+	return now.AddDate(-n, 0, 0)
+}
@@ -0,0 +1,205 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"scraper/internal/config"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-rod/rod"
+)
+
+// searchSettle is how long the search results must stay unchanged before they are read, as they update while typing
+const searchSettle = 500 * time.Millisecond
+
+// containedScore is the least a result scores when its name contains every word of the fund searched for, e.g. the
+// fund name without its share class
+const containedScore = 0.9
+
+// Candidate is a search result ranked by how well its name matches the fund searched for
+type Candidate struct {
+	ListedFund
+	Score float64 //1 is the same name once normalised
+}
+
+// AmbiguousLinkError is returned when no search result matches a fund closely enough, or two match about as well, so
+// its link is left for someone to pick
+type AmbiguousLinkError struct {
+	Fundname   string
+	Candidates []Candidate //best first
+}
+
+func (e *AmbiguousLinkError) Error() string {
+	if len(e.Candidates) == 0 {
+		return fmt.Sprintf("no confident match for %s", e.Fundname)
+	}
+	best := e.Candidates[0]
+	return fmt.Sprintf("no confident match for %s among %d results, best %s (%.2f)", e.Fundname, len(e.Candidates), best.Name, best.Score)
+}
+
+// Permanent tells the retry policy that searching again will find the same results
+func (e *AmbiguousLinkError) Permanent() bool {
+	return true
+}
+
+// FindFundLink searches the fund selector open in page for fundName, ranks every result by how well its name matches
+// and returns the link of the best one if it is a confident match. Otherwise it returns an AmbiguousLinkError with the
+// ranked results.
+func FindFundLink(ctx context.Context, fundName string, page *rod.Page, cfg config.Links) (string, error) {
+	page = page.Context(ctx)
+
+	//Enter fund name into search bar
+	searchBar, err := Selectors.Element(page, "search_bar")
+	if err != nil {
+		return "", step(fundName, "find search bar", err)
+	}
+	searchBar.SelectAllText()
+	if err := searchBar.Input(fundName); err != nil {
+		return "", step(fundName, "search fund", err)
+	}
+
+	log.Println("Searching for fund page links:", fundName)
+	_ = page.WaitDOMStable(searchSettle, 0)
+	elements, err := Selectors.Elements(page, "search_result")
+	if err != nil {
+		return "", step(fundName, "find search results", err)
+	}
+
+	var results []ListedFund
+	for _, el := range elements {
+		href, err := el.Attribute("href")
+		if err != nil || href == nil {
+			continue
+		}
+		name, err := el.Text()
+		if err != nil {
+			continue
+		}
+		if result, ok := NewListedFund(name, *href); ok {
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return "", step(fundName, "get fund link", ErrLinkNotFound)
+	}
+
+	best, err := PickResult(fundName, RankResults(fundName, results), cfg)
+	if err != nil {
+		return "", step(fundName, "match search results", err)
+	}
+	log.Printf("Fund link for %s grabbed from %s (%.2f): %s", fundName, best.Name, best.Score, best.Link)
+	return best.Link, nil
+}
+
+// RankResults scores every search result against fundName, best first. Results with the same code are only kept once.
+func RankResults(fundName string, results []ListedFund) []Candidate {
+	seen := map[string]bool{}
+	var candidates []Candidate
+	for _, result := range results {
+		if seen[result.Code] {
+			continue
+		}
+		seen[result.Code] = true
+		candidates = append(candidates, Candidate{ListedFund: result, Score: MatchScore(fundName, result.Name)})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	return candidates
+}
+
+// PickResult returns the best of the ranked candidates if it scores at least cfg.MinScore and beats the next one by
+// cfg.Margin, or is the only one with the same name once normalised
+func PickResult(fundName string, candidates []Candidate, cfg config.Links) (Candidate, error) {
+	if len(candidates) == 0 {
+		return Candidate{}, ErrLinkNotFound
+	}
+
+	best := candidates[0]
+	confident := best.Score >= cfg.MinScore
+	if len(candidates) > 1 {
+		next := candidates[1]
+		confident = confident && best.Score-next.Score >= cfg.Margin
+		// Nothing beats the same name, however close the next one is
+		confident = confident || best.Score == 1 && next.Score < 1
+	}
+	if !confident {
+		return Candidate{}, &AmbiguousLinkError{Fundname: fundName, Candidates: candidates}
+	}
+	return best, nil
+}
+
+// MatchScore returns how alike two fund names are once normalised, from 0 to 1. It averages how many words they
+// share with how few edits turn one into the other, and only the same name scores 1.
+func MatchScore(a, b string) float64 {
+	a, b = NormaliseName(a), NormaliseName(b)
+	if a == b {
+		return 1
+	}
+	if a == "" || b == "" {
+		return 0
+	}
+
+	wordsA, wordsB := strings.Fields(a), strings.Fields(b)
+	counts := map[string]int{}
+	for _, w := range wordsB {
+		counts[w]++
+	}
+	shared := 0
+	for _, w := range wordsA {
+		if counts[w] > 0 {
+			counts[w]--
+			shared++
+		}
+	}
+	words := 2 * float64(shared) / float64(len(wordsA)+len(wordsB))
+
+	ra, rb := []rune(a), []rune(b)
+	edits := 1 - float64(levenshtein(ra, rb))/float64(max(len(ra), len(rb)))
+
+	score := min((words+edits)/2, 0.99)
+	if shared == len(wordsA) {
+		score = max(score, containedScore)
+	}
+	return score
+}
+
+// NormaliseName lowers a fund name and drops apostrophes and punctuation, so names FSM writes slightly differently
+// compare equal
+func NormaliseName(name string) string {
+	name = strings.ToLower(strings.ReplaceAll(name, "&", " and "))
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '\'' || r == '’' || r == '`':
+			//Schroder's and Schroders are the same fund
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
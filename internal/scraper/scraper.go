@@ -1,15 +1,19 @@
 package scraper
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
+	"scraper/internal/config"
 	"scraper/internal/database"
+	"scraper/internal/report"
 	"scraper/internal/scraper/persiststate"
+	"scraper/internal/selectors"
+	"sort"
 	"strings"
-	"sync"
-	"syscall"
+	"time"
 
 	"github.com/go-rod/rod"
 	"github.com/go-rod/rod/lib/launcher"
@@ -20,214 +24,328 @@ import (
 
 const (
 	FSMfundSelectorSite = "https://secure.fundsupermart.com/fsmone/tools/fund-selector"
-	PoolLimit           = 5 //Number of pages that can be loaded concurrently
+	popupTimeout        = 10 * time.Second
 	pref                = `{
 		"download": {
-		  "default_directory": "/Users/yad/Downloads/ttt"
+		  "default_directory": %q
 		}
 	  }`
 )
 
+// Selectors finds the elements of FSM pages, replaced by main with the registry loaded from the selectors file
+var Selectors = selectors.Default()
+
+// ConcBrowser is the browser pages download from concurrently, with Downloads telling their downloads apart and
+// Blocker, if set, failing the requests they do not need. Factsheet sets what else is read from each fund page, and
+// Match how close a new name on a fund page must be to be taken as FSM renaming the fund.
 type ConcBrowser struct {
-	Browser *rod.Browser
-	Counter int
-	MU      sync.Mutex
+	Browser   *rod.Browser
+	Counter   int
+	Downloads *Downloads
+	Blocker   *Blocker
+	Factsheet config.Factsheet
+	Match     config.Links
 }
 
-func ScrapeFSM(fund database.Fund, browser *rod.Browser, pool *rod.Pool[rod.Page], pageCookies, browserCookies []*proto.NetworkCookie, sessionStorage, localStorage persiststate.StorageData, c *ConcBrowser, fullhist bool, downloadFolderPath string) {
-	page, err := pool.Get(func() (*rod.Page, error) { return browser.MustPage(), nil }) //Create a new page in page pool, must use .MustIncognito for concurrency
-	defer pool.Put(page)
-
+// ScrapeFSM opens the fund page, downloads the prices in rng into downloadFolderPath and reads its factsheet.
+// Cancelling ctx stops the page wherever it is and returns the context error.
+func ScrapeFSM(ctx context.Context, fund database.Fund, browser *rod.Browser, pool *rod.Pool[rod.Page], pageCookies, browserCookies []*proto.NetworkCookie, sessionStorage, localStorage persiststate.StorageData, c *ConcBrowser, rng Range, downloadFolderPath string) (*Factsheet, error) {
+	//Create a new worker in page pool, an incognito page seeded with the login state
+	worker, err := pool.Get(func() (*rod.Page, error) {
+		return c.newWorker(pageCookies, browserCookies, sessionStorage, localStorage)
+	})
 	if err != nil {
-		log.Fatalf("Error creating new page from pool")
-	} else {
-		log.Println("Starting scrape for", fund.Fundname)
+		pool.Put(nil)
+		return nil, step(fund.Fundname, "create page", err)
 	}
+	page := worker.Context(ctx)
 
-	//page.MustNavigate(FSMfundSelectorSite).MustWaitLoad()
-	//setSessionData(page, pageCookies, sessionStorage, localStorage)
-	//page.MustReload().MustWaitLoad()
-
-	//Switch to new fund page button
-	//fundLink := findFundLink(fundName, page)
-	page.MustNavigate(fund.Link)
-	//if err != nil {
-	//	log.Fatalf("Couldn't open fund page for: %s", fundName)
-	//} else {
-	//	log.Println("Opened fund page for:", fundName)
-	//}
+	log.Println("Starting scrape for", fund.Fundname)
 
-	//defer fundPage.Close()
+	var sheet *Factsheet
+	if err = page.Navigate(fund.Link); err != nil {
+		err = step(fund.Fundname, "open fund page", err)
+	} else {
+		sheet, err = downloadFromFundPage(ctx, fund, page, c, rng, downloadFolderPath)
+	}
 
-	downloadFromFundPage(fund.Fundname, page, c, fullhist, downloadFolderPath)
+	if err != nil {
+		c.recycleWorker(pool, worker)
+		return nil, err
+	}
+	pool.Put(worker)
+	return sheet, nil
 }
 
-func InitialiseBrowser() (*rod.Browser, *launcher.Launcher) {
+func InitialiseBrowser(cfg config.Browser) (*rod.Browser, *launcher.Launcher, error) {
 	// Settings to launch browser non-headless
 	l := launcher.New().
-		Preferences(pref).
-		Headless(false).
+		Preferences(fmt.Sprintf(pref, cfg.DownloadDir)).
+		Headless(cfg.Headless).
 		Devtools(false)
 		//Set("download.default_directory", "C:/Users/Acer/Downloads").
 		//Set("download.prompt_for_download", "false").
 		//Set("profile.default_content_settings.popups", "0").
 		//Set("disable-popup-blocking", "true")
 
-	url := l.MustLaunch()
+	url, err := l.Launch()
+	if err != nil {
+		return nil, nil, step("", "launch browser", err)
+	}
 
 	// Launch a browser with non-headless settings
 	browser := rod.New().
 		ControlURL(url).
-		Trace(false). //disable verbose tracking of actions
+		Trace(false) //disable verbose tracking of actions
 		//SlowMotion(2 * time.Second).
-		MustConnect()
+	if err := browser.Connect(); err != nil {
+		l.Cleanup()
+		return nil, nil, step("", "connect to browser", err)
+	}
 
-	return browser, l
+	return browser, l, nil
 }
 
-func LoginSteps(pool *rod.Pool[rod.Page], browser *rod.Browser) (pageCookies, browserCookies []*proto.NetworkCookie, sessionStorage, localStorage persiststate.StorageData) {
+// LoginSteps opens the login page and either fills it in with the configured credentials (login mode auto) or waits
+// for the user to log in and hit enter, or for ctx to be cancelled
+func LoginSteps(ctx context.Context, pool *rod.Pool[rod.Page], browser *rod.Browser, login config.Login) (pageCookies, browserCookies []*proto.NetworkCookie, sessionStorage, localStorage persiststate.StorageData, err error) {
 	//Refresh page once to get rid of annoying popups
-	page, _ := pool.Get(func() (*rod.Page, error) { return browser.MustPage(), nil })
+	page, err := pool.Get(func() (*rod.Page, error) { return browser.Page(proto.TargetCreateTarget{}) })
+	if err != nil {
+		return nil, nil, nil, nil, step("", "create login page", err)
+	}
 	defer pool.Put(page)
+	page = page.Context(ctx)
 
-	page.MustNavigate(FSMfundSelectorSite).MustWaitLoad()
-	page.MustElementX("//span[@aria-hidden='true']").MustClick()
-	page.MustNavigate("https://secure.fundsupermart.com/fsm/account/login").MustWaitStable()
+	if err := page.Navigate(FSMfundSelectorSite); err != nil {
+		return nil, nil, nil, nil, step("", "open fund selector", err)
+	}
+	//The popup does not always show, so only wait for it briefly
+	_ = click(page.Timeout(popupTimeout), "popup_close")
+
+	switch login.Mode {
+	case "auto":
+		creds, err := LoadCredentials(login)
+		if err != nil {
+			return nil, nil, nil, nil, step("", "load credentials", err)
+		}
+		if err := FillLogin(ctx, page, login, creds); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	case "", "interactive":
+		if err := rod.Try(func() { page.MustNavigate(login.URL).MustWaitStable() }); err != nil {
+			return nil, nil, nil, nil, step("", "open login page", err)
+		}
 
-	//Wait for user to login to FSM account before hitting enter into the terminal
-	var i string
-	fmt.Print("Input any random characters and hit enter after logging in, REMEMBER TO FULLY ZOOM OUT OF BROWSER WINDOW: ")
-	fmt.Scan(&i)
+		//Wait for user to login to FSM account before hitting enter into the terminal
+		fmt.Print("Input any random characters and hit enter after logging in, REMEMBER TO FULLY ZOOM OUT OF BROWSER WINDOW: ")
+		if err := waitForEnter(ctx); err != nil {
+			return nil, nil, nil, nil, step("", "wait for login", err)
+		}
+	default:
+		return nil, nil, nil, nil, fmt.Errorf("unknown login mode %q, use interactive or auto", login.Mode)
+	}
 
 	//Save cookies so subsequent pages do not need to relogin and clear annoying popup
-	pageCookies, _ = page.Cookies(make([]string, 0))
-	browserCookies, _ = browser.GetCookies()
-	log.Printf("Number of page cookes: %d", len(pageCookies))
-	for i, cookie := range pageCookies {
-		log.Printf("%d. Cookie Name:%s, Value: %s", i, cookie.Name, cookie.Value)
+	pageCookies, err = page.Cookies(make([]string, 0))
+	if err != nil {
+		return nil, nil, nil, nil, step("", "get page cookies", err)
 	}
-	log.Printf("Number of browser cookes: %d", len(browserCookies))
-	for i, cookie := range browserCookies {
-		log.Printf("%d. Cookie Name:%s, Value: %s", i, cookie.Name, cookie.Value)
+	browserCookies, err = browser.Context(ctx).GetCookies()
+	if err != nil {
+		return nil, nil, nil, nil, step("", "get browser cookies", err)
+	}
+	//Only names are logged, cookie and storage values hold the login session
+	log.Printf("Number of page cookies: %d (%s)", len(pageCookies), strings.Join(cookieNames(pageCookies), ", "))
+	log.Printf("Number of browser cookies: %d (%s)", len(browserCookies), strings.Join(cookieNames(browserCookies), ", "))
+
+	err = rod.Try(func() {
+		sessionStorage = persiststate.ExtractStorageData(page, "sessionStorage")
+		localStorage = persiststate.ExtractStorageData(page, "localStorage")
+	})
+	if err != nil {
+		return nil, nil, nil, nil, step("", "extract storage", err)
 	}
 
-	sessionStorage = persiststate.ExtractStorageData(page, "sessionStorage")
-	localStorage = persiststate.ExtractStorageData(page, "localStorage")
+	log.Printf("Number of local storage keys: %d (%s)", len(localStorage), strings.Join(storageKeys(localStorage), ", "))
+	log.Printf("Number of session storage keys: %d (%s)", len(sessionStorage), strings.Join(storageKeys(sessionStorage), ", "))
 
-	log.Print("Setting local storage to login state")
-	for key, value := range localStorage {
-		log.Printf("Local storage Key: %s, Value: %s", key, value)
-	}
+	return pageCookies, browserCookies, sessionStorage, localStorage, nil
+}
 
-	log.Print("Setting session storage to login state")
-	for key, value := range sessionStorage {
-		log.Printf("Session storage Key: %s, Value: %s", key, value)
+func cookieNames(cookies []*proto.NetworkCookie) []string {
+	names := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		names[i] = cookie.Name
 	}
+	return names
+}
 
-	return pageCookies, browserCookies, sessionStorage, localStorage
+func storageKeys(data persiststate.StorageData) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-func CloseBrowserOnForceExit(browser *rod.Browser) {
-	// Setup signal handling to close the browser on SIGINT and SIGTERM
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+// waitForEnter blocks until a line is read from stdin or ctx is cancelled
+func waitForEnter(ctx context.Context) error {
+	read := make(chan error, 1)
 	go func() {
-		sig := <-sigs
-
-		browser.MustClose()
-		log.Fatalf("Received signal: %s, closing browser", sig)
+		_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		read <- err
 	}()
-}
-
-func FindFundLink(fundName string, page *rod.Page) string {
-	//Enter fund name into search bar
-	searchBar := page.MustElement(`input[placeholder="Search"]`)
-	searchBar.SelectAllText()
-	searchBar.MustInput(fundName)
-
-	//Find fund page button
-	log.Println("Searching for fund page button:", fundName)
-	fundPageButtonX := fmt.Sprintf("//span[contains(text(), '%s')]", fundName)
-	fundPageButton := page.MustElementX(fundPageButtonX).MustParent()
-
-	log.Println("Element found for fund page button:", fundName)
-	//openFundPageFunc := page.WaitOpen()
-	//page.Mouse.Scroll(0, 100, 1)
-	//fundPageButton.MustClick()
-	link, err := fundPageButton.Attribute("href")
-	fundLink := *link
 
-	fundLink = fmt.Sprintf("https://secure.fundsupermart.com%s", fundLink)
-	log.Printf("Fund link for %s grabbed: %s", fundName, fundLink)
-	if err != nil {
-		log.Fatalf("Failed to get fund link: %s", fundLink)
+	select {
+	case err := <-read:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return fundLink
 }
 
-func downloadFromFundPage(fundName string, fundPage *rod.Page, c *ConcBrowser, fullhist bool, downloadFolderPath string) {
-	err := checkFundName(fundName, fundPage)
+func downloadFromFundPage(ctx context.Context, fund database.Fund, fundPage *rod.Page, c *ConcBrowser, rng Range, downloadFolderPath string) (*Factsheet, error) {
+	fundName := fund.Fundname
+	renamed, err := checkFundName(fund, fundPage, c.Match)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	c.MU.Lock()
 	fundPage.Activate()
+	sheet := readFactsheet(fundName, fundPage, c.Factsheet)
+	sheet.Renamed = renamed
 
 	//Export CSV
-	priceButton := fundPage.MustElementX("//span[normalize-space(text())='Price']")
-	priceButton.MustClick()
-
-	// Click on 10Y if fullhist is true
-	if fullhist {
-		fundPage.MustElementX("//span[normalize-space(text())='Price']") //wait for price button to appear again
-
-		moreButton := fundPage.MustElementX("//span[contains(text(), 'More')]").MustParent().MustParent().MustParent()
-		moreButton.MustClick()
+	if err := click(fundPage, "price_tab"); err != nil {
+		return nil, step(fundName, "click Price", err)
+	}
 
-		tenButton := fundPage.MustElementX("//div[contains(text(), '10Y')]")
-		tenButton.MustClick()
+	// The chart shows 3M until another range is picked
+	if preset := rng.ChartPreset(time.Now()); preset != DefaultPreset {
+		if err := pickRange(fundPage, preset); err != nil {
+			return nil, step(fundName, "click "+preset, err)
+		}
 	}
 
-	wait := c.Browser.MustWaitDownload()
+	wait := c.Downloads.Expect(fundPage)
 
 	//Input keyboard enter into system to trigger download from popup window
-	exportButton := fundPage.MustElementX("//span[normalize-space(text())='Export']")
-	exportButton.MustClick()
+	if err := click(fundPage, "export_button"); err != nil {
+		return nil, step(fundName, "click Export", err)
+	}
 
 	//time.Sleep(2 * time.Second)
 	//pressEnterKey()
 
-	err = utils.OutputFile(fmt.Sprintf("%s/%s.csv", downloadFolderPath, strings.ReplaceAll(fundName, "/", "")), wait())
+	data, err := wait(ctx)
+	if err != nil {
+		return nil, step(fundName, "wait for download", err)
+	}
+	if rng.Custom() {
+		from, to := rng.Dates(time.Now())
+		if data, err = report.TrimPrices(data, from, to); err != nil {
+			return nil, step(fundName, "trim prices", err)
+		}
+	}
+
+	err = utils.OutputFile(DownloadPath(downloadFolderPath, fund), data)
 	if err != nil {
-		log.Fatal(err)
+		return nil, step(fundName, "save download", err)
+	}
+	if sheet.Distributions != nil {
+		if err := WriteDistributions(DistributionsPath(downloadFolderPath, fund), sheet.Distributions); err != nil {
+			return nil, step(fundName, "save distributions", err)
+		}
 	}
-	c.MU.Unlock()
 
 	log.Println(fundName, "successfully downloaded")
+	return sheet, nil
 }
 
-func checkFundName(fundName string, fundPage *rod.Page) error {
-	fundPageName := fundPage.MustElementX("//div[@class='flex flex-col items-start']/div/div").MustText()
+// DownloadPath is where the price csv for fund is saved within downloadFolderPath, named after its code so a rename
+// does not start a new file. Funds without a code are named after their name.
+func DownloadPath(downloadFolderPath string, fund database.Fund) string {
+	return fmt.Sprintf("%s/%s.csv", downloadFolderPath, strings.ReplaceAll(fund.WithCode().Key(), "/", ""))
+}
+
+// checkFundName checks the fund page opened is for fund. A different name on the page of a fund with a code is taken as
+// FSM renaming it and returned as renamed if IsRename, otherwise it is a NameMismatchError.
+func checkFundName(fund database.Fund, fundPage *rod.Page, cfg config.Links) (renamed string, err error) {
+	fundName := fund.Fundname
+	titleElement, err := Selectors.Element(fundPage, "fund_title")
+	if err != nil {
+		return "", step(fundName, "find fund name", err)
+	}
+	fundPageName, err := titleElement.Text()
+	if err != nil {
+		return "", step(fundName, "read fund name", err)
+	}
+	fundPageName = strings.Join(strings.Fields(fundPageName), " ")
+
 	if strings.EqualFold(strings.ReplaceAll(fundPageName, " ", ""), strings.ReplaceAll(fundName, " ", "")) {
 		log.Printf("Correct fund page opened for: %s", fundName)
-	} else {
-		//database.UpdateFundName(db, tableName, fundName, fundPageName)
-		return fmt.Errorf("fund name has been updated from %s to %s", fundName, fundPageName)
+		return "", nil
+	}
+	if !IsRename(fund, fundPageName, cfg) {
+		return "", &NameMismatchError{Fundname: fundName, PageFundname: fundPageName}
 	}
+	log.Printf("FSM has renamed %s to %s", fundName, fundPageName)
+	return fundPageName, nil
+}
 
-	return nil
+// IsRename tells whether pageName on the page of fund is FSM renaming it rather than a wrong link. The fund needs a code,
+// and the names must match at least as well as cfg.MinScore asks of a search result, so a page for another fund is not
+// written over the fund's name.
+func IsRename(fund database.Fund, pageName string, cfg config.Links) bool {
+	if fund.WithCode().Code == "" || pageName == "" {
+		return false
+	}
+	return MatchScore(fund.Fundname, pageName) >= cfg.MinScore
+}
+
+// click waits for the named selector and clicks it
+func click(page *rod.Page, name string, args ...any) error {
+	element, err := Selectors.Element(page, name, args...)
+	if err != nil {
+		return err
+	}
+	return element.Click(proto.InputMouseButtonLeft, 1)
+}
+
+// pickRange clicks preset on the price chart, opening the More menu first if the preset is hidden in it
+func pickRange(page *rod.Page, preset string) error {
+	//wait for price button to appear again
+	if _, err := Selectors.Element(page, "price_tab"); err != nil {
+		return err
+	}
+
+	candidates, err := Selectors.Candidates("range", preset)
+	if err != nil {
+		return err
+	}
+	if el, _ := selectors.First(page, candidates); el != nil {
+		if visible, err := el.Visible(); err == nil && visible {
+			return el.Click(proto.InputMouseButtonLeft, 1)
+		}
+	}
+
+	if err := click(page, "more_ranges"); err != nil {
+		return err
+	}
+	return click(page, "range", preset)
 }
 
-func pressEnterKey() {
+func pressEnterKey() error {
 	kb, err := keybd_event.NewKeyBonding()
 	if err != nil {
-		log.Fatalf("Keyboard library not working properly")
+		return fmt.Errorf("keyboard library not working properly: %w", err)
 	}
 	kb.SetKeys(keybd_event.VK_ENTER)
 	err = kb.Launching()
 	if err != nil {
-		log.Fatalf("Error pressing enter")
+		return fmt.Errorf("error pressing enter: %w", err)
 	}
+	return nil
 }
@@ -1,42 +1,71 @@
 package scraper
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"scraper/internal/config"
 	"scraper/internal/database"
+	"scraper/internal/retry"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
 )
 
 func TestScraper(t *testing.T) {
-	browser, l := InitialiseBrowser()
+	ctx := context.Background()
+	cfg, err := config.Load("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	browser, l, err := InitialiseBrowser(cfg.Browser)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer l.Cleanup()
 	defer browser.MustClose()
 
-	pool := rod.NewPagePool(PoolLimit)
+	pool := rod.NewPagePool(cfg.Browser.PoolLimit)
 	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
 
-	CloseBrowserOnForceExit(browser)
-
 	t.Run("Testing get fund link", func(t *testing.T) {
 		fundName := "AB FCP I Global Equity Blend"
 		fundLink := "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"
 
 		tableName := "testfunds"
-		db := database.ConnectDB()
+		db, err := database.ConnectDB(ctx, cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		database.CreateTestFundTable(db, tableName)
+		if err := database.CreateTestFundTable(ctx, db, tableName); err != nil {
+			t.Fatal(err)
+		}
 
 		fund := database.Fund{Fundname: fundName, Link: fundLink}
-		database.AddFund(db, tableName, fund)
+		if _, err := database.AddFund(ctx, db, tableName, fund); err != nil {
+			t.Fatal(err)
+		}
 
 		page, _ := pool.Get(func() (*rod.Page, error) { return browser.MustIncognito().MustPage(), nil })
 		defer pool.Put(page)
 
 		page.MustNavigate(fundLink)
-		err := checkFundName(fundName, page)
+		_, err = checkFundName(database.Fund{Fundname: fundName}, page, cfg.Links)
 
-		if err != nil {
-			results, err := database.FundsByNames(db, tableName, []string{fundName})
+		var mismatch *NameMismatchError
+		if errors.As(err, &mismatch) {
+			results, err := database.FundsByNames(ctx, db, tableName, []string{fundName})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -44,3 +73,915 @@ func TestScraper(t *testing.T) {
 		}
 	})
 }
+
+func TestCredentials(t *testing.T) {
+	t.Run("Testing credentials from the config are used first", func(t *testing.T) {
+		creds, err := LoadCredentials(config.Login{Username: "user", Password: "pass", SecretsFile: "missing.env"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertCredentials(t, creds, "user", "pass")
+	})
+
+	t.Run("Testing missing credentials are read from the secrets file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "fsm.env")
+		if err := os.WriteFile(path, []byte("FSM_USERNAME=fileuser\nFSM_PASSWORD='file pass'\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		creds, err := LoadCredentials(config.Login{Username: "user", SecretsFile: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertCredentials(t, creds, "user", "file pass")
+	})
+
+	t.Run("Testing missing credentials are an error", func(t *testing.T) {
+		if _, err := LoadCredentials(config.Login{Username: "user"}); err == nil {
+			t.Fatal("Expected an error without a password")
+		}
+	})
+}
+
+func TestLogin(t *testing.T) {
+	server := httptest.NewServer(mockLoginSite("user", "secret"))
+	defer server.Close()
+
+	browser, l, err := InitialiseBrowser(config.Browser{DownloadDir: t.TempDir(), PoolLimit: 1, Headless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Cleanup()
+	defer browser.MustClose()
+
+	cfg := config.Default().Login
+	cfg.URL = server.URL + "/fsm/account/login"
+	cfg.CheckURL = server.URL + "/fsm/account/dashboard"
+	cfg.Timeout = 10 * time.Second
+
+	t.Run("Testing the login form is filled and leaves the login page", func(t *testing.T) {
+		page := browser.MustIncognito().MustPage()
+		defer page.MustClose()
+
+		if err := FillLogin(context.Background(), page, cfg, Credentials{Username: "user", Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+		if !page.MustHas("#account") {
+			t.Fatal("Expected the account page after logging in")
+		}
+	})
+
+	t.Run("Testing the session check tells logged in and lapsed sessions apart", func(t *testing.T) {
+		incognito := browser.MustIncognito()
+		page := incognito.MustPage()
+		defer page.MustClose()
+
+		assertLoggedIn(t, page, cfg, false)
+		if err := FillLogin(context.Background(), page, cfg, Credentials{Username: "user", Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+		assertLoggedIn(t, page, cfg, true)
+
+		withAccount := cfg
+		withAccount.Selectors.Account = "#account"
+		assertLoggedIn(t, page, withAccount, true)
+
+		incognito.MustSetCookies()
+		assertLoggedIn(t, page, withAccount, false)
+	})
+
+	t.Run("Testing workers are seeded with the captured login state", func(t *testing.T) {
+		page := browser.MustIncognito().MustPage()
+		defer page.MustClose()
+		if err := FillLogin(context.Background(), page, cfg, Credentials{Username: "user", Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+		cookies := page.MustCookies()
+
+		c := &ConcBrowser{Browser: browser}
+		seeded, err := c.newWorker(nil, cookies, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.closeWorker(seeded)
+		assertLoggedIn(t, seeded, cfg, true)
+
+		empty, err := c.newWorker(nil, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.closeWorker(empty)
+		assertLoggedIn(t, empty, cfg, false)
+	})
+
+	t.Run("Testing a rejected login is a permanent error", func(t *testing.T) {
+		page := browser.MustIncognito().MustPage()
+		defer page.MustClose()
+
+		err := FillLogin(context.Background(), page, cfg, Credentials{Username: "user", Password: "wrong"})
+
+		var loginErr *LoginError
+		if !errors.As(err, &loginErr) {
+			t.Fatalf("Expected a login error, got %v", err)
+		}
+		if loginErr.Message != "Invalid username or password" {
+			t.Errorf("Unexpected login error message %q", loginErr.Message)
+		}
+		if retry.Classify(err) != retry.Permanent {
+			t.Error("Expected a rejected login to be permanent")
+		}
+	})
+}
+
+func TestDownloads(t *testing.T) {
+	server := httptest.NewServer(fakeFundSite(200 * time.Millisecond))
+	defer server.Close()
+
+	browser, downloads := initialiseDownloadBrowser(t)
+	defer browser.MustClose()
+	defer downloads.Close()
+
+	t.Run("Testing concurrent downloads are saved for the page that started them", func(t *testing.T) {
+		dir := t.TempDir()
+		funds := fakeFunds(server.URL, 5)
+
+		if err := scrapeAll(browser, downloads, funds, 5, dir); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, fund := range funds {
+			data, err := os.ReadFile(DownloadPath(dir, fund))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), fund.Fundname) {
+				t.Errorf("Expected the download for %s, got %q", fund.Fundname, data)
+			}
+		}
+	})
+}
+
+func TestResetPool(t *testing.T) {
+	c := &ConcBrowser{}
+
+	t.Run("Testing workers in use are waited for", func(t *testing.T) {
+		pool := rod.NewPagePool(3)
+		inUse := <-pool
+
+		done := make(chan error)
+		go func() { done <- c.resetPool(context.Background(), pool) }()
+
+		select {
+		case err := <-done:
+			t.Fatalf("Expected reset to wait for the worker in use, returned %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		pool.Put(inUse)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if len(pool) != 3 {
+			t.Errorf("Expected 3 empty slots, got %d", len(pool))
+		}
+	})
+
+	t.Run("Testing slots are given back when cancelled", func(t *testing.T) {
+		pool := rod.NewPagePool(3)
+		<-pool
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := c.resetPool(ctx, pool); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected deadline exceeded, got %v", err)
+		}
+		if len(pool) != 2 {
+			t.Errorf("Expected the 2 free slots back, got %d", len(pool))
+		}
+	})
+}
+
+func TestBlocker(t *testing.T) {
+	cfg := config.Block{ResourceTypes: []string{"Image", "Font"}, URLPatterns: []string{"*/analytics/*"}, MeasureBytes: true}
+
+	t.Run("Testing resource types and url patterns are blocked", func(t *testing.T) {
+		blocker, err := NewBlocker(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertBlocks(t, blocker, proto.NetworkResourceTypeImage, "https://fsm.test/logo.png", true)
+		assertBlocks(t, blocker, proto.NetworkResourceTypeScript, "https://tracker.test/analytics/gtag.js", true)
+		assertBlocks(t, blocker, proto.NetworkResourceTypeScript, "https://fsm.test/app.js", false)
+		assertBlocks(t, blocker, proto.NetworkResourceTypeDocument, "https://fsm.test/fsmone/funds/factsheet/ACM019", false)
+	})
+
+	t.Run("Testing stats are counted since an earlier snapshot", func(t *testing.T) {
+		before := BlockStats{Requests: 2, Bytes: 100, ByType: map[string]int{"Image": 2}}
+		after := BlockStats{Requests: 5, Bytes: 400, ByType: map[string]int{"Image": 3, "Font": 2}}
+
+		diff := after.Sub(before)
+		if diff.Requests != 3 || diff.Bytes != 300 || diff.ByType["Image"] != 1 || diff.ByType["Font"] != 2 {
+			t.Errorf("Expected 3 requests and 300 bytes since before, got %+v", diff)
+		}
+		if got, want := diff.String(), "3 requests, 0.0 MB (Font 2, Image 1)"; got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("Testing trackers are never measured and measured urls are capped", func(t *testing.T) {
+		var mu sync.Mutex
+		heads := map[string]int{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			heads[r.URL.Path]++
+			mu.Unlock()
+			w.Header().Set("Content-Length", "2048")
+		}))
+		defer server.Close()
+
+		blocker, err := NewBlocker(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocker.count(proto.NetworkResourceTypeScript, server.URL+"/analytics/tag.js", true)
+		blocker.count(proto.NetworkResourceTypeImage, server.URL+"/logo.png", false)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for blocker.Stats().Bytes < 2048 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mu.Lock()
+		if heads["/analytics/tag.js"] != 0 || heads["/logo.png"] != 1 {
+			t.Errorf("Expected only the logo to be measured, got %v", heads)
+		}
+		mu.Unlock()
+
+		for i := range 2 * maxMeasuredURLs {
+			blocker.count(proto.NetworkResourceTypeImage, fmt.Sprintf("http://127.0.0.1:1/%d.png", i), false)
+		}
+		blocker.mu.Lock()
+		kept := len(blocker.sizes)
+		blocker.mu.Unlock()
+		if kept > maxMeasuredURLs {
+			t.Errorf("Expected at most %d urls kept, got %d", maxMeasuredURLs, kept)
+		}
+		if stats := blocker.Stats(); stats.Requests != 2*maxMeasuredURLs+2 {
+			t.Errorf("Expected every blocked request counted, got %d", stats.Requests)
+		}
+	})
+
+	t.Run("Testing worker pages skip blocked requests", func(t *testing.T) {
+		var mu sync.Mutex
+		fetched := map[string]int{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				mu.Lock()
+				fetched[r.URL.Path]++
+				mu.Unlock()
+			}
+			switch r.URL.Path {
+			case "/logo.png":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(make([]byte, 2048))
+			case "/analytics/tag.js":
+				w.Header().Set("Content-Type", "text/javascript")
+				w.Write([]byte("window.tracked = true"))
+			default:
+				fmt.Fprint(w, `<html><body><img src="/logo.png"><script src="/analytics/tag.js"></script><p id="loaded">Fund</p></body></html>`)
+			}
+		}))
+		defer server.Close()
+
+		browser, downloads := initialiseDownloadBrowser(t)
+		defer browser.MustClose()
+		defer downloads.Close()
+
+		blocker, err := NewBlocker(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &ConcBrowser{Browser: browser, Downloads: downloads, Blocker: blocker}
+		page, err := c.newWorker(nil, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.closeWorker(page)
+
+		page.Timeout(10 * time.Second).MustNavigate(server.URL + "/fund").MustWaitLoad().MustElement("#loaded")
+
+		mu.Lock()
+		if fetched["/logo.png"] != 0 || fetched["/analytics/tag.js"] != 0 || fetched["/fund"] != 1 {
+			t.Errorf("Expected only the fund page to be fetched, got %v", fetched)
+		}
+		mu.Unlock()
+
+		// Sizes are measured in the background
+		deadline := time.Now().Add(5 * time.Second)
+		for blocker.Stats().Bytes < 2048 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		stats := blocker.Stats()
+		if stats.Requests != 2 || stats.Bytes < 2048 {
+			t.Errorf("Expected 2 requests and the size of the logo to be saved, got %+v", stats)
+		}
+	})
+}
+
+func TestFundInfo(t *testing.T) {
+	browser := rod.New().MustConnect()
+	defer browser.MustClose()
+	page := browser.MustPage()
+	page.MustSetDocumentContent(`<html><body>
+<div><span>Fund House</span><span>AllianceBernstein</span></div>
+<div><span>Base Currency</span><span> USD </span></div>
+<table><tr><td>Risk Rating</td><td>4 - Higher Risk</td></tr></table>
+<div><span>Min. Initial Investment</span><span>SGD 1,000</span></div>
+</body></html>`)
+
+	t.Run("Testing key facts are read next to their labels", func(t *testing.T) {
+		info, found := ReadFundInfo(page)
+		want := database.FundInfo{FundHouse: "AllianceBernstein", BaseCurrency: "USD", RiskRating: "4 - Higher Risk", MinInvestment: "SGD 1,000"}
+		if found != 4 || info != want {
+			t.Fatalf("Expected %+v, got %d facts %+v", want, found, info)
+		}
+	})
+}
+
+func TestDistributions(t *testing.T) {
+	t.Run("Testing distribution rows are read by their headers", func(t *testing.T) {
+		distributions, err := ParseDistributions([][]string{
+			{"Type", "Ex-Date", "Payment Date", "Dividend"},
+			{"Dividend", "15 Jul 2024", "31 Jul 2024", "USD 0.0512"},
+			{"Capital", "2024-01-15", "-", "1,000.5"},
+			{"No distributions before this date"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(distributions) != 2 {
+			t.Fatalf("Expected 2 distributions, got %+v", distributions)
+		}
+
+		first := distributions[0]
+		if first.ExDate.Format(time.DateOnly) != "2024-07-15" || first.PayDate.Format(time.DateOnly) != "2024-07-31" ||
+			first.Amount != 0.0512 || first.Currency != "USD" || first.Type != "Dividend" {
+			t.Errorf("Unexpected first distribution %+v", first)
+		}
+		second := distributions[1]
+		if !second.PayDate.IsZero() || second.Amount != 1000.5 || second.Currency != "" {
+			t.Errorf("Unexpected second distribution %+v", second)
+		}
+	})
+
+	t.Run("Testing a table without an amount is an error", func(t *testing.T) {
+		if _, err := ParseDistributions([][]string{{"Ex-Date", "Pay Date"}, {"15 Jul 2024", "31 Jul 2024"}}); err == nil {
+			t.Error("Expected an error for a table without an amount column")
+		}
+	})
+
+	t.Run("Testing distributions are saved next to the prices", func(t *testing.T) {
+		dir := t.TempDir()
+		if path := DistributionsPath(dir, database.Fund{Fundname: "AB/C Fund"}); path != dir+"/ABC Fund_distributions.csv" {
+			t.Fatalf("Unexpected distributions path %s", path)
+		}
+		path := DistributionsPath(dir, database.Fund{Fundname: "AB/C Fund", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"})
+		if path != dir+"/ACM019_distributions.csv" {
+			t.Fatalf("Unexpected distributions path %s", path)
+		}
+		exDate, _ := time.Parse(time.DateOnly, "2024-07-15")
+		if err := WriteDistributions(path, []database.Distribution{{ExDate: exDate, Amount: 0.0512, Currency: "USD", Type: "Dividend"}}); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(path)
+		want := "Ex Date,Pay Date,Amount,Currency,Type\n2024-07-15,,0.0512,USD,Dividend\n"
+		if string(data) != want {
+			t.Errorf("Expected %q, got %q", want, data)
+		}
+	})
+}
+
+func TestAllocations(t *testing.T) {
+	asOf := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Testing holdings and weights are read from their tables", func(t *testing.T) {
+		allocations := ParseAllocations(database.AllocationHolding, asOf, [][]string{
+			{"Holding", "Sector", "% of Assets"},
+			{"Microsoft  Corp", "Technology", "7.85%"},
+			{"NVIDIA Corp", "Technology", "6.1 %"},
+			{"Total", ""},
+		})
+		want := []database.Allocation{
+			{AsOf: asOf, Kind: database.AllocationHolding, Name: "Microsoft Corp", Weight: 7.85},
+			{AsOf: asOf, Kind: database.AllocationHolding, Name: "NVIDIA Corp", Weight: 6.1},
+		}
+		if !reflect.DeepEqual(allocations, want) {
+			t.Fatalf("Expected %+v, got %+v", want, allocations)
+		}
+	})
+
+	t.Run("Testing the as-of date is found in its label", func(t *testing.T) {
+		for text, want := range map[string]string{
+			"As of 31 May 2024":                      "2024-05-31",
+			"As at 2024-05-31 (Source: Morningstar)": "2024-05-31",
+			"Data as of 31/05/2024":                  "2024-05-31",
+		} {
+			date, ok := ParseAsOf(text)
+			if !ok || date.Format(time.DateOnly) != want {
+				t.Errorf("Expected %s from %q, got %s", want, text, date)
+			}
+		}
+		if _, ok := ParseAsOf("As of 31"); ok {
+			t.Error("Expected no date in a label with only a day")
+		}
+	})
+}
+
+func TestCrawler(t *testing.T) {
+	t.Run("Testing listed funds are read from their factsheet links", func(t *testing.T) {
+		fund, ok := NewListedFund(" AB FCP I\n Global Equity Blend ", "/fsmone/funds/factsheet/ACM019")
+		want := ListedFund{Name: "AB FCP I Global Equity Blend", Code: "ACM019", Link: FSMsite + "/fsmone/funds/factsheet/ACM019"}
+		if !ok || fund != want {
+			t.Fatalf("Expected %+v, got %+v", want, fund)
+		}
+		if _, ok := NewListedFund("Compare", "/fsmone/tools/fund-compare"); ok {
+			t.Error("Expected a link that is not to a factsheet to be skipped")
+		}
+	})
+
+	t.Run("Testing every listing page is read until Next is disabled", func(t *testing.T) {
+		browser := rod.New().MustConnect()
+		defer browser.MustClose()
+		page := browser.MustPage()
+		page.MustSetDocumentContent(`<html><body>
+<div id="list"></div>
+<button aria-label="Next page">Next</button>
+<script>
+const pages = [["AAA001", "BBB002"], ["CCC003"]];
+let current = 0;
+function show() {
+	document.getElementById("list").innerHTML = pages[current].map(c => '<a href="/fsmone/funds/factsheet/' + c + '">Fund ' + c + '</a>').join("");
+	if (current == pages.length - 1) document.querySelector("button").disabled = true;
+}
+document.querySelector("button").onclick = () => { current++; setTimeout(show, 300); };
+show();
+</script>
+</body></html>`)
+
+		crawler := NewCrawler(config.Crawl{PageTimeout: 5 * time.Second})
+		funds, err := crawler.crawlPages(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var codes []string
+		for _, fund := range funds {
+			codes = append(codes, fund.Code)
+		}
+		if !reflect.DeepEqual(codes, []string{"AAA001", "BBB002", "CCC003"}) {
+			t.Fatalf("Expected the funds of both pages, got %v", codes)
+		}
+	})
+}
+
+func TestResolver(t *testing.T) {
+	cfg := config.Default().Links
+	results := func(names ...string) []ListedFund {
+		var listed []ListedFund
+		for i, name := range names {
+			fund, _ := NewListedFund(name, fmt.Sprintf("/fsmone/funds/factsheet/F%03d", i))
+			listed = append(listed, fund)
+		}
+		return listed
+	}
+
+	t.Run("Testing names are compared without case, apostrophes and punctuation", func(t *testing.T) {
+		if got := NormaliseName("Schroder's ISF - Asian Bond (Acc) & Income"); got != "schroders isf asian bond acc and income" {
+			t.Errorf("Unexpected normalised name %q", got)
+		}
+		if score := MatchScore("Schroder's Asian Bond", "SCHRODERS ASIAN BOND"); score != 1 {
+			t.Errorf("Expected names differing in case and apostrophes to score 1, got %.2f", score)
+		}
+	})
+
+	t.Run("Testing the same name is picked over a share class sharing its prefix", func(t *testing.T) {
+		ranked := RankResults("AB FCP I Global Equity Blend A SGD", results("AB FCP I Global Equity Blend A USD", "AB FCP I Global Equity Blend A SGD"))
+		best, err := PickResult("AB FCP I Global Equity Blend A SGD", ranked, cfg)
+		if err != nil || best.Code != "F001" {
+			t.Fatalf("Expected the A SGD class, got %+v, %v", best, err)
+		}
+	})
+
+	t.Run("Testing a lone result containing the name is confident", func(t *testing.T) {
+		ranked := RankResults("AB FCP I Global Equity Blend", results("AB FCP I Global Equity Blend A SGD", "Allianz Income and Growth"))
+		if _, err := PickResult("AB FCP I Global Equity Blend", ranked, cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Testing share classes matching equally are ambiguous", func(t *testing.T) {
+		ranked := RankResults("AB FCP I Global Equity Blend", results("AB FCP I Global Equity Blend A SGD", "AB FCP I Global Equity Blend A USD"))
+		_, err := PickResult("AB FCP I Global Equity Blend", ranked, cfg)
+		var ambiguous *AmbiguousLinkError
+		if !errors.As(err, &ambiguous) || len(ambiguous.Candidates) != 2 {
+			t.Fatalf("Expected an AmbiguousLinkError with both classes, got %v", err)
+		}
+	})
+
+	t.Run("Testing a poor match is not used", func(t *testing.T) {
+		ranked := RankResults("United Asian Bond", results("Allianz Income and Growth"))
+		var ambiguous *AmbiguousLinkError
+		if _, err := PickResult("United Asian Bond", ranked, cfg); !errors.As(err, &ambiguous) {
+			t.Fatalf("Expected an AmbiguousLinkError, got %v", err)
+		}
+	})
+
+	t.Run("Testing only close names on a fund page are taken as renames", func(t *testing.T) {
+		fund := database.Fund{Fundname: "AB American Income A2 USD", Link: "/fsmone/funds/factsheet/ACM019"}
+		if !IsRename(fund, "AB American Income Portfolio A2 USD", cfg) {
+			t.Error("Expected a name with a word added to be a rename")
+		}
+		if IsRename(fund, "Allianz Income and Growth AM USD", cfg) {
+			t.Error("Expected the page of another fund not to be a rename")
+		}
+		if IsRename(database.Fund{Fundname: fund.Fundname, Link: "link1"}, "AB American Income Portfolio A2 USD", cfg) {
+			t.Error("Expected a fund without a code not to be renamed")
+		}
+	})
+
+	t.Run("Testing search results are read for names with apostrophes", func(t *testing.T) {
+		browser := rod.New().MustConnect()
+		defer browser.MustClose()
+		page := browser.MustPage()
+		page.MustSetDocumentContent(`<html><body>
+<input placeholder="Search">
+<a href="/fsmone/funds/factsheet/SCH001"><span>Schroder's Asian Bond A Acc</span></a>
+<a href="/fsmone/funds/factsheet/SCH002"><span>Schroder's Asian Bond A Dis</span></a>
+</body></html>`)
+
+		link, err := FindFundLink(context.Background(), "Schroders Asian Bond A Dis", page, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link != FSMsite+"/fsmone/funds/factsheet/SCH002" {
+			t.Fatalf("Expected the Dis class, got %s", link)
+		}
+	})
+}
+
+func TestRanges(t *testing.T) {
+	now := time.Date(2024, 8, 23, 19, 0, 0, 0, time.UTC)
+
+	t.Run("Testing presets and custom dates are parsed", func(t *testing.T) {
+		assertRange(t, "", "3M")
+		assertRange(t, "ytd", "YTD")
+		assertRange(t, "10Y", "10Y")
+		assertRange(t, "2020-01-01..2024-06-30", "2020-01-01..2024-06-30")
+		assertRange(t, "2020-01-01..", "2020-01-01..")
+
+		for _, bad := range []string{"2W", "2024-06-30..2020-01-01", "2020-13-01.."} {
+			if _, err := ParseRange(bad); err == nil {
+				t.Errorf("Expected an error for range %s", bad)
+			}
+		}
+	})
+
+	t.Run("Testing custom dates run to today without an end", func(t *testing.T) {
+		rng, _ := ParseRange("2024-01-15..")
+		from, to := rng.Dates(now)
+		if from.Format(time.DateOnly) != "2024-01-15" || !to.Equal(now) {
+			t.Errorf("Expected 2024-01-15 to now, got %s to %s", from, to)
+		}
+		if preset := rng.ChartPreset(now); preset != "YTD" {
+			t.Errorf("Expected YTD on the chart for a range from 2024-01-15, got %s", preset)
+		}
+	})
+
+	t.Run("Testing the smallest preset covering the gap is chosen", func(t *testing.T) {
+		for since, want := range map[string]string{
+			"2024-08-20": "1M",
+			"2024-06-01": "3M",
+			"2024-03-01": "6M",
+			"2024-01-10": "YTD",
+			"2023-12-01": "1Y",
+			"2022-01-01": "3Y",
+			"2020-01-01": "5Y",
+			"2001-01-01": "10Y",
+		} {
+			date, _ := time.Parse(time.DateOnly, since)
+			if got := CoveringRange(date, now).Preset; got != want {
+				t.Errorf("Expected %s to cover %s, got %s", want, since, got)
+			}
+		}
+
+		// In the first days of the year YTD is smaller than 1M
+		jan := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+		if got := CoveringRange(time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), jan).Preset; got != "YTD" {
+			t.Errorf("Expected YTD to cover 2025-01-02 on 2025-01-10, got %s", got)
+		}
+	})
+}
+
+func TestExportEndpoint(t *testing.T) {
+	t.Run("Testing fund codes are read from factsheet links", func(t *testing.T) {
+		for link, want := range map[string]string{
+			"https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019":  "ACM019",
+			"https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019/": "ACM019",
+			"https://secure.fundsupermart.com/fsmone/tools/fund-selector":     "",
+		} {
+			if got := FundCode(link); got != want {
+				t.Errorf("Expected code %q for %s, got %q", want, link, got)
+			}
+		}
+	})
+
+	t.Run("Testing the code and date range are learned from a query", func(t *testing.T) {
+		endpoint, err := LearnEndpoint(CapturedRequest{
+			Method:  "GET",
+			URL:     "https://secure.fundsupermart.com/fsmone/rest/fund/prices/export?endDate=23%2F08%2F2024&fundCode=ACM019&startDate=23%2F05%2F2024",
+			Headers: map[string]string{"Accept": "text/csv", "Cookie": "JSESSIONID=abc"},
+		}, "ACM019")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "https://secure.fundsupermart.com/fsmone/rest/fund/prices/export?endDate={to}&fundCode={code}&startDate={from}"
+		if endpoint.URL != want || endpoint.DateLayout != "02/01/2006" {
+			t.Fatalf("Expected %s with dd/mm/yyyy dates, got %s with %s", want, endpoint.URL, endpoint.DateLayout)
+		}
+		if _, ok := endpoint.Headers["Cookie"]; ok {
+			t.Error("Expected cookies to be left out of the learned headers")
+		}
+	})
+
+	t.Run("Testing the code and date range are learned from a JSON body", func(t *testing.T) {
+		endpoint, err := LearnEndpoint(CapturedRequest{
+			Method: "POST",
+			URL:    "https://secure.fundsupermart.com/fsmone/rest/fund/prices",
+			Body:   `{"code":"ACM019","from":1716422400000,"to":1724371200000}`,
+		}, "ACM019")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint.Body != `{"code":"{code}","from":{from},"to":{to}}` || endpoint.DateLayout != unixMillis {
+			t.Fatalf("Unexpected endpoint %+v", endpoint)
+		}
+	})
+
+	t.Run("Testing prices are fetched from a stand in endpoint with the login cookies", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "ok" {
+				http.Redirect(w, r, "/fsm/account/login", http.StatusFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			fmt.Fprintf(w, "Date,%s\n%s,1.01\n%s,1.02\n", r.FormValue("fundCode"), r.FormValue("startDate"), r.FormValue("endDate"))
+		}))
+		defer server.Close()
+
+		endpoint, err := LearnEndpoint(CapturedRequest{Method: "GET", URL: server.URL + "/export?fundCode=ACM019&startDate=2024-05-23&endDate=2024-08-23"}, "ACM019")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "endpoint.json")
+		if err := SaveEndpoint(path, endpoint); err != nil {
+			t.Fatal(err)
+		}
+		if endpoint, err = LoadEndpoint(path); err != nil {
+			t.Fatal(err)
+		}
+
+		from, to := time.Date(2014, 8, 23, 0, 0, 0, 0, time.UTC), time.Date(2024, 8, 23, 0, 0, 0, 0, time.UTC)
+		cookies := []*proto.NetworkCookie{{Name: "session", Value: "ok", Domain: "127.0.0.1"}, {Name: "other", Value: "x", Domain: "example.com"}}
+		data, err := FetchExport(context.Background(), server.Client(), endpoint, cookies, "CIT001", from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Date,CIT001\n2014-08-23,1.01\n2024-08-23,1.02\n"; string(data) != want {
+			t.Fatalf("Expected %q, got %q", want, data)
+		}
+
+		if _, err := FetchExport(context.Background(), server.Client(), endpoint, nil, "CIT001", from, to); err == nil {
+			t.Fatal("Expected an error when the endpoint redirects to the login page")
+		}
+	})
+}
+
+func TestDirectExport(t *testing.T) {
+	server := httptest.NewServer(fakeFundSite(0))
+	defer server.Close()
+
+	browser, downloads := initialiseDownloadBrowser(t)
+	defer browser.MustClose()
+	defer downloads.Close()
+
+	session := &Session{Browser: browser, Pool: rod.NewPagePool(2), Conc: &ConcBrowser{Browser: browser, Downloads: downloads}}
+	defer session.Pool.Cleanup(session.Conc.closeWorker)
+	endpointPath := filepath.Join(t.TempDir(), "endpoint.json")
+	if err := session.UseExport(config.Export{Mode: "direct", Endpoint: endpointPath, Timeout: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Testing the export endpoint is learned from the first fund and used for the next", func(t *testing.T) {
+		dir := t.TempDir()
+		funds := fakeFunds(server.URL, 2)
+		for _, fund := range funds {
+			if _, err := session.Scrape(context.Background(), fund, Range{Preset: DefaultPreset}, dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		endpoint, err := LoadEndpoint(endpointPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(endpoint.URL, "fundCode={code}") || !strings.Contains(endpoint.URL, "startDate={from}") {
+			t.Fatalf("Unexpected learned endpoint %s", endpoint.URL)
+		}
+
+		data, err := os.ReadFile(DownloadPath(dir, funds[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), "Date,Fake Fund 2") {
+			t.Fatalf("Unexpected direct download %q", data)
+		}
+	})
+}
+
+// BenchmarkDownloads compares exporting 10 funds one page at a time with 5 pages at once, from a fake site whose
+// exports take 200ms
+func BenchmarkDownloads(b *testing.B) {
+	server := httptest.NewServer(fakeFundSite(200 * time.Millisecond))
+	defer server.Close()
+
+	browser, downloads := initialiseDownloadBrowser(b)
+	defer browser.MustClose()
+	defer downloads.Close()
+
+	funds := fakeFunds(server.URL, 10)
+	for _, pages := range []int{1, 5} {
+		b.Run(fmt.Sprintf("%d pages", pages), func(b *testing.B) {
+			dir := b.TempDir()
+			for i := 0; i < b.N; i++ {
+				if err := scrapeAll(browser, downloads, funds, pages, dir); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func initialiseDownloadBrowser(t testing.TB) (*rod.Browser, *Downloads) {
+	t.Helper()
+
+	browser, l, err := InitialiseBrowser(config.Browser{DownloadDir: t.TempDir(), Headless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Cleanup)
+
+	downloads, err := WatchDownloads(browser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return browser, downloads
+}
+
+// scrapeAll downloads funds with a pool of pages pages, returning the first error
+func scrapeAll(browser *rod.Browser, downloads *Downloads, funds []database.Fund, pages int, dir string) error {
+	pool := rod.NewPagePool(pages)
+	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
+	c := &ConcBrowser{Browser: browser, Downloads: downloads}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(funds))
+	for _, fund := range funds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ScrapeFSM(context.Background(), fund, browser, &pool, nil, nil, nil, nil, c, Range{Preset: DefaultPreset}, dir)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fakeFunds(url string, n int) []database.Fund {
+	var funds []database.Fund
+	for i := 1; i <= n; i++ {
+		funds = append(funds, database.Fund{Fundname: fmt.Sprintf("Fake Fund %d", i), Link: fmt.Sprintf("%s/fsmone/funds/factsheet/FAKE%d", url, i)})
+	}
+	return funds
+}
+
+// fakeFundSite serves fund pages laid out like FSM factsheets at /fsmone/funds/factsheet/FAKE<n>, whose Export link
+// downloads the last 3 months of prices as a CSV from /api/export after delay
+func fakeFundSite(delay time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fsmone/funds/factsheet/{code}", func(w http.ResponseWriter, r *http.Request) {
+		n, ok := strings.CutPrefix(r.PathValue("code"), "FAKE")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		to := time.Now()
+		fmt.Fprintf(w, `<html><body>
+<div class="flex flex-col items-start"><div><div>Fake Fund %s</div></div></div>
+<span>Price</span>
+<a href="/api/export?fundCode=FAKE%s&startDate=%s&endDate=%s"><span>Export</span></a>
+</body></html>`, n, n, to.AddDate(0, -3, 0).Format(time.DateOnly), to.Format(time.DateOnly))
+	})
+	mux.HandleFunc("/api/export", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		code := r.FormValue("fundCode")
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", code))
+		fmt.Fprintf(w, "Date,Fake Fund %s\n%s,1.01\n%s,1.02\n", strings.TrimPrefix(code, "FAKE"), r.FormValue("startDate"), r.FormValue("endDate"))
+	})
+	return mux
+}
+
+func assertLoggedIn(t testing.TB, page *rod.Page, cfg config.Login, want bool) {
+	t.Helper()
+
+	got, err := LoggedIn(context.Background(), page, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("Expected logged in to be %v, got %v", want, got)
+	}
+}
+
+func assertRange(t testing.TB, s, want string) {
+	t.Helper()
+
+	rng, err := ParseRange(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng.String() != want {
+		t.Errorf("Expected range %q to be %s, got %s", s, want, rng)
+	}
+}
+
+func assertBlocks(t testing.TB, blocker *Blocker, typ proto.NetworkResourceType, url string, want bool) {
+	t.Helper()
+
+	if got := blocker.Blocks(typ, url); got != want {
+		t.Errorf("Expected blocking %s %s to be %v", typ, url, want)
+	}
+}
+
+func assertCredentials(t testing.TB, creds Credentials, username, password string) {
+	t.Helper()
+
+	if creds.Username != username || creds.Password != password {
+		t.Fatalf("Expected %s/%s, got %s/%s", username, password, creds.Username, creds.Password)
+	}
+}
+
+// mockLoginSite serves a login form at /fsm/account/login like FSM's, redirecting to /fsm/account/dashboard when the
+// username and password match and showing an error otherwise. The dashboard redirects back to the login page without
+// the session cookie.
+func mockLoginSite(username, password string) http.Handler {
+	form := `<html><body>
+<form method="post" action="/fsm/account/login">
+<div class="error" style="display:none"></div>
+%s
+<input id="username" name="username">
+<input type="password" name="password">
+<button type="submit">Log in</button>
+</form>
+</body></html>`
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fsm/account/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			fmt.Fprintf(w, form, "")
+			return
+		}
+		if r.FormValue("username") == username && r.FormValue("password") == password {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "ok", Path: "/"})
+			http.Redirect(w, r, "/fsm/account/dashboard", http.StatusSeeOther)
+			return
+		}
+		fmt.Fprintf(w, form, `<div class="alert-danger">Invalid username or password</div>`)
+	})
+	mux.HandleFunc("/fsm/account/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "ok" {
+			http.Redirect(w, r, "/fsm/account/login", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, `<html><body><div id="account">My account</div></body></html>`)
+	})
+	return mux
+}
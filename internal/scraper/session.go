@@ -0,0 +1,207 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"scraper/internal/config"
+	"scraper/internal/database"
+	"scraper/internal/scraper/persiststate"
+	"sync"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/launcher"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// Session is a browser logged in to FSM with the page pool downloads share. The daemon keeps one open across runs so
+// the user only logs in once.
+type Session struct {
+	Browser *rod.Browser
+	Pool    rod.Pool[rod.Page]
+	Conc    *ConcBrowser
+
+	PageCookies    []*proto.NetworkCookie
+	BrowserCookies []*proto.NetworkCookie
+	SessionStorage persiststate.StorageData
+	LocalStorage   persiststate.StorageData
+
+	export   config.Export
+	endpoint *ExportEndpoint //request behind the Export button, once learned in direct mode
+	exportMu sync.Mutex
+	client   *http.Client
+
+	captured time.Time //when the login was captured, by this run or a saved one
+	login    config.Login
+	store    *persiststate.Store
+	launcher *launcher.Launcher
+}
+
+// Login launches a browser and logs in to FSM. A session saved by an earlier run is restored if it has not expired,
+// otherwise the user logs in or the login form is filled as set in login, and the new session is saved.
+func Login(ctx context.Context, cfg config.Browser, login config.Login) (*Session, error) {
+	store, err := openStore(login)
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := loadSaved(store, login.SessionMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	if saved == nil && cfg.Headless && login.Mode != "auto" {
+		return nil, errors.New("a headless browser cannot be logged in to by hand, set login.mode to auto or browser.headless to false")
+	}
+
+	browser, l, err := InitialiseBrowser(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	downloads, err := WatchDownloads(browser)
+	if err != nil {
+		browser.Close()
+		l.Cleanup()
+		return nil, err
+	}
+
+	var blocker *Blocker
+	if cfg.Block.Enabled {
+		if blocker, err = NewBlocker(cfg.Block); err != nil {
+			downloads.Close()
+			browser.Close()
+			l.Cleanup()
+			return nil, err
+		}
+	}
+
+	s := &Session{
+		Browser:  browser,
+		Pool:     rod.NewPagePool(cfg.PoolLimit),
+		Conc:     &ConcBrowser{Browser: browser, Downloads: downloads, Blocker: blocker, Match: config.Default().Links},
+		login:    login,
+		store:    store,
+		launcher: l,
+	}
+
+	if saved != nil {
+		if err := s.restore(ctx, saved); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+
+	s.PageCookies, s.BrowserCookies, s.SessionStorage, s.LocalStorage, err = LoginSteps(ctx, &s.Pool, browser, login)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.save()
+	//the login page was put back in the pool, workers get their own contexts
+	if err := s.Conc.resetPool(ctx, s.Pool); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openStore returns the store for saved sessions, or nil if no passphrase or key file is set
+func openStore(login config.Login) (*persiststate.Store, error) {
+	if login.SessionFile == "" || (login.Passphrase == "" && login.KeyFile == "") {
+		return nil, nil
+	}
+	return persiststate.NewStore(login.SessionFile, login.Passphrase, login.KeyFile)
+}
+
+// loadSaved returns the saved session if there is one that has not expired
+func loadSaved(store *persiststate.Store, maxAge time.Duration) (*persiststate.Saved, error) {
+	if store == nil {
+		return nil, nil
+	}
+
+	saved, err := store.Load()
+	switch {
+	case errors.Is(err, persiststate.ErrNoSession):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case saved.Expired(time.Now(), maxAge):
+		log.Printf("Saved session from %s has expired, logging in again", saved.Captured.Format("2006-01-02 15:04"))
+		return nil, nil
+	}
+
+	log.Printf("Reusing session saved at %s", saved.Captured.Format("2006-01-02 15:04"))
+	return saved, nil
+}
+
+// restore puts a saved session's cookies and storage into the browser
+func (s *Session) restore(ctx context.Context, saved *persiststate.Saved) error {
+	page, err := s.Browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return step("", "create login page", err)
+	}
+	defer page.Close()
+	page = page.Context(ctx)
+
+	//Storage belongs to the site, so it can only be set once a page of the site is open
+	err = rod.Try(func() {
+		page.MustNavigate(FSMfundSelectorSite).MustWaitLoad()
+		s.Browser.Context(ctx).MustSetCookies(saved.BrowserCookies...)
+		persiststate.SetSessionData(page, saved.PageCookies, saved.SessionStorage, saved.LocalStorage)
+		page.MustReload().MustWaitLoad()
+	})
+	if err != nil {
+		return step("", "restore saved session", err)
+	}
+
+	s.PageCookies, s.BrowserCookies = saved.PageCookies, saved.BrowserCookies
+	s.SessionStorage, s.LocalStorage = saved.SessionStorage, saved.LocalStorage
+	s.captured = saved.Captured
+	return nil
+}
+
+// save writes the session to the store so the next run can reuse it. Failing to save only costs a login next time.
+func (s *Session) save() {
+	s.captured = time.Now()
+	if s.store == nil {
+		return
+	}
+
+	err := s.store.Save(&persiststate.Saved{
+		PageCookies:    s.PageCookies,
+		BrowserCookies: s.BrowserCookies,
+		SessionStorage: s.SessionStorage,
+		LocalStorage:   s.LocalStorage,
+		Captured:       s.captured,
+	})
+	if err != nil {
+		log.Printf("Could not save session: %v", err)
+		return
+	}
+	log.Printf("Session saved to %s", s.store.Path)
+}
+
+// Scrape downloads the prices in rng of fund into downloadFolderPath with a page from the session's pool, or straight from
+// the export endpoint in direct export mode. The factsheet is only read when the fund page is opened, otherwise it is nil.
+func (s *Session) Scrape(ctx context.Context, fund database.Fund, rng Range, downloadFolderPath string) (*Factsheet, error) {
+	s.exportMu.Lock()
+	direct := s.export.Mode == "direct"
+	s.exportMu.Unlock()
+	if code := FundCode(fund.Link); direct && code != "" {
+		return s.directExport(ctx, fund, code, rng, downloadFolderPath)
+	}
+
+	return ScrapeFSM(ctx, fund, s.Browser, &s.Pool, s.PageCookies, s.BrowserCookies, s.SessionStorage, s.LocalStorage, s.Conc, rng, downloadFolderPath)
+}
+
+// Close closes the pages and the browser
+func (s *Session) Close() {
+	s.Pool.Cleanup(s.Conc.closeWorker)
+	s.Conc.Downloads.Close()
+	s.Browser.Close()
+	s.launcher.Cleanup()
+}
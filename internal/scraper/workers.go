@@ -0,0 +1,99 @@
+package scraper
+
+import (
+	"context"
+	"log"
+	"scraper/internal/scraper/persiststate"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// newWorker opens a page in its own incognito context, so workers do not share cookies or storage, and seeds it with
+// the login state captured by LoginSteps. Its downloads are followed by c.Downloads and its requests filtered by
+// c.Blocker.
+func (c *ConcBrowser) newWorker(pageCookies, browserCookies []*proto.NetworkCookie, sessionStorage, localStorage persiststate.StorageData) (*rod.Page, error) {
+	incognito, err := c.Browser.Incognito()
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := seedWorker(incognito, c.Downloads, pageCookies, browserCookies, sessionStorage, localStorage)
+	if err != nil {
+		incognito.Close()
+		return nil, err
+	}
+	if err := c.Blocker.Attach(page); err != nil {
+		c.closeWorker(page)
+		return nil, err
+	}
+	return page, nil
+}
+
+func seedWorker(incognito *rod.Browser, downloads *Downloads, pageCookies, browserCookies []*proto.NetworkCookie, sessionStorage, localStorage persiststate.StorageData) (*rod.Page, error) {
+	if downloads != nil {
+		if err := downloads.Allow(incognito); err != nil {
+			return nil, err
+		}
+	}
+	if len(browserCookies) != 0 {
+		if err := incognito.SetCookies(proto.CookiesToParams(browserCookies)); err != nil {
+			return nil, err
+		}
+	}
+
+	page, err := incognito.Page(proto.TargetCreateTarget{})
+	if err != nil || (len(pageCookies) == 0 && len(sessionStorage) == 0 && len(localStorage) == 0) {
+		return page, err
+	}
+
+	//Storage belongs to the site, so it can only be set once a page of the site is open
+	err = rod.Try(func() {
+		page.MustNavigate(FSMfundSelectorSite).MustWaitLoad()
+		persiststate.SetSessionData(page, pageCookies, sessionStorage, localStorage)
+	})
+	return page, err
+}
+
+// closeWorker closes page along with its incognito context
+func (c *ConcBrowser) closeWorker(page *rod.Page) {
+	c.Blocker.Detach(page)
+	page.Close()
+	if browser := page.Browser(); browser.BrowserContextID != "" {
+		if err := browser.Close(); err != nil {
+			log.Printf("Could not close worker context: %v", err)
+		}
+	}
+}
+
+// recycleWorker replaces a worker that failed with an empty slot in pool, so the next fund gets a fresh context seeded
+// with the same login state instead of one left in an unknown state
+func (c *ConcBrowser) recycleWorker(pool *rod.Pool[rod.Page], page *rod.Page) {
+	c.closeWorker(page)
+	pool.Put(nil)
+}
+
+// resetPool closes every worker in pool and leaves their slots empty, so the next Get creates a new one. It takes every
+// slot before putting any back, so it waits for workers in use to be put back and no Get can take a slot meanwhile.
+// If ctx is done first the slots taken so far are left empty and ctx's error is returned.
+func (c *ConcBrowser) resetPool(ctx context.Context, pool rod.Pool[rod.Page]) error {
+	taken := 0
+	defer func() {
+		for ; taken > 0; taken-- {
+			pool.Put(nil)
+		}
+	}()
+
+	for taken < cap(pool) {
+		select {
+		case page := <-pool:
+			taken++
+			if page != nil {
+				c.closeWorker(page)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package selectors
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-rod/rod"
+)
+
+// Result is how one selector fared against the snapshot of its page
+type Result struct {
+	Name       string
+	Page       string
+	Matched    int    //index of the candidate found, -1 if none was
+	Candidate  string //the candidate found
+	NoSnapshot bool   //there is no saved snapshot of the page to check against
+}
+
+func (r Result) String() string {
+	switch {
+	case r.NoSnapshot:
+		return fmt.Sprintf("NO SNAPSHOT  %s (%s.html)", r.Name, r.Page)
+	case r.Matched < 0:
+		return fmt.Sprintf("MISSING      %s (%s)", r.Name, r.Page)
+	case r.Matched > 0:
+		return fmt.Sprintf("FALLBACK     %s (%s) candidate %d: %s", r.Name, r.Page, r.Matched+1, r.Candidate)
+	default:
+		return fmt.Sprintf("OK           %s (%s)", r.Name, r.Page)
+	}
+}
+
+// Check loads the saved HTML snapshot <page>.html in dir for every page the selectors name into page, and reports
+// which candidate of each selector is found on it
+func (r *Registry) Check(page *rod.Page, dir string) ([]Result, error) {
+	byPage := map[string][]string{}
+	for _, name := range r.Names() {
+		sel := r.Selectors[name]
+		byPage[sel.Page] = append(byPage[sel.Page], name)
+	}
+	pages := make([]string, 0, len(byPage))
+	for p := range byPage {
+		pages = append(pages, p)
+	}
+	sort.Strings(pages)
+
+	var results []Result
+	for _, pageName := range pages {
+		html, err := os.ReadFile(filepath.Join(dir, pageName+".html"))
+		if errors.Is(err, os.ErrNotExist) {
+			for _, name := range byPage[pageName] {
+				results = append(results, Result{Name: name, Page: pageName, Matched: -1, NoSnapshot: true})
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read snapshot: %w", err)
+		}
+
+		if err := page.SetDocumentContent(string(html)); err != nil {
+			return nil, fmt.Errorf("could not load snapshot %s: %w", pageName, err)
+		}
+		for _, name := range byPage[pageName] {
+			results = append(results, r.check(page, name))
+		}
+	}
+
+	return results, nil
+}
+
+func (r *Registry) check(page *rod.Page, name string) Result {
+	sel := r.Selectors[name]
+	result := Result{Name: name, Page: sel.Page, Matched: -1}
+
+	var candidates []string
+	if sel.Example != "" {
+		candidates, _ = r.Candidates(name, sel.Example)
+	} else {
+		candidates, _ = r.Candidates(name)
+	}
+	if _, i := First(page, candidates); i >= 0 {
+		result.Matched, result.Candidate = i, candidates[i]
+	}
+	return result
+}
@@ -0,0 +1,182 @@
+package selectors
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-rod/rod"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the selector file version this build understands
+const Version = 1
+
+//go:embed default.yaml
+var defaultFile []byte
+
+// Selector finds one element with ordered fallback candidates
+type Selector struct {
+	Page       string   `yaml:"page"`    //snapshot the selector is checked against
+	Example    string   `yaml:"example"` //filled into %s when checking snapshots
+	Candidates []string `yaml:"candidates"`
+}
+
+// Registry holds every selector by name
+type Registry struct {
+	Version   int                 `yaml:"version"`
+	Selectors map[string]Selector `yaml:"selectors"`
+}
+
+// Default returns the selectors built into the scraper
+func Default() *Registry {
+	r, err := parse(defaultFile)
+	if err != nil {
+		panic(fmt.Sprintf("built in selectors are invalid: %v", err))
+	}
+	return r
+}
+
+// Load returns the built in selectors with those in the file at path replacing them by name. A missing file leaves the
+// built in selectors as they are.
+func Load(path string) (*Registry, error) {
+	r := Default()
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening selectors: %w", err)
+	}
+
+	override, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading selectors %s: %w", path, err)
+	}
+	for name, sel := range override.Selectors {
+		r.Selectors[name] = sel
+	}
+	r.Version = override.Version
+	return r, nil
+}
+
+func parse(data []byte) (*Registry, error) {
+	var r Registry
+	if err := yaml.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.Version != Version {
+		return nil, fmt.Errorf("selectors are version %d, this scraper reads version %d", r.Version, Version)
+	}
+	for name, sel := range r.Selectors {
+		if len(sel.Candidates) == 0 {
+			return nil, fmt.Errorf("selector %s has no candidates", name)
+		}
+	}
+	return &r, nil
+}
+
+// Names returns the selector names in order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.Selectors))
+	for name := range r.Selectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Candidates returns the candidates of the named selector with args filled in
+func (r *Registry) Candidates(name string, args ...any) ([]string, error) {
+	sel, ok := r.Selectors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown selector %s", name)
+	}
+	if len(args) == 0 {
+		return sel.Candidates, nil
+	}
+
+	candidates := make([]string, len(sel.Candidates))
+	for i, c := range sel.Candidates {
+		candidates[i] = c
+		if strings.Contains(c, "%s") {
+			candidates[i] = fmt.Sprintf(c, args...)
+		}
+	}
+	return candidates, nil
+}
+
+// Element waits for the named selector on page, using the first candidate found. Each poll tries the candidates in
+// order, so a fallback is only used while the preferred candidate is missing.
+func (r *Registry) Element(page *rod.Page, name string, args ...any) (*rod.Element, error) {
+	candidates, err := r.Candidates(name, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	el, err := page.Race().ElementFunc(func(p *rod.Page) (*rod.Element, error) {
+		el, i := First(p, candidates)
+		if el == nil {
+			return nil, &rod.ElementNotFoundError{}
+		}
+		if i > 0 {
+			log.Printf("Selector %s fell back to candidate %d: %s", name, i+1, candidates[i])
+		}
+		return el, nil
+	}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("selector %s: %w", name, err)
+	}
+	return el, nil
+}
+
+// Elements waits for the named selector on page like Element, and returns every element the candidate found matches
+func (r *Registry) Elements(page *rod.Page, name string, args ...any) (rod.Elements, error) {
+	candidates, err := r.Candidates(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Element(page, name, args...); err != nil {
+		return nil, err
+	}
+
+	for _, c := range candidates {
+		elements, err := find(page, c)
+		if err == nil && !elements.Empty() {
+			return elements, nil
+		}
+	}
+	return nil, fmt.Errorf("selector %s: %w", name, &rod.ElementNotFoundError{})
+}
+
+// First returns the element of the first candidate found on page without waiting, and the index of that candidate
+func First(page *rod.Page, candidates []string) (*rod.Element, int) {
+	for i, c := range candidates {
+		elements, err := find(page, c)
+		if err == nil && !elements.Empty() {
+			return elements.First(), i
+		}
+	}
+	return nil, -1
+}
+
+// find returns the elements matching candidate without waiting
+func find(page *rod.Page, candidate string) (rod.Elements, error) {
+	if IsXPath(candidate) {
+		return page.ElementsX(candidate)
+	}
+	return page.Elements(candidate)
+}
+
+// IsXPath reports whether a candidate is XPath rather than CSS
+func IsXPath(candidate string) bool {
+	return strings.HasPrefix(candidate, "/") || strings.HasPrefix(candidate, "(")
+}
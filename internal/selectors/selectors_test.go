@@ -0,0 +1,119 @@
+package selectors
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-rod/rod"
+)
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Testing built in selectors load without a file", func(t *testing.T) {
+		r, err := Load(filepath.Join(dir, "missing.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"search_bar", "search_result", "fund_title", "price_tab", "more_ranges", "range", "export_button"} {
+			if _, ok := r.Selectors[name]; !ok {
+				t.Errorf("Expected built in selector %s", name)
+			}
+		}
+	})
+
+	t.Run("Testing a selectors file replaces selectors by name", func(t *testing.T) {
+		path := filepath.Join(dir, "selectors.yaml")
+		writeFile(t, path, "version: 1\nselectors:\n  price_tab:\n    page: factsheet\n    candidates:\n      - button.price\n      - //span[text()='Prices']\n")
+
+		r, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertCandidates(t, r, "price_tab", nil, []string{"button.price", "//span[text()='Prices']"})
+		assertCandidates(t, r, "export_button", nil, Default().Selectors["export_button"].Candidates)
+	})
+
+	t.Run("Testing a selectors file of another version is rejected", func(t *testing.T) {
+		path := filepath.Join(dir, "v2.yaml")
+		writeFile(t, path, "version: 2\nselectors: {}\n")
+
+		if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "version 2") {
+			t.Fatalf("Expected a version error, got %v", err)
+		}
+	})
+
+	t.Run("Testing the fund name is filled into candidates", func(t *testing.T) {
+		r := Default()
+		r.Selectors["fund_link"] = Selector{Candidates: []string{"//span[contains(text(), '%s')]/..", "a.fund"}}
+		assertCandidates(t, r, "fund_link", []any{"AB FCP"}, []string{"//span[contains(text(), 'AB FCP')]/..", "a.fund"})
+	})
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "factsheet.html"), `<html><body>
+<div class="flex flex-col items-start"><div><div>AB FCP I Global Equity Blend</div></div></div>
+<span>Price</span>
+<button>Export CSV</button>
+</body></html>`)
+
+	browser := rod.New().MustConnect()
+	defer browser.MustClose()
+	page := browser.MustPage()
+
+	r := Default()
+	results, err := r.Check(page, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]Result{}
+	for _, result := range results {
+		got[result.Name] = result
+	}
+
+	t.Run("Testing selectors found by their first candidate", func(t *testing.T) {
+		if got["price_tab"].Matched != 0 || got["fund_title"].Matched != 0 {
+			t.Errorf("Expected price_tab and fund_title to match, got %+v %+v", got["price_tab"], got["fund_title"])
+		}
+	})
+
+	t.Run("Testing selectors found by a fallback", func(t *testing.T) {
+		if got["export_button"].Matched != 1 {
+			t.Errorf("Expected export_button to fall back to its second candidate, got %+v", got["export_button"])
+		}
+	})
+
+	t.Run("Testing missing selectors and pages without a snapshot", func(t *testing.T) {
+		if got["range"].Matched != -1 || got["range"].NoSnapshot {
+			t.Errorf("Expected range to be missing, got %+v", got["range"])
+		}
+		if !got["search_bar"].NoSnapshot {
+			t.Errorf("Expected search_bar to have no snapshot, got %+v", got["search_bar"])
+		}
+	})
+}
+
+func writeFile(t testing.TB, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertCandidates(t testing.TB, r *Registry, name string, args []any, want []string) {
+	t.Helper()
+
+	got, err := r.Candidates(name, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %s candidates %q, got %q", name, want, got)
+	}
+}
@@ -1,274 +1,311 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"scraper/internal/database"
+	"scraper/internal/journal"
 	"scraper/internal/local"
+	downloads "scraper/internal/local/downloads"
+	"scraper/internal/pipeline"
+	"scraper/internal/retry"
 	"scraper/internal/scraper"
-	"sync"
-
-	"github.com/go-rod/rod"
-)
-
-const DOWNLOAD_ONLY_FROM_PLANNING_EXCEL = true
-
-// shared settings
-const (
-	fullhist = false //false if only want 3 months of data, true if want full data on fsm website
-)
-
-// settings to download all funds data when download_only_from_planning_excel = true
-const (
-	planningRelativeFilepath = "Planning.xlsx"
-)
-
-// settings to download all funds data when download_only_from_planning_excel = false
-const (
-	tableName          = "funds"
-	batchsize          = 1000 //290 seems to be the max limit to download in 1 session, decreases over time
-	downloadWithinDays = 3
+	"syscall"
 )
 
 func main() {
-	if DOWNLOAD_ONLY_FROM_PLANNING_EXCEL == true {
-		main_local()
-	} else {
-		main_db()
+	ctx, cancel := notifyShutdown()
+	defer cancel()
+
+	if err := run(ctx, os.Args[1:], os.Stderr); err != nil {
+		log.Fatal(err)
 	}
 }
 
-func main_db() {
-	fundNames := local.GetAllFunds("export(1722502686274).xlsx")
-	// Set up scraping tools
-	browser, l := scraper.InitialiseBrowser()
-	defer l.Cleanup()
-
-	concBrowser := &scraper.ConcBrowser{Browser: browser}
-	browser = concBrowser.Browser
-	defer browser.MustClose()
-
-	pool := rod.NewPagePool(scraper.PoolLimit)
-	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
-
-	scraper.CloseBrowserOnForceExit(browser)
+// notifyShutdown returns a context that is cancelled on the first SIGINT or SIGTERM so the run can stop taking new
+// funds and finish cleanly. A second signal exits immediately.
+func notifyShutdown() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Printf("Received signal: %s, finishing funds in progress, send it again to exit immediately", sig)
+		cancel()
+	}()
+
+	return ctx, cancel
+}
 
-	db := database.ConnectDB()
+// newPipeline wires up the fund source, link store and sinks for s.source
+func newPipeline(ctx context.Context, s settings) (*pipeline.Pipeline, error) {
+	p := &pipeline.Pipeline{
+		Name:              s.source,
+		JournalDir:        s.cfg.Paths.Runs,
+		Resume:            s.resume,
+		Browser:           s.cfg.Browser,
+		Login:             s.cfg.Login,
+		Export:            s.cfg.Export,
+		Factsheet:         s.cfg.Factsheet,
+		Match:             s.cfg.Links,
+		Range:             s.priceRange,
+		FundRanges:        s.cfg.Scrape.FundRanges,
+		DownloadFolder:    s.downloadFolder,
+		GracePeriod:       s.cfg.Scrape.ShutdownGrace,
+		CheckSessionEvery: s.cfg.Scrape.CheckSessionEvery,
+		Retry:             retry.NewPolicy(s.cfg.Retry),
+		ReportDir:         filepath.Join(s.downloadFolder, "reports"),
+	}
 
-	// Get fund links to directly scrape from fund page
-	getFundLinksDB(db, fundNames, tableName)
-	log.Print("Fund links successfully obtained")
+	if p.Range == "" && s.fullhist {
+		p.Range = "10Y"
+	}
 
-	fundsNotDownloaded, err := database.FundsNotDownloadedWithinDays(db, tableName, downloadWithinDays)
+	failures, err := retry.OpenLedger(filepath.Join(s.cfg.Paths.Runs, "failures.json"), s.cfg.Retry.SkipAfterFailedRuns)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if s.includeBroken {
+		failures.SkipAfter = 0
+	}
+	p.Failures = failures
+	if s.cfg.Links.ReviewFile != "" {
+		p.Review = &pipeline.LinkReview{Path: s.cfg.Links.ReviewFile}
 	}
 
-	funds := fundsNotDownloaded[:min(batchsize, len(fundsNotDownloaded))]
-
-	pageCookies, browserCookies, sessionStorage, localStorage := scraper.LoginSteps(&pool, browser)
-
-	var wg sync.WaitGroup
-	wg.Add(len(funds))
-
-	for _, fund := range funds {
-		go func() {
-			defer wg.Done()
-			//Close browser if any panic warnings are thrown
-			defer func() {
-				if r := recover(); r != nil {
-					log.Fatalf("Panic: %v\n. ScrapeFSM function failed, exiting program", r)
-				}
-			}()
-
-			scraper.ScrapeFSM(fund, browser, &pool, pageCookies, browserCookies, sessionStorage, localStorage, concBrowser, fullhist, "data/downloaded")
-			database.UpdateLastDownloaded(db, tableName, fund.Fundname)
+	switch s.source {
+	case "planning":
+		p.Source = pipeline.ExcelSource{Path: s.planningPath, Sheet: "Planning"}
+		p.Links = &pipeline.ExcelLinks{Path: s.planningPath, Sheet: "Link", Listing: "Planning"}
+		p.Factsheets = append(p.Factsheets, &pipeline.ExcelFactsheets{Path: s.planningPath, InfoSheet: "Info", AllocationSheet: "Allocations"})
+		p.ClearFolder = true
+	case "universe":
+		db := s.db
+		if db == nil {
+			db, err = database.ConnectDB(ctx, s.cfg.Database)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.Source = pipeline.ExcelSource{Path: s.universePath}
+		if s.universePath == "" {
+			p.Source = pipeline.DBSource{DB: db, TableName: s.tableName}
+		}
+		p.Links = pipeline.DBLinks{DB: db, TableName: s.tableName}
+		p.Select = pipeline.StaleFunds{DB: db, TableName: s.tableName, Days: s.downloadWithinDays}
+		sink := pipeline.DBSink{DB: db, TableName: s.tableName}
+		p.Sinks = append(p.Sinks, sink)
+		p.Factsheets = append(p.Factsheets, sink)
+		p.Batchsize = s.batchsize
+	case "watchlist":
+		p.Source = pipeline.CSVSource{Path: s.watchlistPath}
+		if s.watchlistPath == "-" {
+			p.Source = pipeline.ListSource{Reader: os.Stdin}
+		}
+		p.Links = &pipeline.ExcelLinks{Path: s.planningPath, Sheet: "Link", Listing: "Planning"}
+	default:
+		return nil, fmt.Errorf("unknown source %s", s.source)
+	}
 
-			concBrowser.Counter++
-			log.Printf("%d/%d funds successfully downloaded, %d/%d total funds", concBrowser.Counter, batchsize, len(fundNames)-len(fundsNotDownloaded)+concBrowser.Counter, len(fundNames))
-		}()
+	if s.downloadLog != "" {
+		p.Sinks = append(p.Sinks, &pipeline.CSVSink{Path: s.downloadLog})
 	}
 
-	wg.Wait()
+	return p, nil
 }
 
-func main_local() {
-	fundNames := local.GetFundsOwned("Planning.xlsx")
-	// Set up scraping tools
-	browser, l := scraper.InitialiseBrowser()
-	defer l.Cleanup()
-
-	concBrowser := &scraper.ConcBrowser{Browser: browser}
-	browser = concBrowser.Browser
-	defer browser.MustClose()
-
-	pool := rod.NewPagePool(scraper.PoolLimit)
-	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
-
-	scraper.CloseBrowserOnForceExit(browser)
-
-	//db := database.ConnectDB()
-
-	// Get fund links to directly scrape from fund page
-	//funds := getFundLinks(db, fundNames, tableName)
-
-	local.ClearFolder("data/planning")
-
-	funds := getFundLinksLocal(planningRelativeFilepath, fundNames)
-	log.Print("Fund links successfully obtained")
-
-	pageCookies, browserCookies, sessionStorage, localStorage := scraper.LoginSteps(&pool, browser)
-
-	var wg sync.WaitGroup
-	wg.Add(len(fundNames))
-
-	for _, fund := range funds {
-		go func() {
-			defer wg.Done()
-			//Close browser if any panic warnings are thrown
-			defer func() {
-				if r := recover(); r != nil {
-					log.Fatalf("Panic: %v\n. ScrapeFSM function failed, exiting program", r)
-				}
-			}()
-
-			scraper.ScrapeFSM(fund, browser, &pool, pageCookies, browserCookies, sessionStorage, localStorage, concBrowser, fullhist, "data/planning")
-			concBrowser.Counter++
-			log.Printf("%d/%d funds successfully downloaded", concBrowser.Counter, len(fundNames))
-		}()
+// prepareStores creates the tables a scrape of s writes to and moves tables and sheets made before funds were keyed on
+// their codes to them. Only commands that write call it, so status and dry runs leave the user's schema alone.
+func prepareStores(ctx context.Context, s settings, p *pipeline.Pipeline) error {
+	switch links := p.Links.(type) {
+	case pipeline.DBLinks:
+		db, table := links.DB, links.TableName
+		if err := database.CreateFundTable(ctx, db, table); err != nil {
+			return err
+		}
+		if s.cfg.Factsheet.Info {
+			if err := database.CreateFundInfoTable(ctx, db, database.InfoTable(table)); err != nil {
+				return err
+			}
+		}
+		if s.cfg.Factsheet.Distributions {
+			if err := database.CreateDistributionTable(ctx, db, database.DistributionTable(table)); err != nil {
+				return err
+			}
+		}
+		if s.cfg.Factsheet.Allocations {
+			if err := database.CreateAllocationTable(ctx, db, database.AllocationTable(table)); err != nil {
+				return err
+			}
+		}
+		return database.MigrateFactsheetTables(ctx, db, table)
+	case *pipeline.ExcelLinks:
+		if s.source == "planning" {
+			return local.MigrateCodes(links.Path, links.Sheet, "Info", "Allocations")
+		}
 	}
-
-	wg.Wait()
+	return nil
 }
 
-func getFundLinksLocal(planningRelativeFilepath string, fundNames []string) []database.Fund {
-	// Set up scraping tools
-	browser, l := scraper.InitialiseBrowser()
-	defer l.Cleanup()
-
-	concBrowser := &scraper.ConcBrowser{Browser: browser}
-	browser = concBrowser.Browser
-	defer browser.MustClose()
-
-	pool := rod.NewPagePool(scraper.PoolLimit)
-	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
-
-	scraper.CloseBrowserOnForceExit(browser)
-
-	fundsNotIn, err := local.FundsNotInNames(planningRelativeFilepath, "Link", fundNames)
+func scrape(ctx context.Context, s settings) error {
+	p, err := newPipeline(ctx, s)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	if len(fundsNotIn) == 0 {
-		funds, err := local.FundsByNames(planningRelativeFilepath, "Link", fundNames)
+	if s.dryRun {
+		plan, err := p.Plan(ctx)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		return funds
+		plan.Print(os.Stdout)
+		return nil
 	}
-
-	log.Printf("%s not in DB, starting scrape to get fund links", fundsNotIn)
-
-	page := browser.MustPage()
-	page.MustNavigate(scraper.FSMfundSelectorSite).MustWaitLoad()
-
-	var fundsToAdd []database.Fund
-	for _, fundName := range fundsNotIn {
-		if err != nil {
-			log.Fatalf("Error creating new page from pool")
-		} else {
-			log.Printf("Getting link for %s", fundName)
-		}
-
-		fundLink := scraper.FindFundLink(fundName, page)
-
-		fundsToAdd = append(fundsToAdd, database.Fund{Fundname: fundName, Link: fundLink})
+	if err := prepareStores(ctx, s, p); err != nil {
+		return err
 	}
 
-	if len(fundsToAdd) != 0 {
-		local.AddFunds(fundsToAdd, planningRelativeFilepath, "Link")
+	summary, err := p.Run(ctx)
+	if len(summary.Results) != 0 {
+		summary.Print(os.Stdout)
 	}
-
-	funds, err := local.FundsByNames(planningRelativeFilepath, "Link", fundNames)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	return funds
+	if summary.Interrupted {
+		return fmt.Errorf("run %s interrupted", summary.RunID)
+	}
+	if failed := summary.Failed(); len(failed) != 0 {
+		return fmt.Errorf("%d funds failed in run %s", len(failed), summary.RunID)
+	}
+	return nil
 }
 
-func getFundLinksDB(db *sql.DB, fundNames []string, tableName string) []database.Fund {
-	// Set up scraping tools
-	browser, l := scraper.InitialiseBrowser()
-	defer l.Cleanup()
-
-	concBrowser := &scraper.ConcBrowser{Browser: browser}
-	browser = concBrowser.Browser
-	defer browser.MustClose()
-
-	pool := rod.NewPagePool(scraper.PoolLimit)
-	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
+func resolveLinks(ctx context.Context, s settings) error {
+	p, err := newPipeline(ctx, s)
+	if err != nil {
+		return err
+	}
 
-	scraper.CloseBrowserOnForceExit(browser)
+	fundNames, err := p.Source.FundNames(ctx)
+	if err != nil {
+		return err
+	}
 
-	fundsNotIn, err := database.FundsNotInNames(db, tableName, fundNames)
+	funds, failed, err := p.ResolveLinks(ctx, fundNames)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	for _, result := range failed {
+		log.Printf("No link for %s: %v", result.Fund.Fundname, result.Err)
 	}
+	log.Printf("%d/%d funds have links", len(funds), len(fundNames))
+	return nil
+}
 
-	if len(fundsNotIn) == 0 {
-		funds, err := database.FundsByNames(db, tableName, fundNames)
-		if err != nil {
-			log.Fatal(err)
+// crawlUniverse walks the fund selector listing and adds every fund not in the funds table yet
+func crawlUniverse(ctx context.Context, s settings) error {
+	p, err := newPipeline(ctx, s)
+	if err != nil {
+		return err
+	}
+	if links, ok := p.Links.(pipeline.DBLinks); ok {
+		// Adds fund codes to a funds table made before funds were keyed on them
+		if err := database.CreateFundTable(ctx, links.DB, links.TableName); err != nil {
+			return err
 		}
-		return funds
 	}
 
-	createPages(browser, &pool)
+	cfg := s.cfg.Crawl
+	cfg.MaxPages = s.maxPages
+	listed, added, err := p.Crawl(ctx, scraper.NewCrawler(cfg))
+	if err != nil {
+		return err
+	}
+	log.Printf("Crawled %d funds, added %d to %s", len(listed), added, s.tableName)
+	return nil
+}
 
-	log.Printf("%s not in DB, starting scrape to get fund links", fundsNotIn)
+func processDownloads(ctx context.Context, s settings) error {
+	fundNames, err := local.GetFundsOwned(s.planningPath)
+	if err != nil {
+		return err
+	}
+	return downloads.ProcessDownloads(fundNames, s.cfg.Browser.DownloadDir, s.cfg.Paths.Data, s.cfg.Paths.CompileScript)
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(fundsNotIn))
+func status(ctx context.Context, s settings) error {
+	p, err := newPipeline(ctx, s)
+	if err != nil {
+		return err
+	}
+	return printStatus(ctx, os.Stdout, p, s)
+}
 
-	for _, fundName := range fundsNotIn {
-		go func() {
-			defer wg.Done()
-			page, err := pool.Get(func() (*rod.Page, error) { return browser.MustIncognito().MustPage(), nil }) //Create a new page in page pool, must use .MustIncognito for concurrency
-			defer pool.Put(page)
+func printStatus(ctx context.Context, w io.Writer, p *pipeline.Pipeline, s settings) error {
+	fundNames, err := p.Source.FundNames(ctx)
+	if err != nil {
+		return err
+	}
+	fundsNotIn, err := p.Links.FundsNotInNames(ctx, fundNames)
+	if err != nil {
+		return err
+	}
 
-			if err != nil {
-				log.Fatalf("Error creating new page from pool")
-			} else {
-				log.Printf("Getting link for %s", fundName)
-			}
+	if err := printRuns(w, s.cfg.Paths.Runs, 5); err != nil {
+		return err
+	}
 
-			fundLink := scraper.FindFundLink(fundName, page)
+	fmt.Fprintf(w, "Funds in %s: %d\n", s.source, len(fundNames))
+	fmt.Fprintf(w, "With links:     %d\n", len(fundNames)-len(fundsNotIn))
+	fmt.Fprintf(w, "Missing links:  %v\n", fundsNotIn)
 
-			database.AddFund(db, tableName, database.Fund{Fundname: fundName, Link: fundLink})
-			concBrowser.Counter++
-			log.Printf("%d/%d links successfully extracted", concBrowser.Counter, len(fundsNotIn))
-		}()
+	if p.Select == nil {
+		return nil
 	}
 
-	wg.Wait()
-
-	funds, err := database.FundsByNames(db, tableName, fundNames)
+	funds, err := p.Links.FundsByNames(ctx, fundNames)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	selected, err := p.Select.Select(ctx, funds)
+	if err != nil {
+		return err
 	}
+	fmt.Fprintf(w, "Not downloaded within %d days: %d\n", s.downloadWithinDays, len(selected))
 
-	return funds
+	return nil
 }
 
-func createPages(browser *rod.Browser, pool *rod.Pool[rod.Page]) {
-	for i := 0; i < scraper.PoolLimit; i++ {
-		page, err := pool.Get(func() (*rod.Page, error) { return browser.MustIncognito().MustPage(), nil }) //Create a new page in page pool, must use .MustIncognito for concurrency
+// printRuns lists the last n run journals with how many funds are in each state
+func printRuns(w io.Writer, dir string, n int) error {
+	ids, err := journal.List(dir)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(w, "Recent runs:")
+	for _, id := range ids[max(0, len(ids)-n):] {
+		j, err := journal.Open(dir, id)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		page.MustNavigate(scraper.FSMfundSelectorSite).MustWaitLoad()
-		defer pool.Put(page)
+		counts := j.Counts()
+		j.Close()
+
+		fmt.Fprintf(w, "  %s %-9s done %d, failed %d, not finished %d\n", j.ID, j.Source, counts[journal.Done], counts[journal.Failed], counts[journal.Pending]+counts[journal.InProgress])
 	}
+	fmt.Fprintln(w)
+
+	return nil
 }
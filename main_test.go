@@ -1,106 +1,152 @@
 package main
 
 import (
-	"reflect"
+	"bytes"
+	"context"
+	"io"
+	"scraper/internal/config"
 	"scraper/internal/database"
-	"scraper/internal/local"
-	"scraper/internal/scraper"
-	"sort"
+	"scraper/internal/journal"
+	"scraper/internal/pipeline"
+	"scraper/internal/selectors"
+	"strings"
 	"testing"
-
-	"github.com/go-rod/rod"
+	"time"
 )
 
-func TestMainDB(t *testing.T) {
-	tableName := "testfunds"
-	db := database.ConnectDB()
+type fakeLinks struct {
+	funds []database.Fund
+}
 
-	database.CreateTestFundTable(db, tableName)
-	funds := []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}, {Fundname: "fund3", Link: "link3"}}
+func (l fakeLinks) FundsByNames(ctx context.Context, names []string) ([]database.Fund, error) {
+	var funds []database.Fund
+	for _, fund := range l.funds {
+		for _, name := range names {
+			if fund.Fundname == name {
+				funds = append(funds, fund)
+			}
+		}
+	}
+	return funds, nil
+}
 
+func (l fakeLinks) FundsNotInNames(ctx context.Context, names []string) ([]string, error) {
+	funds, _ := l.FundsByNames(ctx, names)
+	var found []string
 	for _, fund := range funds {
-		database.AddFund(db, tableName, fund)
+		found = append(found, fund.Fundname)
 	}
+	return database.Difference(names, found), nil
+}
 
-	browser, l := scraper.InitialiseBrowser()
-	defer l.Cleanup()
-	defer browser.MustClose()
+func (l fakeLinks) AddFund(ctx context.Context, fund database.Fund) error { return nil }
 
-	pool := rod.NewPagePool(scraper.PoolLimit)
-	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
+type firstFund struct{}
 
-	t.Run("Testing getting links", func(t *testing.T) {
-		actualFunds := []database.Fund{{Fundname: "AB FCP I Global Equity Blend A SGD", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}, {Fundname: "abrdn SICAV I - Asian Credit Sustainable Bond A Gross MIncA SGD-H", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ABD035"}}
-		fundNames := []string{"fund1", "fund2", "fund3"}
-		expected := funds
+func (firstFund) Select(ctx context.Context, funds []database.Fund) ([]database.Fund, error) {
+	return funds[:1], nil
+}
 
-		// Add new actual funds to expected funds
-		for _, fund := range actualFunds {
-			fundNames = append(fundNames, fund.Fundname)
-			expected = append(expected, fund)
-		}
+func TestMainStatus(t *testing.T) {
+	p := &pipeline.Pipeline{
+		Source: pipeline.ListSource{Reader: strings.NewReader("fund1\nfund2\nfund3")},
+		Links:  fakeLinks{funds: []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}}},
+		Select: firstFund{},
+	}
 
-		gotFunds := getFundLinksDB(db, fundNames, tableName)
-		var got []database.Fund
-		for _, fund := range gotFunds {
-			fund.ID = 0
-			got = append(got, fund)
-		}
+	cfg := config.Default()
+	cfg.Paths.Runs = t.TempDir()
+	if _, err := journal.New(cfg.Paths.Runs, "watchlist", []database.Fund{{Fundname: "fund1", Link: "link1"}}); err != nil {
+		t.Fatal(err)
+	}
 
-		got = sortFunds(t, got)
-		expected = sortFunds(t, expected)
+	var out bytes.Buffer
+	if err := printStatus(context.Background(), &out, p, settings{cfg: cfg, source: "watchlist", downloadWithinDays: 3}); err != nil {
+		t.Fatal(err)
+	}
 
-		if !reflect.DeepEqual(got, expected) {
-			t.Fatalf("Get fund links failed. Expected: %+v, Got: %+v", expected, got)
+	for _, want := range []string{"watchlist done 0, failed 0, not finished 1", "Funds in watchlist: 3", "With links:     2", "Missing links:  [fund3]", "Not downloaded within 3 days: 1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected status to contain %q, got:\n%s", want, out.String())
 		}
-	})
+	}
 }
 
-func TestMainLocal(t *testing.T) {
-	filepath := "internal/local/TestPlanning.xlsx"
-
-	funds := []database.Fund{{Fundname: "fund1", Link: "link1"}, {Fundname: "fund2", Link: "link2"}, {Fundname: "fund3", Link: "link3"}}
+func TestDaemonSchedule(t *testing.T) {
+	cfg := config.Default()
+	cfg.Daemon.Jobs = []config.Job{
+		{Name: "planning", Schedule: "0 19 * * *", Source: "planning"},
+		{Schedule: "0 1 * * *", Source: "universe", Batchsize: 290},
+	}
 
-	local.AddFunds(funds, filepath, "Link")
+	jobs, loc, err := parseJobs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	browser, l := scraper.InitialiseBrowser()
-	defer l.Cleanup()
-	defer browser.MustClose()
+	t.Run("Testing next job is the soonest", func(t *testing.T) {
+		next, at := nextJob(jobs, time.Date(2024, 8, 23, 20, 0, 0, 0, loc))
+		if next.Name != "universe" || !at.Equal(time.Date(2024, 8, 24, 1, 0, 0, 0, loc)) {
+			t.Fatalf("Expected universe job at 01:00, got %s at %s", next.Name, at)
+		}
 
-	pool := rod.NewPagePool(scraper.PoolLimit)
-	defer pool.Cleanup(func(p *rod.Page) { p.MustClose() })
+		s := jobSettings(defaultSettings(cfg), next)
+		if s.source != "universe" || s.batchsize != 290 || s.downloadFolder != cfg.Paths.UniverseDownloads || s.downloadWithinDays != cfg.Scrape.DownloadWithinDays {
+			t.Fatalf("Unexpected settings for universe job %+v", s)
+		}
+	})
 
-	t.Run("Testing getting links", func(t *testing.T) {
-		actualFunds := []database.Fund{{Fundname: "AB FCP I Global Equity Blend A SGD", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ACM019"}, {Fundname: "abrdn SICAV I - Asian Credit Sustainable Bond A Gross MIncA SGD-H", Link: "https://secure.fundsupermart.com/fsmone/funds/factsheet/ABD035"}}
-		fundNames := []string{"fund1", "fund2", "fund3"}
-		expected := funds
+	t.Run("Testing schedule is printed in SGT", func(t *testing.T) {
+		var out bytes.Buffer
+		printSchedule(&out, jobs[:1], time.Date(2024, 8, 23, 10, 0, 0, 0, time.UTC).In(loc), 2)
 
-		// Add new actual funds to expected funds
-		for _, fund := range actualFunds {
-			fundNames = append(fundNames, fund.Fundname)
-			expected = append(expected, fund)
+		for _, want := range []string{"planning (planning, 0 19 * * *)", "Fri 2024-08-23 19:00 +08", "Sat 2024-08-24 19:00 +08"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Expected schedule to contain %q, got:\n%s", want, out.String())
+			}
 		}
+	})
 
-		gotFunds := getFundLinksLocal(filepath, fundNames)
-		var got []database.Fund
-		for _, fund := range gotFunds {
-			fund.ID = 0
-			got = append(got, fund)
+	t.Run("Testing invalid jobs", func(t *testing.T) {
+		cfg.Daemon.Jobs = []config.Job{{Schedule: "0 19 * *", Source: "planning"}}
+		if _, _, err := parseJobs(cfg); err == nil {
+			t.Error("Expected error for schedule with 4 fields")
+		}
+		cfg.Daemon.Jobs = []config.Job{{Schedule: "0 19 * * *", Source: "everything"}}
+		if _, _, err := parseJobs(cfg); err == nil {
+			t.Error("Expected error for unknown source")
 		}
+		cfg.Daemon.Jobs = []config.Job{{Schedule: "0 0 31 2 *", Source: "planning"}}
+		if _, _, err := parseJobs(cfg); err == nil {
+			t.Error("Expected error for schedule that never runs")
+		}
+	})
+}
 
-		got = sortFunds(t, got)
-		expected = sortFunds(t, expected)
+func TestSelectorResults(t *testing.T) {
+	reg := selectors.Default()
+	results := []selectors.Result{
+		{Name: "price_tab", Page: "factsheet", Matched: 0, Candidate: "//span[normalize-space(text())='Price']"},
+		{Name: "export_button", Page: "factsheet", Matched: 1, Candidate: "//button[contains(normalize-space(.), 'Export')]"},
+		{Name: "search_bar", Page: "fund_selector", Matched: -1, NoSnapshot: true},
+	}
 
-		if !reflect.DeepEqual(got, expected) {
-			t.Fatalf("Get fund links failed. Expected: %+v, Got: %+v", expected, got)
+	t.Run("Testing fallbacks and unchecked selectors pass", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := printSelectorResults(&out, reg, results); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"Selectors version 1", "OK           price_tab", "FALLBACK     export_button (factsheet) candidate 2", "NO SNAPSHOT  search_bar (fund_selector.html)", "1 selectors not checked"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+			}
 		}
 	})
-}
 
-func sortFunds(t testing.TB, funds []database.Fund) []database.Fund {
-	t.Helper()
-	sort.Slice(funds, func(i, j int) bool {
-		return funds[i].Fundname > funds[j].Fundname
+	t.Run("Testing missing selectors fail", func(t *testing.T) {
+		missing := append(results, selectors.Result{Name: "range", Page: "factsheet", Matched: -1})
+		if err := printSelectorResults(io.Discard, reg, missing); err == nil {
+			t.Fatal("Expected an error for a missing selector")
+		}
 	})
-	return funds
 }
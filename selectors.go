@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"scraper/internal/scraper"
+	"scraper/internal/selectors"
+
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// checkSelectors loads each saved snapshot into a headless browser and reports which candidate of every selector is
+// found, failing if any selector matches nothing
+func checkSelectors(ctx context.Context, s settings) error {
+	browserCfg := s.cfg.Browser
+	browserCfg.Headless = true
+	browser, l, err := scraper.InitialiseBrowser(browserCfg)
+	if err != nil {
+		return err
+	}
+	defer l.Cleanup()
+	defer browser.Close()
+
+	page, err := browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return err
+	}
+
+	results, err := scraper.Selectors.Check(page.Context(ctx), s.snapshotsDir)
+	if err != nil {
+		return err
+	}
+	return printSelectorResults(os.Stdout, scraper.Selectors, results)
+}
+
+func printSelectorResults(w io.Writer, reg *selectors.Registry, results []selectors.Result) error {
+	fmt.Fprintf(w, "Selectors version %d\n", reg.Version)
+
+	missing, unchecked := 0, 0
+	for _, r := range results {
+		fmt.Fprintln(w, r)
+		switch {
+		case r.NoSnapshot:
+			unchecked++
+		case r.Matched < 0:
+			missing++
+		}
+	}
+
+	if unchecked != 0 {
+		fmt.Fprintf(w, "%d selectors not checked, save their pages into the snapshots folder\n", unchecked)
+	}
+	if missing != 0 {
+		return fmt.Errorf("%d selectors found nothing on their snapshot", missing)
+	}
+	return nil
+}